@@ -2,46 +2,74 @@ package app
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/bcambl/rtmpauthbot/config"
 	"github.com/bcambl/rtmpauthbot/controllers"
+	"github.com/bcambl/rtmpauthbot/router"
+	"github.com/bcambl/rtmpauthbot/store"
 	log "github.com/sirupsen/logrus"
-	bolt "go.etcd.io/bbolt"
 )
 
-// DataBuckets is a slice of all buckets that exist throught the project
-var DataBuckets = []string{
-	"ConfigBucket",             // General configuration & caching
-	"PublisherBucket",          // Local publishers -> rtmp stream keys
-	"RTMPLiveBucket",           // Local publishers -> rtmp live stream status
-	"TwitchStreamBucket",       // Local publishers -> twitch stream names
-	"TwitchLiveBucket",         // Local publishers -> twitch live stream status
-	"TwitchNotificationBucket", // Local publishers -> twitch notification state
-	"StreamInfoBucket",         // Local publishers -> generic stream information
+// Run parses the command line and runs a subcommand or the server until the
+// process receives SIGINT or SIGTERM
+func Run() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, os.Args[1:])
+	stop()
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		// list each problem on its own line
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
-func init() {
-	debugFlag := flag.Bool("debug", false, "enable debug logging")
-	envVarsFlag := flag.Bool("environment", false, "print environment variables with defaults")
-	licenseFlag := flag.Bool("license", false, "print project license")
-	unitFileFlag := flag.Bool("unitfile", false, "print a systemd unit-file template")
-	flag.Parse()
+// run parses the flags and runs the subcommand given in args or serves until
+// the context is cancelled
+func run(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rtmpauthbot", flag.ContinueOnError)
+	debugFlag := fs.Bool("debug", false, "enable debug logging")
+	envVarsFlag := fs.Bool("environment", false, "print environment variables with defaults")
+	licenseFlag := fs.Bool("license", false, "print project license")
+	unitFileFlag := fs.Bool("unitfile", false, "print a systemd unit-file template")
+	configFlag := fs.String("config", "", "read settings from a yaml config file")
+	overrides := settingFlag{}
+	fs.Var(overrides, "set", "override a setting as key=value, may be repeated")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot [flags] [command]")
+		fs.PrintDefaults()
+		fmt.Fprint(fs.Output(), "\n"+commandUsage)
+	}
+	err := fs.Parse(args)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
 	if *licenseFlag {
 		config.PrintLicense()
-		os.Exit(0)
+		return nil
 	}
 	if *envVarsFlag {
 		config.PrintEnv()
-		os.Exit(0)
+		return nil
 	}
 	if *unitFileFlag {
 		config.PrintSystemDUnit()
-		os.Exit(0)
+		return nil
 	}
 
 	logLevel := log.InfoLevel
@@ -51,80 +79,211 @@ func init() {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(logLevel)
 
-	// Initialize the database
-	db, err := bolt.Open(config.DatabasePath(), 0700, nil)
+	// settings of the config file are overridden by the environment, which
+	// is overridden by -set flags
+	conf, err := config.Load(*configFlag, overrides)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.Close()
 
-	for b := range DataBuckets {
-		log.Debug("db: ensuring bucket exists: ", DataBuckets[b])
-		db.Update(func(tx *bolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists([]byte(DataBuckets[b]))
-			if err != nil {
-				return fmt.Errorf("error creating bucket: %s", err)
-			}
-			return nil
-		})
+	// run a subcommand instead of the server when one is given
+	if fs.NArg() > 0 && fs.Arg(0) != "serve" {
+		return runCommand(conf, fs.Args())
 	}
+
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+	return serve(ctx, conf, func() (*config.Config, error) {
+		return config.Load(*configFlag, overrides)
+	})
 }
 
-// Run performs setup and starts the server.
-func Run() {
+// settingFlag collects repeated key=value setting overrides
+type settingFlag map[string]string
 
-	var conf config.Config
-	err := conf.ParseEnv()
-	if err != nil {
-		log.Fatal(err)
+func (f settingFlag) String() string {
+	return ""
+}
+
+func (f settingFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value")
 	}
+	f[key] = val
+	return nil
+}
 
-	db, err := bolt.Open(config.DatabasePath(), 0700, nil)
+// serve runs the server & background schedulers until the context is
+// cancelled. The configuration is re-read with load on SIGHUP. Running polls
+// are cancelled and open requests are given SHUTDOWN_TIMEOUT to complete
+// before the database is closed.
+func serve(ctx context.Context, conf *config.Config, load func() (*config.Config, error)) error {
+	st, err := store.Open(conf.DatabaseBackend, conf.DatabasePath())
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	defer db.Close()
+	defer st.Close()
+
+	c := controllers.NewController(conf, st)
+	c.Events = controllers.NewEventHub(256)
+
+	// background schedulers are stopped before the database is closed
+	s := &schedulers{c: c}
+	defer func() {
+		ctx, done := context.WithTimeout(context.Background(), c.Config().ShutdownTimeout)
+		defer done()
+		s.stop(ctx)
+	}()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s.apply(ctx)
+
+	r := &reloader{ctx: ctx, c: c, s: s, load: load}
+	c.Reload = r.reload
+	c.ConfigChanged = func() { s.apply(ctx) }
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	listenAddress := fmt.Sprintf("%s:%s", conf.AuthServerIP, conf.AuthServerPort)
+	srv := &http.Server{Addr: listenAddress, Handler: Handler(c)}
+	// end event streams, which would otherwise keep the server draining
+	srv.RegisterOnShutdown(c.Events.Close)
 
-	c := controllers.Controller{Config: &conf, DB: db}
+	// Serve
+	log.Infof("starting rtmpauthbot server on %s", listenAddress)
+	if conf.AdminPassword == "" {
+		log.Warn("admin dashboard & /api disabled (ADMIN_PASSWORD not set)")
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+	for running := true; running; {
+		select {
+		case err = <-served:
+			return err
+		case <-hup:
+			log.Info("received SIGHUP, reloading configuration")
+			err = r.reload()
+			if err != nil {
+				log.Error("configuration not reloaded: ", err)
+			}
+		case <-ctx.Done():
+			running = false
+		}
+	}
 
-	// Start Twitch polling scheduler if integration is enabled
-	if c.Config.TwitchEnabled {
-		log.Infof("twitch integration enabled")
-		log.Infof("starting twitch scheduler (poll rate: %s)", c.Config.TwitchPollRate.String())
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-		c.TwitchScheduler(ctx, c.Config.TwitchPollRate)
-	} else {
-		log.Infof("twitch integration disabled")
+	log.Infof("shutting down, waiting up to %s for open requests", c.Config().ShutdownTimeout)
+	cancel()
+	shutdownCtx, done := context.WithTimeout(context.Background(), c.Config().ShutdownTimeout)
+	defer done()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Warn("error draining open requests: ", err)
 	}
+	if err = <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// schedulers & slash commands share the deadline of the open requests
+	s.stop(shutdownCtx)
+	err = c.Wait(shutdownCtx)
+	if err != nil {
+		log.Warn("slash commands still being answered at shutdown")
+	}
+	log.Info("server stopped")
+	return nil
+}
+
+// Handler returns the http handler of the server, all routes behind the admin
+// authentication
+func Handler(c *controllers.Controller) http.Handler {
+	return c.RequireAuth(routes(c))
+}
+
+// routes returns the router of all http handlers
+func routes(c *controllers.Controller) *router.Router {
+	rt := router.New()
+	rt.NotFound = http.HandlerFunc(controllers.NotFoundHandler)
+	rt.MethodNotAllowed = http.HandlerFunc(controllers.MethodNotAllowedHandler)
 
 	// Root Handler
-	http.HandleFunc("/", c.IndexHandler)
+	rt.HandleFunc("", "/", c.IndexHandler)
 
 	// Play Handlers
-	http.HandleFunc("/on_play", c.OnPlayHandler)
-	http.HandleFunc("/on_play_done", c.OnPlayDoneHandler)
+	rt.HandleFunc("", "/on_play", c.OnPlayHandler)
+	rt.HandleFunc("", "/on_play_done", c.OnPlayDoneHandler)
 
 	// Publish Handlers
-	http.HandleFunc("/on_publish", c.OnPublishHandler)
-	http.HandleFunc("/on_publish_done", c.OnPublishDoneHandler)
+	rt.HandleFunc("", "/on_publish", c.OnPublishHandler)
+	rt.HandleFunc("", "/on_publish_done", c.OnPublishDoneHandler)
 
 	// API Endpoints
-	http.HandleFunc("/api/publisher", c.PublisherAPIHandler)
-
-	// if the listen address env variables are not set, set to sane default
-	if conf.AuthServerIP == "" {
-		conf.AuthServerIP = "127.0.0.1"
+	rt.HandleFunc("GET", "/api/v1/publishers", c.ListPublishersHandler)
+	rt.HandleFunc("POST", "/api/v1/publishers", c.CreatePublisherHandler)
+	rt.HandleFunc("GET", "/api/v1/publishers/{name}", c.GetPublisherHandler)
+	rt.HandleFunc("PUT", "/api/v1/publishers/{name}", c.UpdatePublisherHandler)
+	rt.HandleFunc("PATCH", "/api/v1/publishers/{name}", c.UpdatePublisherHandler)
+	rt.HandleFunc("DELETE", "/api/v1/publishers/{name}", c.DeletePublisherHandler)
+	for _, method := range []string{"GET", "PUT", "POST"} {
+		rt.HandleFunc(method, "/api/v1/publishers/{name}/key", c.PublisherKeyHandler)
 	}
-	if conf.AuthServerPort == "" {
-		conf.AuthServerPort = "9090"
+	rt.HandleFunc("GET", "/api/v1/publishers/{name}/sessions", c.PublisherSessionsHandler)
+	for _, method := range []string{"GET", "PUT", "POST", "DELETE"} {
+		rt.HandleFunc(method, "/api/v1/publishers/{name}/links", c.PublisherLinksHandler)
 	}
-	listenAddress := fmt.Sprintf("%s:%s", conf.AuthServerIP, conf.AuthServerPort)
+	rt.HandleFunc("POST", "/api/v1/notifications/test", c.TestNotificationHandler)
+	rt.HandleFunc("GET", "/api/admin/backup", c.BackupHandler)
+	rt.HandleFunc("POST", "/api/admin/reload", c.ReloadHandler)
+	rt.HandleFunc("GET", "/api/settings", c.SettingsHandler)
+	rt.HandleFunc("PUT", "/api/settings", c.SettingsHandler)
+	rt.HandleFunc("GET", "/api/settings/audit", c.SettingsAuditHandler)
+	rt.HandleFunc("GET", "/api/openapi.json", c.OpenAPIHandler)
+	rt.HandleFunc("GET", "/api/events", c.EventsHandler)
+	rt.HandleFunc("GET", "/api/events/ws", c.EventsWebSocketHandler)
 
-	// Serve
-	log.Infof("starting rtmpauthbot server on %s", listenAddress)
-	err = http.ListenAndServe(listenAddress, nil)
-	if err != nil {
-		log.Fatal(err)
+	// prometheus metrics
+	rt.HandleFunc("GET", "/metrics", c.MetricsHandler)
+
+	// public read-only endpoints which are safe to expose
+	for _, method := range []string{"GET", "OPTIONS"} {
+		rt.HandleFunc(method, "/public/live", c.PublicLiveHandler)
+		rt.HandleFunc(method, "/public/badge/{badge}", c.PublicBadgeHandler)
+		rt.HandleFunc(method, "/public/events", c.PublicEventsHandler)
 	}
+	rt.HandleFunc("GET", "/public/events/ws", c.PublicEventsWebSocketHandler)
+
+	// admin dashboard & its login session
+	rt.HandleFunc("GET", "/admin/{path...}", c.DashboardHandler)
+	rt.HandleFunc("GET", "/admin", c.DashboardHandler)
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		rt.HandleFunc(method, "/api/session", c.SessionHandler)
+	}
+
+	// member portal with discord login
+	rt.HandleFunc("GET", "/portal/login", c.PortalLoginHandler)
+	rt.HandleFunc("GET", "/portal/callback", c.PortalCallbackHandler)
+	rt.HandleFunc("POST", "/portal/logout", c.PortalLogoutHandler)
+	rt.HandleFunc("GET", "/portal/api/me", c.PortalMeHandler)
+	rt.HandleFunc("PATCH", "/portal/api/me", c.PortalMeHandler)
+	rt.HandleFunc("POST", "/portal/api/me/key", c.PortalKeyHandler)
+	rt.HandleFunc("GET", "/portal/api/me/sessions", c.PortalSessionsHandler)
+	rt.HandleFunc("GET", "/portal/{path...}", c.PortalHandler)
+	rt.HandleFunc("GET", "/portal", c.PortalHandler)
+	rt.HandleFunc("GET", "/api/v1/portal/allow-list", c.AllowListHandler)
+	rt.HandleFunc("PUT", "/api/v1/portal/allow-list", c.AllowListHandler)
+
+	// discord slash commands
+	rt.HandleFunc("POST", "/discord/interactions", c.DiscordInteractionsHandler)
+
+	// Legacy API Endpoints
+	rt.HandleFunc("", "/api/publisher", c.PublisherAPIHandler)
+	rt.HandleFunc("GET", "/api/publisher/{name}", c.PublisherItemHandler)
+	rt.HandleFunc("PUT", "/api/publisher/{name}", c.PublisherItemHandler)
+	rt.HandleFunc("PATCH", "/api/publisher/{name}", c.PublisherItemHandler)
+
+	return rt
 }
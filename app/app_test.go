@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.PanicLevel)
+}
+
+// freePort returns a tcp port which is free to listen on
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return fmt.Sprint(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestServeShutdown(t *testing.T) {
+	// the owncast instance never answers, so the poll is running at shutdown
+	polled, cancelled := make(chan struct{}, 1), make(chan struct{}, 1)
+	owncast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case polled <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+		cancelled <- struct{}{}
+	}))
+	defer owncast.Close()
+
+	port := freePort(t)
+	conf, err := config.Load("", map[string]string{
+		"DATA_PATH":         t.TempDir(),
+		"AUTH_SERVER_IP":    "127.0.0.1",
+		"AUTH_SERVER_PORT":  port,
+		"OWNCAST_ENABLED":   "true",
+		"OWNCAST_POLL_RATE": "5",
+		"SHUTDOWN_TIMEOUT":  "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.Open(conf.DatabaseBackend, conf.DatabasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = st.UpsertPublisher("alice", func(p *models.Publisher) error {
+		p.Key = "alicekey"
+		p.Links = []models.StreamLink{{Provider: "owncast", Account: owncast.URL}}
+		return nil
+	})
+	st.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, conf, func() (*config.Config, error) { return conf, nil })
+	}()
+
+	select {
+	case <-polled:
+	case err = <-served:
+		t.Fatalf("server stopped before polling: %v", err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("owncast instance was not polled")
+	}
+	resp, err := http.Get("http://127.0.0.1:" + port + "/public/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the server to be up, got %d", resp.StatusCode)
+	}
+
+	started := time.Now()
+	cancel()
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop within the shutdown timeout")
+	}
+	if elapsed := time.Since(started); elapsed > 2*conf.ShutdownTimeout {
+		t.Errorf("expected shutdown within %s, took %s", conf.ShutdownTimeout, elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("expected the running poll to be cancelled")
+	}
+
+	// the database is closed once serve returns
+	st, err = store.Open(conf.DatabaseBackend, conf.DatabasePath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Close()
+}
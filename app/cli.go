@@ -0,0 +1,503 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bcambl/rtmpauthbot/client"
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiURLEnv is the environment variable of the default server url used by
+// the management commands
+const apiURLEnv = "RTMPAUTHBOT_API_URL"
+
+// commandUsage lists the subcommands of the binary
+const commandUsage = `commands:
+  serve                              start the server (default)
+  publisher list                     list publishers
+  publisher show <name>              show a publisher & its key
+  publisher add <name> [-key k] [-twitch login]
+                                     add a publisher, a key is generated if omitted
+  publisher rm <name>                remove a publisher
+  publisher rotate <name>            replace the key of a publisher
+  twitch check <login>               verify a twitch channel & show its live status
+  notify test                        post a test notification to discord
+  db check                           verify the integrity of the database
+  config check                       print the effective configuration & its problems
+  export, import                     export or import the database as json
+  discord-commands                   register the discord slash commands
+
+publisher commands open the database directly, which requires the server to
+be stopped when using bbolt. publisher & notify commands manage a running
+server through the http api with -api url (default: $RTMPAUTHBOT_API_URL)
+authenticated with $ADMIN_USERNAME & $ADMIN_PASSWORD. -json prints json
+instead of tables.
+`
+
+// cliOptions are the common flags of the management commands
+type cliOptions struct {
+	api  string
+	json bool
+}
+
+// newFlagSet returns the flag set of a management command with the common
+// flags. The api flag is only added to commands supporting the http api.
+func newFlagSet(name, usage string, api bool) (*flag.FlagSet, *cliOptions) {
+	opts := &cliOptions{}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	if api {
+		fs.StringVar(&opts.api, "api", os.Getenv(apiURLEnv), "url of a running server to manage through the http api")
+	}
+	fs.BoolVar(&opts.json, "json", false, "print json instead of a table")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot "+usage)
+		fs.PrintDefaults()
+	}
+	return fs, opts
+}
+
+// parseArgs parses flags placed before or after the positional arguments and
+// exits with the usage unless exactly n positional arguments are given
+func parseArgs(fs *flag.FlagSet, args []string, n int) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != n {
+		fs.Usage()
+		os.Exit(2)
+	}
+	return positional
+}
+
+// printJSON writes v as indented json to stdout
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// publisherBackend manages publishers directly in the database or through
+// the http api of a running server
+type publisherBackend interface {
+	list() ([]models.Publisher, error)
+	show(name string) (models.Publisher, error)
+	add(name, key, twitch string) (models.Publisher, error)
+	remove(name string) error
+	rotate(name string) (models.Publisher, error)
+	close() error
+}
+
+// storeBackend manages publishers in the database of a stopped server
+type storeBackend struct {
+	c *controllers.Controller
+}
+
+// openStoreBackend opens the database configured in the environment. Twitch
+// accounts are verified if the twitch integration is enabled.
+func openStoreBackend(conf *config.Config) (*storeBackend, error) {
+	st, err := store.Open(conf.DatabaseBackend, conf.DatabasePath())
+	if err != nil {
+		return nil, fmt.Errorf("%s (use -api to manage a running server)", err)
+	}
+	c := controllers.NewController(conf, st)
+	if conf.TwitchEnabled {
+		c.RegisterProvider(controllers.NewTwitchProvider(c))
+	}
+	return &storeBackend{c: c}, nil
+}
+
+func (b *storeBackend) list() ([]models.Publisher, error) {
+	return b.c.Store.ListPublishers()
+}
+
+func (b *storeBackend) show(name string) (models.Publisher, error) {
+	p, err := b.c.Store.GetPublisher(name)
+	if err == store.ErrNotFound {
+		return p, fmt.Errorf("publisher not found: %s", name)
+	}
+	return p, err
+}
+
+func (b *storeBackend) add(name, key, twitch string) (models.Publisher, error) {
+	return b.c.CreatePublisher(name, key, twitch)
+}
+
+func (b *storeBackend) remove(name string) error {
+	return b.c.DeletePublisher(name)
+}
+
+func (b *storeBackend) rotate(name string) (models.Publisher, error) {
+	return b.c.RotateKey(name)
+}
+
+func (b *storeBackend) close() error {
+	return b.c.Store.Close()
+}
+
+// apiBackend manages publishers through the http api of a running server
+type apiBackend struct {
+	ctx context.Context
+	cl  *client.Client
+}
+
+// newAPIClient returns a client of the server authenticated with the admin
+// credentials configured in the environment
+func newAPIClient(baseURL string) *client.Client {
+	cl := client.New(baseURL)
+	cl.Username = os.Getenv("ADMIN_USERNAME")
+	if cl.Username == "" {
+		cl.Username = "admin"
+	}
+	cl.Password = os.Getenv("ADMIN_PASSWORD")
+	return cl
+}
+
+func (b *apiBackend) list() ([]models.Publisher, error) {
+	return b.cl.ListPublishers(b.ctx, client.ListOptions{})
+}
+
+func (b *apiBackend) show(name string) (models.Publisher, error) {
+	return b.cl.GetPublisher(b.ctx, name)
+}
+
+func (b *apiBackend) add(name, key, twitch string) (models.Publisher, error) {
+	return b.cl.CreatePublisher(b.ctx, client.PublisherInput{Name: name, Key: key, TwitchStream: twitch})
+}
+
+func (b *apiBackend) remove(name string) error {
+	return b.cl.DeletePublisher(b.ctx, name)
+}
+
+func (b *apiBackend) rotate(name string) (models.Publisher, error) {
+	_, err := b.cl.RotateKey(b.ctx, name)
+	if err != nil {
+		return models.Publisher{}, err
+	}
+	return b.cl.GetPublisher(b.ctx, name)
+}
+
+func (b *apiBackend) close() error {
+	return nil
+}
+
+// openBackend returns the api backend if a server url is given or the
+// database backend otherwise
+func openBackend(conf *config.Config, opts *cliOptions) (publisherBackend, error) {
+	if opts.api != "" {
+		return &apiBackend{ctx: context.Background(), cl: newAPIClient(opts.api)}, nil
+	}
+	return openStoreBackend(conf)
+}
+
+// linkSummary returns the linked accounts of a publisher for tables
+func linkSummary(p *models.Publisher) string {
+	links := make([]string, 0, len(p.Links))
+	for _, l := range p.Links {
+		links = append(links, l.Provider+":"+l.Account)
+	}
+	return strings.Join(links, ",")
+}
+
+// yesNo formats a boolean for tables
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// printPublishers prints publishers as a table
+func printPublishers(w io.Writer, publishers []models.Publisher) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tLIVE\tUNLISTED\tDISCORD\tLINKS")
+	for i := range publishers {
+		p := &publishers[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", p.Name, yesNo(p.IsLive()), yesNo(p.Unlisted), p.DiscordID, linkSummary(p))
+	}
+	return tw.Flush()
+}
+
+// printPublisher prints the fields of a publisher including its key
+func printPublisher(w io.Writer, p *models.Publisher) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "name:\t%s\n", p.Name)
+	fmt.Fprintf(tw, "key:\t%s\n", p.Key)
+	fmt.Fprintf(tw, "live:\t%s\n", yesNo(p.IsLive()))
+	fmt.Fprintf(tw, "unlisted:\t%s\n", yesNo(p.Unlisted))
+	fmt.Fprintf(tw, "discord id:\t%s\n", p.DiscordID)
+	fmt.Fprintf(tw, "muted:\t%s\n", strings.Join(p.Muted, ","))
+	for _, l := range p.Links {
+		state := l.State
+		if state == "" {
+			state = models.StateOffline
+		}
+		fmt.Fprintf(tw, "link:\t%s:%s (%s)\n", l.Provider, l.Account, state)
+	}
+	fmt.Fprintf(tw, "revision:\t%d\n", p.Revision)
+	return tw.Flush()
+}
+
+// publisherCommand manages publishers
+func publisherCommand(conf *config.Config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: rtmpauthbot publisher list|show|add|rm|rotate")
+	}
+	sub, args := args[0], args[1:]
+	var (
+		fs     *flag.FlagSet
+		opts   *cliOptions
+		key    string
+		twitch string
+		n      = 1
+	)
+	switch sub {
+	case "list":
+		fs, opts = newFlagSet("publisher list", "publisher list [-api url] [-json]", true)
+		n = 0
+	case "show", "rm", "rotate":
+		fs, opts = newFlagSet("publisher "+sub, "publisher "+sub+" [-api url] [-json] <name>", true)
+	case "add":
+		fs, opts = newFlagSet("publisher add", "publisher add [-api url] [-json] [-key key] [-twitch login] <name>", true)
+		fs.StringVar(&key, "key", "", "stream key, a random key is generated if empty")
+		fs.StringVar(&twitch, "twitch", "", "twitch login of the publisher")
+	default:
+		return fmt.Errorf("unknown publisher command: %s", sub)
+	}
+	positional := parseArgs(fs, args, n)
+
+	backend, err := openBackend(conf, opts)
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+
+	if sub == "list" {
+		publishers, err := backend.list()
+		if err != nil {
+			return err
+		}
+		if opts.json {
+			return printJSON(publishers)
+		}
+		return printPublishers(os.Stdout, publishers)
+	}
+
+	name := positional[0]
+	var p models.Publisher
+	switch sub {
+	case "show":
+		p, err = backend.show(name)
+	case "add":
+		p, err = backend.add(name, key, twitch)
+	case "rotate":
+		p, err = backend.rotate(name)
+	case "rm":
+		err = backend.remove(name)
+		if err == nil {
+			log.Infof("publisher removed: %s", name)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if opts.json {
+		return printJSON(p)
+	}
+	return printPublisher(os.Stdout, &p)
+}
+
+// twitchStatus is the result of the twitch check command
+type twitchStatus struct {
+	Login   string `json:"login"`
+	URL     string `json:"url"`
+	Live    bool   `json:"live"`
+	Title   string `json:"title,omitempty"`
+	Game    string `json:"game,omitempty"`
+	Viewers int    `json:"viewers"`
+}
+
+// twitchCommand verifies twitch channels with the configured credentials
+func twitchCommand(conf *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: rtmpauthbot twitch check <login>")
+	}
+	fs, opts := newFlagSet("twitch check", "twitch check [-json] <login>", false)
+	login := parseArgs(fs, args[1:], 1)[0]
+
+	backend, err := openStoreBackend(conf)
+	if err != nil {
+		return err
+	}
+	defer backend.close()
+	if conf.TwitchClientID == "" || conf.TwitchClientSecret == "" {
+		return fmt.Errorf("TWITCH_CLIENT_ID & TWITCH_CLIENT_SECRET are required")
+	}
+
+	// the access token is cached in the database like the server does
+	twitch := controllers.NewTwitchProvider(backend.c)
+	account, err := twitch.ResolveAccount(context.Background(), login)
+	if err != nil {
+		return fmt.Errorf("twitch %s: %s", login, err)
+	}
+	streams, err := twitch.LiveStreams(context.Background(), []string{account})
+	if err != nil {
+		return err
+	}
+	status := twitchStatus{Login: account, URL: twitch.StreamURL(account)}
+	for _, s := range streams {
+		if strings.EqualFold(s.Account, account) && s.Type == "live" {
+			status.Live = true
+			status.Title = s.Title
+			status.Game = s.Category
+			status.Viewers = s.ViewerCount
+		}
+	}
+	if opts.json {
+		return printJSON(status)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "login:\t%s\n", status.Login)
+	fmt.Fprintf(tw, "url:\t%s\n", status.URL)
+	fmt.Fprintf(tw, "live:\t%s\n", yesNo(status.Live))
+	if status.Live {
+		fmt.Fprintf(tw, "title:\t%s\n", status.Title)
+		fmt.Fprintf(tw, "game:\t%s\n", status.Game)
+		fmt.Fprintf(tw, "viewers:\t%d\n", status.Viewers)
+	}
+	return tw.Flush()
+}
+
+// notifyCommand posts a test notification to the discord webhook
+func notifyCommand(conf *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "test" {
+		return fmt.Errorf("usage: rtmpauthbot notify test")
+	}
+	fs, opts := newFlagSet("notify test", "notify test [-api url]", true)
+	parseArgs(fs, args[1:], 0)
+
+	if opts.api != "" {
+		err := newAPIClient(opts.api).TestNotification(context.Background())
+		if err != nil {
+			return err
+		}
+	} else {
+		c := controllers.NewController(conf, nil)
+		err := c.SendTestNotification(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+	log.Info("test notification sent")
+	return nil
+}
+
+// dbCheckResult is the result of the db check command
+type dbCheckResult struct {
+	Backend    string   `json:"backend"`
+	Path       string   `json:"path"`
+	Publishers int      `json:"publishers"`
+	Sessions   int      `json:"sessions"`
+	Problems   []string `json:"problems"`
+}
+
+// dbCommand verifies the integrity of the database & its publishers. The
+// database is opened read-only and pending schema migrations are reported
+// instead of applied.
+func dbCommand(conf *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: rtmpauthbot db check")
+	}
+	fs, opts := newFlagSet("db check", "db check [-json]", false)
+	parseArgs(fs, args[1:], 0)
+
+	result := dbCheckResult{Backend: conf.DatabaseBackend, Path: conf.DatabasePath()}
+	if _, err := os.Stat(result.Path); err != nil {
+		return err
+	}
+	st, err := store.OpenReadOnly(result.Backend, result.Path)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	result.Problems, err = st.Check()
+	if err != nil {
+		return err
+	}
+	version, latest, err := st.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version < latest {
+		// records are only readable with the latest schema
+		result.Problems = append(result.Problems, fmt.Sprintf(
+			"schema version %d has %d pending migrations to version %d, start the server to apply them",
+			version, latest-version, latest))
+		return printDBCheck(result, opts.json)
+	}
+	publishers, err := st.ListPublishers()
+	if err != nil {
+		return err
+	}
+	result.Publishers = len(publishers)
+	owners := make(map[string]string)
+	for i := range publishers {
+		p := &publishers[i]
+		if err := p.IsValid(); err != nil {
+			result.Problems = append(result.Problems, fmt.Sprintf("publisher %s: %s", p.Name, err))
+		}
+		if p.DiscordID == "" {
+			continue
+		}
+		if owner, ok := owners[p.DiscordID]; ok {
+			result.Problems = append(result.Problems, fmt.Sprintf("publishers %s & %s are linked to discord user %s", owner, p.Name, p.DiscordID))
+		}
+		owners[p.DiscordID] = p.Name
+	}
+	sessions, err := st.ListSessions("")
+	if err != nil {
+		return err
+	}
+	result.Sessions = len(sessions)
+	return printDBCheck(result, opts.json)
+}
+
+// printDBCheck prints the result of the db check command and returns an error
+// if problems were found
+func printDBCheck(result dbCheckResult, asJSON bool) error {
+	var err error
+	if asJSON {
+		err = printJSON(result)
+	} else {
+		fmt.Printf("%s database %s: %d publishers, %d sessions\n", result.Backend, result.Path, result.Publishers, result.Sessions)
+		for _, problem := range result.Problems {
+			fmt.Println("problem:", problem)
+		}
+		if len(result.Problems) == 0 {
+			fmt.Println("ok")
+		}
+	}
+	if err == nil && len(result.Problems) > 0 {
+		err = fmt.Errorf("database check found %d problems", len(result.Problems))
+	}
+	return err
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand runs the subcommand named by the first argument
+func runCommand(conf *config.Config, args []string) error {
+	// keep stdout clean for command output
+	log.SetOutput(os.Stderr)
+
+	switch args[0] {
+	case "export":
+		return exportCommand(conf, args[1:])
+	case "import":
+		return importCommand(conf, args[1:])
+	case "discord-commands":
+		return discordCommandsCommand(conf, args[1:])
+	case "publisher":
+		return publisherCommand(conf, args[1:])
+	case "twitch":
+		return twitchCommand(conf, args[1:])
+	case "notify":
+		return notifyCommand(conf, args[1:])
+	case "db":
+		return dbCommand(conf, args[1:])
+	case "config":
+		return configCommand(conf, args[1:])
+	}
+	return fmt.Errorf("unknown command: %s", args[0])
+}
+
+// exportCommand writes a json export of the database to a file or stdout
+func exportCommand(conf *config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	output := fs.String("o", "", "write the export to a file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot export [-o file]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	st, err := store.Open(conf.DatabaseBackend, conf.DatabasePath())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	export, err := store.ExportData(st)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(export)
+	if err != nil {
+		return err
+	}
+	log.Infof("exported %d publishers, %d settings and %d sessions",
+		len(export.Publishers), len(export.Settings), len(export.Sessions))
+	return nil
+}
+
+// importCommand merges a json export into the database
+func importCommand(conf *config.Config, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report changes without modifying the database")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot import [-dry-run] file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var export store.Export
+	err = json.NewDecoder(f).Decode(&export)
+	if err != nil {
+		return fmt.Errorf("error decoding export: %s", err)
+	}
+
+	st, err := store.Open(conf.DatabaseBackend, conf.DatabasePath())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	report, err := store.ImportData(st, export, *dryRun)
+	if err != nil {
+		return err
+	}
+	for i := range report.Changes {
+		fmt.Println(report.Changes[i])
+	}
+	if *dryRun {
+		fmt.Printf("dry run: %d changes, %d unchanged\n", len(report.Changes), report.Unchanged)
+		return nil
+	}
+	fmt.Printf("imported %d changes, %d unchanged\n", len(report.Changes), report.Unchanged)
+	return nil
+}
+
+// discordCommandsCommand registers the slash commands with the discord
+// application configured in the environment
+func discordCommandsCommand(conf *config.Config, args []string) error {
+	fs := flag.NewFlagSet("discord-commands", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot discord-commands")
+		fmt.Fprintln(fs.Output(), "registers the slash commands using DISCORD_CLIENT_ID & DISCORD_BOT_TOKEN")
+	}
+	fs.Parse(args)
+
+	c := controllers.NewController(conf, nil)
+	err := c.RegisterCommands()
+	if err != nil {
+		return err
+	}
+	log.Info("discord slash commands registered")
+	return nil
+}
+
+// configCommand prints the effective configuration with secrets masked and
+// reports all of its problems
+func configCommand(conf *config.Config, args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return fmt.Errorf("usage: rtmpauthbot [-config file] [-set key=value] config check")
+	}
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: rtmpauthbot [-config file] [-set key=value] config check")
+		fmt.Fprintln(fs.Output(), "prints the effective configuration with secrets masked")
+	}
+	fs.Parse(args[1:])
+
+	err := conf.WriteYAML(os.Stdout)
+	if err != nil {
+		return err
+	}
+	err = conf.Validate()
+	if err != nil {
+		return err
+	}
+	log.Info("configuration is valid")
+	return nil
+}
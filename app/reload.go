@@ -0,0 +1,204 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	log "github.com/sirupsen/logrus"
+)
+
+// job is a background scheduler of the configuration
+type job struct {
+	name string
+	// settings the scheduler is started with, it is restarted when they
+	// change
+	settings string
+	// provider is the stateful provider polled by the scheduler, it is
+	// restarted when the provider is replaced
+	provider controllers.StreamProvider
+	run      func(ctx context.Context)
+}
+
+// scheduler is a running background scheduler
+type scheduler struct {
+	job
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// schedulers runs the provider & backup schedulers of the current
+// configuration
+type schedulers struct {
+	c *controllers.Controller
+
+	mu      sync.Mutex
+	stopped bool
+	running map[string]*scheduler
+	// twitch is kept across reloads to reuse its access token
+	twitch *controllers.TwitchProvider
+}
+
+// jobs returns the schedulers of the current configuration and registers
+// the enabled stream providers
+func (s *schedulers) jobs() []job {
+	conf := s.c.Config()
+	var jobs []job
+	var providers []controllers.StreamProvider
+	if conf.TwitchEnabled {
+		if s.twitch == nil {
+			s.twitch = controllers.NewTwitchProvider(s.c)
+		}
+		twitch, pollRate := s.twitch, conf.TwitchPollRate
+		providers = append(providers, twitch)
+		jobs = append(jobs, job{name: "twitch", settings: "poll rate: " + pollRate.String(), provider: twitch,
+			run: func(ctx context.Context) { s.c.ProviderScheduler(ctx, twitch, pollRate) }})
+	}
+	if conf.OwncastEnabled {
+		owncast, pollRate := controllers.NewOwncastProvider(), conf.OwncastPollRate
+		providers = append(providers, owncast)
+		jobs = append(jobs, job{name: "owncast", settings: "poll rate: " + pollRate.String(),
+			run: func(ctx context.Context) { s.c.ProviderScheduler(ctx, owncast, pollRate) }})
+	}
+	if conf.PeerTubeEnabled {
+		peertube, pollRate := controllers.NewPeerTubeProvider(), conf.PeerTubePollRate
+		providers = append(providers, peertube)
+		jobs = append(jobs, job{name: "peertube", settings: "poll rate: " + pollRate.String(),
+			run: func(ctx context.Context) { s.c.ProviderScheduler(ctx, peertube, pollRate) }})
+	}
+	// scheduled database snapshots are taken if a backup directory is set
+	if conf.BackupDir != "" {
+		interval := conf.BackupInterval
+		jobs = append(jobs, job{name: "backup",
+			settings: fmt.Sprintf("interval: %s, retention: %d, dir: %s", interval, conf.BackupRetention, conf.BackupDir),
+			run:      func(ctx context.Context) { s.c.BackupScheduler(ctx, interval) }})
+	}
+	s.c.SetProviders(providers...)
+	return jobs
+}
+
+// apply starts, restarts or stops the schedulers to match the current
+// configuration. Running polls of stopped schedulers are cancelled.
+func (s *schedulers) apply(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return
+	}
+	jobs := s.jobs()
+
+	wanted := make(map[string]job)
+	for _, j := range jobs {
+		wanted[j.name] = j
+	}
+	if s.running == nil {
+		s.running = make(map[string]*scheduler)
+	}
+	for name, sc := range s.running {
+		if j, ok := wanted[name]; ok && j.settings == sc.settings && j.provider == sc.provider {
+			continue
+		}
+		log.Infof("stopping %s scheduler", name)
+		sc.cancel()
+		<-sc.done
+		delete(s.running, name)
+	}
+	for _, j := range jobs {
+		if _, ok := s.running[j.name]; ok {
+			continue
+		}
+		log.Infof("starting %s scheduler (%s)", j.name, j.settings)
+		var schedCtx context.Context
+		sc := &scheduler{job: j, done: make(chan struct{})}
+		schedCtx, sc.cancel = context.WithCancel(ctx)
+		go func() {
+			defer close(sc.done)
+			sc.run(schedCtx)
+		}()
+		s.running[j.name] = sc
+	}
+}
+
+// stop stops all schedulers, cancelling running polls, and waits for them
+// to return until the context is done. Schedulers are not started again once
+// stopped.
+func (s *schedulers) stop(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopped = true
+	for _, sc := range s.running {
+		sc.cancel()
+	}
+	for name, sc := range s.running {
+		select {
+		case <-sc.done:
+		case <-ctx.Done():
+			log.Warnf("%s scheduler did not stop within the shutdown timeout", name)
+		}
+		delete(s.running, name)
+	}
+}
+
+// restartSettings can not be changed without restarting the server
+var restartSettings = []string{"DATA_PATH", "DATABASE_BACKEND", "AUTH_SERVER_IP", "AUTH_SERVER_PORT"}
+
+// reloader re-reads the configuration and applies it to the running server
+type reloader struct {
+	ctx  context.Context
+	c    *controllers.Controller
+	s    *schedulers
+	load func() (*config.Config, error)
+
+	mu sync.Mutex
+}
+
+// reload replaces the configuration of the controller and restarts the
+// schedulers whose settings changed. An invalid configuration, including the
+// stored runtime settings, is rejected and the current configuration is
+// kept. Settings which require a restart keep their current value.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx.Err() != nil {
+		return errors.New("the server is shutting down")
+	}
+	conf, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	old := r.c.Config()
+	keep := make(map[string]string)
+	for _, name := range restartSettings {
+		if conf.Value(name) != old.Value(name) {
+			log.Warnf("%s changed, restart the server to apply it", name)
+			keep[name] = old.Value(name)
+		}
+	}
+	conf, err = conf.With(keep)
+	if err != nil {
+		return err
+	}
+	err = r.c.ApplyConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	r.s.mu.Lock()
+	if conf.TwitchClientID != old.TwitchClientID || conf.TwitchClientSecret != old.TwitchClientSecret {
+		// the cached access token belongs to the previous credentials
+		r.s.twitch = nil
+		err = r.c.Store.SetToken("twitch", "")
+		if err != nil {
+			log.Error("error clearing cached twitch access token: ", err)
+		}
+	}
+	r.s.mu.Unlock()
+
+	r.s.apply(r.ctx)
+	log.Info("configuration reloaded")
+	return nil
+}
@@ -0,0 +1,361 @@
+// Package client is a typed Go client of the rtmpauthbot http api described
+// by /api/openapi.json
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+// Client calls the versioned publisher api of an rtmpauthbot server
+type Client struct {
+	// BaseURL of the server, ie: "http://127.0.0.1:9090"
+	BaseURL string
+	// HTTPClient used for requests
+	HTTPClient *http.Client
+	// Username & Password of the admin credentials of the server
+	Username string
+	Password string
+}
+
+// Error is returned for unsuccessful responses
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("rtmpauthbot: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("rtmpauthbot: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// IsNotFound returns true if err is a not found api error
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// RequestOption modifies a request before it is sent
+type RequestOption func(r *http.Request)
+
+// IfMatch makes a modifying request conditional on the publisher revision
+func IfMatch(revision int64) RequestOption {
+	return func(r *http.Request) {
+		r.Header.Set("If-Match", fmt.Sprintf("\"%d\"", revision))
+	}
+}
+
+// New returns a client of the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Key is the stream key of a publisher
+type Key struct {
+	Key string `json:"key"`
+}
+
+// StreamLinkInput is a provider account to link, the live status of links is
+// set by the server
+type StreamLinkInput struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account"`
+}
+
+// PublisherInput is the body used to create or replace a publisher
+type PublisherInput struct {
+	Name         string            `json:"name,omitempty"`
+	Key          string            `json:"key,omitempty"`
+	TwitchStream string            `json:"twitch_stream,omitempty"`
+	Links        []StreamLinkInput `json:"links,omitempty"`
+	Unlisted     bool              `json:"unlisted,omitempty"`
+	DiscordID    string            `json:"discord_id,omitempty"`
+	Muted        []string          `json:"muted,omitempty"`
+}
+
+// authorize adds the admin credentials to a request if configured
+func (c *Client) authorize(req *http.Request) {
+	if c.Password != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// publisherPath returns the escaped path of a publisher resource
+func publisherPath(name string, sub ...string) string {
+	p := "/api/v1/publishers/" + url.PathEscape(name)
+	for i := range sub {
+		p += "/" + sub[i]
+	}
+	return p
+}
+
+// do sends a request and decodes the json response into out if not nil
+func (c *Client) do(ctx context.Context, method, path, contentType string, in, out interface{}, opts []RequestOption) error {
+	_, err := c.send(ctx, method, path, contentType, in, out, opts)
+	return err
+}
+
+// send is do but also returns the response headers
+func (c *Client) send(ctx context.Context, method, path, contentType string, in, out interface{}, opts []RequestOption) (http.Header, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("Accept", "application/json")
+	c.authorize(req)
+	for i := range opts {
+		opts[i](req)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var e struct {
+			Error *Error `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) == nil && e.Error != nil {
+			apiErr.Code = e.Error.Code
+			apiErr.Message = e.Error.Message
+		}
+		return resp.Header, apiErr
+	}
+	if out == nil {
+		return resp.Header, nil
+	}
+	return resp.Header, json.NewDecoder(resp.Body).Decode(out)
+}
+
+// ListOptions selects a page of publishers. Nil filters match all publishers.
+type ListOptions struct {
+	Limit      int
+	Cursor     string
+	Prefix     string
+	Descending bool
+	Live       *bool
+	TwitchLive *bool
+	HasTwitch  *bool
+}
+
+// values returns the query parameters of the options
+func (o *ListOptions) values() url.Values {
+	v := url.Values{}
+	if o.Limit > 0 {
+		v.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Cursor != "" {
+		v.Set("cursor", o.Cursor)
+	}
+	if o.Prefix != "" {
+		v.Set("prefix", o.Prefix)
+	}
+	if o.Descending {
+		v.Set("sort", "-name")
+	}
+	filters := map[string]*bool{"live": o.Live, "twitch_live": o.TwitchLive, "has_twitch": o.HasTwitch}
+	for param, filter := range filters {
+		if filter != nil {
+			v.Set(param, strconv.FormatBool(*filter))
+		}
+	}
+	return v
+}
+
+// ListPublishersPage returns a page of publishers and the cursor of the next
+// page, which is empty on the last page
+func (c *Client) ListPublishersPage(ctx context.Context, opts ListOptions) ([]models.Publisher, string, error) {
+	var publishers []models.Publisher
+	path := "/api/v1/publishers"
+	if q := opts.values().Encode(); q != "" {
+		path += "?" + q
+	}
+	header, err := c.send(ctx, "GET", path, "", nil, &publishers, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return publishers, header.Get("X-Next-Cursor"), nil
+}
+
+// ListPublishers returns all publishers matching the options, following all
+// pages
+func (c *Client) ListPublishers(ctx context.Context, opts ListOptions) ([]models.Publisher, error) {
+	publishers := []models.Publisher{}
+	for {
+		page, next, err := c.ListPublishersPage(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		publishers = append(publishers, page...)
+		if next == "" {
+			return publishers, nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// CreatePublisher creates a publisher, a random key is generated if none is
+// provided
+func (c *Client) CreatePublisher(ctx context.Context, p PublisherInput) (models.Publisher, error) {
+	var created models.Publisher
+	err := c.do(ctx, "POST", "/api/v1/publishers", "application/json", p, &created, nil)
+	return created, err
+}
+
+// GetPublisher returns a publisher
+func (c *Client) GetPublisher(ctx context.Context, name string) (models.Publisher, error) {
+	var p models.Publisher
+	err := c.do(ctx, "GET", publisherPath(name), "", nil, &p, nil)
+	return p, err
+}
+
+// ReplacePublisher replaces the key & links of a publisher, creating it if
+// needed
+func (c *Client) ReplacePublisher(ctx context.Context, name string, p PublisherInput, opts ...RequestOption) (models.Publisher, error) {
+	var updated models.Publisher
+	err := c.do(ctx, "PUT", publisherPath(name), "application/json", p, &updated, opts)
+	return updated, err
+}
+
+// PatchPublisher applies a JSON Merge Patch to a publisher. A nil value
+// clears twitch_stream or links.
+func (c *Client) PatchPublisher(ctx context.Context, name string, patch map[string]interface{}, opts ...RequestOption) (models.Publisher, error) {
+	var updated models.Publisher
+	err := c.do(ctx, "PATCH", publisherPath(name), "application/merge-patch+json", patch, &updated, opts)
+	return updated, err
+}
+
+// DeletePublisher deletes a publisher
+func (c *Client) DeletePublisher(ctx context.Context, name string, opts ...RequestOption) error {
+	return c.do(ctx, "DELETE", publisherPath(name), "", nil, nil, opts)
+}
+
+// GetKey returns the stream key of a publisher
+func (c *Client) GetKey(ctx context.Context, name string) (string, error) {
+	var k Key
+	err := c.do(ctx, "GET", publisherPath(name, "key"), "", nil, &k, nil)
+	return k.Key, err
+}
+
+// SetKey sets the stream key of a publisher
+func (c *Client) SetKey(ctx context.Context, name, key string, opts ...RequestOption) error {
+	return c.do(ctx, "PUT", publisherPath(name, "key"), "application/json", Key{Key: key}, nil, opts)
+}
+
+// RotateKey replaces the stream key of a publisher with a new random key
+func (c *Client) RotateKey(ctx context.Context, name string, opts ...RequestOption) (string, error) {
+	var k Key
+	err := c.do(ctx, "POST", publisherPath(name, "key"), "", nil, &k, opts)
+	return k.Key, err
+}
+
+// ListSessions returns the stream sessions of a publisher, most recent first
+func (c *Client) ListSessions(ctx context.Context, name string) ([]models.Session, error) {
+	var sessions []models.Session
+	err := c.do(ctx, "GET", publisherPath(name, "sessions"), "", nil, &sessions, nil)
+	return sessions, err
+}
+
+// ListLinks returns the linked provider accounts of a publisher
+func (c *Client) ListLinks(ctx context.Context, name string) ([]models.StreamLink, error) {
+	var links []models.StreamLink
+	err := c.do(ctx, "GET", publisherPath(name, "links"), "", nil, &links, nil)
+	return links, err
+}
+
+// SetLinks replaces all linked provider accounts of a publisher
+func (c *Client) SetLinks(ctx context.Context, name string, links []StreamLinkInput, opts ...RequestOption) ([]models.StreamLink, error) {
+	if links == nil {
+		links = []StreamLinkInput{}
+	}
+	var updated []models.StreamLink
+	err := c.do(ctx, "PUT", publisherPath(name, "links"), "application/json", links, &updated, opts)
+	return updated, err
+}
+
+// AddLink links an additional provider account to a publisher
+func (c *Client) AddLink(ctx context.Context, name, provider, account string, opts ...RequestOption) ([]models.StreamLink, error) {
+	var updated []models.StreamLink
+	link := StreamLinkInput{Provider: provider, Account: account}
+	err := c.do(ctx, "POST", publisherPath(name, "links"), "application/json", link, &updated, opts)
+	return updated, err
+}
+
+// RemoveLink unlinks a provider account from a publisher
+func (c *Client) RemoveLink(ctx context.Context, name, provider, account string, opts ...RequestOption) ([]models.StreamLink, error) {
+	var updated []models.StreamLink
+	q := url.Values{"provider": {provider}, "account": {account}}
+	err := c.do(ctx, "DELETE", publisherPath(name, "links")+"?"+q.Encode(), "", nil, &updated, opts)
+	return updated, err
+}
+
+// Backup writes a snapshot of the server database to w
+func (c *Client) Backup(ctx context.Context, w io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/api/admin/backup", nil)
+	if err != nil {
+		return 0, err
+	}
+	c.authorize(req)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, &Error{StatusCode: resp.StatusCode}
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// TestNotification posts a test message to the discord webhook of the server
+func (c *Client) TestNotification(ctx context.Context) error {
+	return c.do(ctx, "POST", "/api/v1/notifications/test", "", nil, nil, nil)
+}
+
+// GetAllowList returns the discord user ids which may register
+// through the member portal
+func (c *Client) GetAllowList(ctx context.Context) ([]string, error) {
+	var entries []string
+	err := c.do(ctx, "GET", "/api/v1/portal/allow-list", "", nil, &entries, nil)
+	return entries, err
+}
+
+// SetAllowList replaces the member portal allow-list
+func (c *Client) SetAllowList(ctx context.Context, entries []string) ([]string, error) {
+	if entries == nil {
+		entries = []string{}
+	}
+	var updated []string
+	err := c.do(ctx, "PUT", "/api/v1/portal/allow-list", "application/json", entries, &updated, nil)
+	return updated, err
+}
@@ -0,0 +1,707 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/app"
+	"github.com/bcambl/rtmpauthbot/client"
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/controllers"
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.PanicLevel)
+}
+
+const testPassword = "correct horse battery staple"
+
+// newTestClient returns a client of a server running all routes over a
+// temporary database. The requests & responses of the client are checked
+// against the openapi document served by the server.
+func newTestClient(t *testing.T, overrides map[string]string) (*client.Client, *controllers.Controller) {
+	t.Helper()
+	settings := map[string]string{"ADMIN_PASSWORD": testPassword}
+	for k, v := range overrides {
+		settings[k] = v
+	}
+	conf, err := config.Load("", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.OpenBolt(filepath.Join(t.TempDir(), "rtmpauthbot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	c := controllers.NewController(conf, st)
+	c.Events = controllers.NewEventHub(16)
+	srv := httptest.NewServer(app.Handler(c))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var spec map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := client.New(srv.URL)
+	cl.Username = conf.AdminUsername
+	cl.Password = testPassword
+	cl.HTTPClient.Transport = &specTransport{t: t, spec: spec}
+	return cl, c
+}
+
+// specTransport fails the test if a request of the client or a response of
+// the server is not described by the openapi document
+type specTransport struct {
+	t    *testing.T
+	spec map[string]interface{}
+}
+
+// object returns v as a json object, or nil
+func object(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+// resolve follows the $ref of a node of the document
+func (st *specTransport) resolve(node map[string]interface{}) map[string]interface{} {
+	for node != nil {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		node = st.spec
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			node = object(node[part])
+		}
+	}
+	return node
+}
+
+// operation returns the path item & operation matching a request
+func (st *specTransport) operation(req *http.Request) (map[string]interface{}, map[string]interface{}) {
+	segments := strings.Split(req.URL.EscapedPath(), "/")
+	for pattern, item := range object(st.spec["paths"]) {
+		parts := strings.Split(pattern, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		match := true
+		for i := range parts {
+			param := strings.HasPrefix(parts[i], "{") && strings.HasSuffix(parts[i], "}")
+			if parts[i] != segments[i] && !(param && segments[i] != "") {
+				match = false
+				break
+			}
+		}
+		if match {
+			return object(item), object(object(item)[strings.ToLower(req.Method)])
+		}
+	}
+	return nil, nil
+}
+
+// declared returns true if the operation declares the parameter
+func (st *specTransport) declared(item, op map[string]interface{}, in, name string) bool {
+	params, _ := item["parameters"].([]interface{})
+	ops, _ := op["parameters"].([]interface{})
+	for _, p := range append(params, ops...) {
+		param := st.resolve(object(p))
+		if param["in"] == in && strings.EqualFold(param["name"].(string), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate returns the problems of a decoded json value against a schema
+func (st *specTransport) validate(schema map[string]interface{}, v interface{}, at string) []string {
+	schema = st.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return []string{at + ": null is not nullable"}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for i := range enum {
+			found = found || enum[i] == v
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v is not one of %v", at, v, enum)}
+		}
+	}
+	var problems []string
+	switch schema["type"] {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an object, got %T", at, v)}
+		}
+		required, _ := schema["required"].([]interface{})
+		for i := range required {
+			if _, ok := m[required[i].(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %s", at, required[i]))
+			}
+		}
+		properties := object(schema["properties"])
+		for name, value := range m {
+			if properties == nil {
+				break
+			}
+			property, ok := properties[name]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: undocumented property %s", at, name))
+				continue
+			}
+			problems = append(problems, st.validate(object(property), value, at+"."+name)...)
+		}
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected an array, got %T", at, v)}
+		}
+		for i := range items {
+			problems = append(problems, st.validate(object(schema["items"]), items[i], fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected a string, got %T", at, v))
+		}
+	case "integer":
+		if n, ok := v.(float64); !ok || n != float64(int64(n)) {
+			problems = append(problems, fmt.Sprintf("%s: expected an integer, got %v", at, v))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected a boolean, got %T", at, v))
+		}
+	}
+	return problems
+}
+
+// checkBody validates a json body against the content described for its
+// media type
+func (st *specTransport) checkBody(content map[string]interface{}, contentType string, body []byte, at string) {
+	st.t.Helper()
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	media, ok := content[mediaType]
+	if !ok {
+		st.t.Errorf("%s: content type %q is not described", at, contentType)
+		return
+	}
+	if !strings.HasSuffix(mediaType, "json") {
+		return
+	}
+	var v interface{}
+	err := json.Unmarshal(body, &v)
+	if err != nil {
+		st.t.Errorf("%s: invalid json: %s", at, err)
+		return
+	}
+	for _, problem := range st.validate(object(object(media)["schema"]), v, at) {
+		st.t.Error(problem)
+	}
+}
+
+func (st *specTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	st.t.Helper()
+	at := req.Method + " " + req.URL.Path
+	item, op := st.operation(req)
+	if op == nil {
+		st.t.Errorf("%s: operation is not described", at)
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	for name := range req.URL.Query() {
+		if !st.declared(item, op, "query", name) {
+			st.t.Errorf("%s: query parameter %s is not described", at, name)
+		}
+	}
+	if req.Header.Get("If-Match") != "" && !st.declared(item, op, "header", "If-Match") {
+		st.t.Errorf("%s: If-Match is not described", at)
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		requestBody := object(op["requestBody"])
+		if requestBody == nil {
+			st.t.Errorf("%s: request body is not described", at)
+		} else {
+			st.checkBody(object(requestBody["content"]), req.Header.Get("Content-Type"), body, at+" request")
+		}
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	status := strconv.Itoa(resp.StatusCode)
+	response := st.resolve(object(object(op["responses"])[status]))
+	if response == nil && resp.StatusCode == http.StatusUnauthorized && st.spec["security"] != nil {
+		// every operation may be refused by the global security requirement
+		response = map[string]interface{}{"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"}},
+		}}
+	}
+	if response == nil {
+		st.t.Errorf("%s: response status %s is not described", at, status)
+		return resp, nil
+	}
+	for _, header := range []string{"ETag", "X-Next-Cursor", "Link"} {
+		if resp.Header.Get(header) != "" && object(response["headers"])[header] == nil {
+			st.t.Errorf("%s: response header %s is not described for status %s", at, header, status)
+		}
+	}
+	if content := object(response["content"]); content != nil && len(body) > 0 {
+		st.checkBody(content, resp.Header.Get("Content-Type"), body, at+" "+status)
+	}
+	return resp, nil
+}
+
+// checkError fails the test unless err is an api error of the status & code
+func checkError(t *testing.T, err error, status int, code string) {
+	t.Helper()
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected a %d %s api error, got %v", status, code, err)
+	}
+	if apiErr.StatusCode != status || apiErr.Code != code || apiErr.Message == "" {
+		t.Fatalf("expected a %d %s api error, got %+v", status, code, apiErr)
+	}
+	if !strings.Contains(apiErr.Error(), apiErr.Message) {
+		t.Errorf("expected the error message in %q", apiErr.Error())
+	}
+}
+
+func TestPublishers(t *testing.T) {
+	cl, c := newTestClient(t, nil)
+	ctx := context.Background()
+
+	created, err := cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice", TwitchStream: "alicetv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Name != "alice" || created.Key == "" || created.TwitchStream != "alicetv" || created.Revision != 1 {
+		t.Fatalf("unexpected created publisher: %+v", created)
+	}
+	p, err := cl.GetPublisher(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != created.Key || p.Revision != created.Revision {
+		t.Errorf("expected %+v, got %+v", created, p)
+	}
+
+	key, err := cl.GetKey(ctx, "alice")
+	if err != nil || key != created.Key {
+		t.Fatalf("expected key %s, got %s (%v)", created.Key, key, err)
+	}
+	err = cl.SetKey(ctx, "alice", "secret-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = cl.GetKey(ctx, "alice")
+	if err != nil || key != "secret-key" {
+		t.Fatalf("expected the set key, got %s (%v)", key, err)
+	}
+	key, err = cl.RotateKey(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key == "" || key == "secret-key" {
+		t.Errorf("expected a new random key, got %q", key)
+	}
+
+	replaced, err := cl.ReplacePublisher(ctx, "alice", client.PublisherInput{Key: "replaced", Unlisted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced.Key != "replaced" || !replaced.Unlisted || replaced.TwitchStream != "" {
+		t.Errorf("unexpected replaced publisher: %+v", replaced)
+	}
+	bob, err := cl.ReplacePublisher(ctx, "bob", client.PublisherInput{Key: "bobkey"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.Name != "bob" || bob.Revision != 1 {
+		t.Errorf("expected the publisher to be created, got %+v", bob)
+	}
+
+	patched, err := cl.PatchPublisher(ctx, "alice", map[string]interface{}{"twitch_stream": "alicetv", "muted": []string{"viewers"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.TwitchStream != "alicetv" || len(patched.Muted) != 1 || patched.Key != "replaced" {
+		t.Errorf("unexpected patched publisher: %+v", patched)
+	}
+	patched, err = cl.PatchPublisher(ctx, "alice", map[string]interface{}{"twitch_stream": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.TwitchStream != "" {
+		t.Errorf("expected the twitch stream to be removed, got %+v", patched)
+	}
+
+	sessions, err := cl.ListSessions(ctx, "alice")
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("expected no sessions, got %+v (%v)", sessions, err)
+	}
+	_, err = c.Store.StartSession(models.Session{Publisher: "alice", Provider: "rtmp", StartedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err = cl.ListSessions(ctx, "alice")
+	if err != nil || len(sessions) != 1 || !sessions[0].IsActive() {
+		t.Fatalf("expected an active session, got %+v (%v)", sessions, err)
+	}
+
+	err = cl.DeletePublisher(ctx, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cl.GetPublisher(ctx, "bob")
+	if !client.IsNotFound(err) {
+		t.Errorf("expected the publisher to be deleted, got %v", err)
+	}
+}
+
+func TestListPublishers(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	for _, name := range []string{"p3", "p1", "q1", "p2"} {
+		input := client.PublisherInput{Name: name}
+		if name == "p2" {
+			input.TwitchStream = "p2tv"
+		}
+		_, err := cl.CreatePublisher(ctx, input)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, next, err := cl.ListPublishersPage(ctx, client.ListOptions{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 3 || next == "" {
+		t.Fatalf("expected a first page of 3 & a cursor, got %d %q", len(page), next)
+	}
+	page, next, err = cl.ListPublishersPage(ctx, client.ListOptions{Limit: 3, Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Name != "q1" || next != "" {
+		t.Fatalf("expected a last page of q1, got %+v %q", page, next)
+	}
+
+	live, hasTwitch := false, true
+	tests := []struct {
+		opts  client.ListOptions
+		names string
+	}{
+		{client.ListOptions{}, "p1 p2 p3 q1"},
+		{client.ListOptions{Limit: 1}, "p1 p2 p3 q1"},
+		{client.ListOptions{Prefix: "p", Descending: true}, "p3 p2 p1"},
+		{client.ListOptions{Live: &live}, "p1 p2 p3 q1"},
+		{client.ListOptions{TwitchLive: &hasTwitch}, ""},
+		{client.ListOptions{HasTwitch: &hasTwitch}, "p2"},
+	}
+	for _, tc := range tests {
+		publishers, err := cl.ListPublishers(ctx, tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, len(publishers))
+		for i := range publishers {
+			names[i] = publishers[i].Name
+		}
+		if strings.Join(names, " ") != tc.names {
+			t.Errorf("%+v: expected %q, got %q", tc.opts, tc.names, strings.Join(names, " "))
+		}
+	}
+}
+
+func TestLinks(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	_, err := cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := cl.SetLinks(ctx, "alice", []client.StreamLinkInput{
+		{Provider: "twitch", Account: "alicetv"},
+		{Provider: "owncast", Account: "https://owncast.example.com"},
+	})
+	if err != nil || len(links) != 2 {
+		t.Fatalf("expected 2 links, got %+v (%v)", links, err)
+	}
+	links, err = cl.AddLink(ctx, "alice", "peertube", "https://peertube.example.com/c/alice")
+	if err != nil || len(links) != 3 {
+		t.Fatalf("expected 3 links, got %+v (%v)", links, err)
+	}
+	links, err = cl.RemoveLink(ctx, "alice", "owncast", "https://owncast.example.com")
+	if err != nil || len(links) != 2 {
+		t.Fatalf("expected 2 links, got %+v (%v)", links, err)
+	}
+	links, err = cl.ListLinks(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 2 || links[0].Provider != "twitch" || links[1].Provider != "peertube" {
+		t.Errorf("unexpected links: %+v", links)
+	}
+	p, err := cl.GetPublisher(ctx, "alice")
+	if err != nil || p.TwitchStream != "alicetv" {
+		t.Errorf("expected the twitch link as twitch stream, got %+v (%v)", p, err)
+	}
+
+	links, err = cl.SetLinks(ctx, "alice", nil)
+	if err != nil || len(links) != 0 {
+		t.Fatalf("expected the links to be removed, got %+v (%v)", links, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	_, err := cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cl.GetPublisher(ctx, "missing")
+	checkError(t, err, http.StatusNotFound, "not_found")
+	if !client.IsNotFound(err) {
+		t.Error("expected IsNotFound")
+	}
+	_, err = cl.PatchPublisher(ctx, "missing", map[string]interface{}{"unlisted": true})
+	checkError(t, err, http.StatusNotFound, "not_found")
+	_, err = cl.ListSessions(ctx, "missing")
+	checkError(t, err, http.StatusNotFound, "not_found")
+	_, err = cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice"})
+	checkError(t, err, http.StatusConflict, "conflict")
+	if client.IsNotFound(err) {
+		t.Error("expected a conflict not to be IsNotFound")
+	}
+	_, err = cl.CreatePublisher(ctx, client.PublisherInput{})
+	checkError(t, err, http.StatusBadRequest, "invalid_request")
+	_, err = cl.ReplacePublisher(ctx, "alice", client.PublisherInput{Unlisted: true})
+	checkError(t, err, http.StatusBadRequest, "invalid_request")
+	err = cl.TestNotification(ctx)
+	checkError(t, err, http.StatusBadRequest, "invalid_request")
+
+	unauthorized := *cl
+	unauthorized.Password = "wrong"
+	_, err = unauthorized.ListPublishers(ctx, client.ListOptions{})
+	checkError(t, err, http.StatusUnauthorized, "unauthorized")
+	_, err = unauthorized.Backup(ctx, io.Discard)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized backup, got %v", err)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	p, err := cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = cl.PatchPublisher(ctx, "alice", map[string]interface{}{"unlisted": true}, client.IfMatch(p.Revision))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cl.AddLink(ctx, "alice", "twitch", "alicetv", client.IfMatch(p.Revision))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := client.IfMatch(p.Revision)
+	calls := map[string]func() error{
+		"replace": func() error {
+			_, err := cl.ReplacePublisher(ctx, "alice", client.PublisherInput{Key: "key"}, stale)
+			return err
+		},
+		"patch": func() error {
+			_, err := cl.PatchPublisher(ctx, "alice", map[string]interface{}{"unlisted": false}, stale)
+			return err
+		},
+		"delete":  func() error { return cl.DeletePublisher(ctx, "alice", stale) },
+		"set key": func() error { return cl.SetKey(ctx, "alice", "key", stale) },
+		"rotate key": func() error {
+			_, err := cl.RotateKey(ctx, "alice", stale)
+			return err
+		},
+		"set links": func() error {
+			_, err := cl.SetLinks(ctx, "alice", nil, stale)
+			return err
+		},
+		"add link": func() error {
+			_, err := cl.AddLink(ctx, "alice", "owncast", "https://owncast.example.com", stale)
+			return err
+		},
+		"remove link": func() error {
+			_, err := cl.RemoveLink(ctx, "alice", "twitch", "alicetv", stale)
+			return err
+		},
+	}
+	for name, call := range calls {
+		t.Run(name, func(t *testing.T) {
+			checkError(t, call(), http.StatusPreconditionFailed, "precondition_failed")
+		})
+	}
+	current, err := cl.GetPublisher(ctx, "alice")
+	if err != nil || current.Revision != p.Revision+1 || len(current.Links) != 1 {
+		t.Errorf("expected the publisher to be unchanged, got %+v (%v)", current, err)
+	}
+}
+
+func TestRequireIfMatch(t *testing.T) {
+	cl, _ := newTestClient(t, map[string]string{"API_REQUIRE_IF_MATCH": "true"})
+	ctx := context.Background()
+	// new publishers may be created without If-Match
+	p, err := cl.ReplacePublisher(ctx, "alice", client.PublisherInput{Key: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cl.PatchPublisher(ctx, "alice", map[string]interface{}{"unlisted": true})
+	checkError(t, err, http.StatusPreconditionRequired, "precondition_required")
+	err = cl.DeletePublisher(ctx, "alice")
+	checkError(t, err, http.StatusPreconditionRequired, "precondition_required")
+	_, err = cl.PatchPublisher(ctx, "alice", map[string]interface{}{"unlisted": true}, client.IfMatch(p.Revision))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	_, err := cl.CreatePublisher(ctx, client.PublisherInput{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	n, err := cl.Backup(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n != int64(buf.Len()) {
+		t.Fatalf("expected %d bytes, got %d", buf.Len(), n)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	err = os.WriteFile(path, buf.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	_, err = st.GetPublisher("alice")
+	if err != nil {
+		t.Errorf("expected the publisher in the backup: %v", err)
+	}
+}
+
+func TestNotification(t *testing.T) {
+	var mu sync.Mutex
+	var messages []string
+	failing := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Content string `json:"content"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		messages = append(messages, body.Content)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer hook.Close()
+
+	cl, _ := newTestClient(t, map[string]string{"DISCORD_ENABLED": "true", "DISCORD_WEBHOOK": hook.URL + "/api/webhooks/1/token"})
+	ctx := context.Background()
+	err := cl.TestNotification(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	if len(messages) != 1 || !strings.Contains(messages[0], "test notification") {
+		t.Errorf("expected a test notification, got %q", messages)
+	}
+	failing = true
+	mu.Unlock()
+	err = cl.TestNotification(ctx)
+	checkError(t, err, http.StatusBadGateway, "notification_failed")
+}
+
+func TestAllowList(t *testing.T) {
+	cl, _ := newTestClient(t, nil)
+	ctx := context.Background()
+	entries, err := cl.GetAllowList(ctx)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected an empty allow-list, got %q (%v)", entries, err)
+	}
+	ids := []string{"123456789012345678", "223456789012345678"}
+	entries, err = cl.SetAllowList(ctx, ids)
+	if err != nil || strings.Join(entries, ",") != strings.Join(ids, ",") {
+		t.Fatalf("expected %q, got %q (%v)", ids, entries, err)
+	}
+	entries, err = cl.GetAllowList(ctx)
+	if err != nil || strings.Join(entries, ",") != strings.Join(ids, ",") {
+		t.Fatalf("expected %q, got %q (%v)", ids, entries, err)
+	}
+	entries, err = cl.SetAllowList(ctx, nil)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected the allow-list to be cleared, got %q (%v)", entries, err)
+	}
+}
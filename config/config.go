@@ -1,69 +1,221 @@
 package config
 
 import (
-	"os"
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Config contains config vars parsed from the environment
+// Config contains the settings read from the config file, environment
+// variables & command line overrides
 type Config struct {
-	AuthServerIP       string
-	AuthServerPort     string
-	RTMPServerFQDN     string
-	RTMPServerPort     string
-	TwitchEnabled      bool
-	TwitchClientID     string
-	TwitchClientSecret string
-	DiscordWebhook     string
-	DiscordEnabled     bool
-	TwitchPollRate     time.Duration
+	DataPath            string
+	DatabaseBackend     string
+	AuthServerIP        string
+	AuthServerPort      string
+	RTMPServerFQDN      string
+	RTMPServerPort      string
+	HLSBaseURL          string
+	TwitchEnabled       bool
+	TwitchClientID      string
+	TwitchClientSecret  string
+	TwitchTokenKey      string
+	DiscordWebhook      string
+	DiscordEnabled      bool
+	DiscordClientID     string
+	DiscordClientSecret string
+	DiscordRedirectURL  string
+	DiscordAuthorizeURL string
+	DiscordTokenURL     string
+	DiscordUserURL      string
+	DiscordPublicKey    ed25519.PublicKey
+	DiscordBotToken     string
+	DiscordAdminIDs     []string
+	DiscordAPIURL       string
+	TwitchPollRate      time.Duration
+	OwncastEnabled      bool
+	OwncastPollRate     time.Duration
+	PeerTubeEnabled     bool
+	PeerTubePollRate    time.Duration
+	OfflineGracePolls   int
+	OfflineGracePeriod  time.Duration
+	StreamInfoNotify    []string
+	BackupDir           string
+	BackupInterval      time.Duration
+	BackupRetention     int
+	APIRequireIfMatch   bool
+	AdminUsername       string
+	AdminPassword       string
+	MetricsToken        string
+	ShutdownTimeout     time.Duration
+	VaultAddress        string
+	VaultToken          string
+	VaultMount          string
+	VaultSecretPath     string
+
+	// values are the effective raw settings keyed by environment variable
+	values map[string]string
+	// sourceProblems are the problems found reading the config file & the
+	// secret sources
+	sourceProblems []string
+	// pinned are the settings set by command line overrides keyed by
+	// environment variable
+	pinned map[string]bool
+	// problems are the malformed settings found while parsing
+	problems []string
 }
 
-// DatabasePath returns the path to the database
-func DatabasePath() string {
-	pathToDB := os.Getenv("DATA_PATH")
-	fullDBPath := filepath.Join(pathToDB, "rtmpauthbot.db")
+// DatabasePath returns the path to the database of the configured backend
+func (c *Config) DatabasePath() string {
+	dbFile := "rtmpauthbot.db"
+	if c.DatabaseBackend == "sqlite" {
+		dbFile = "rtmpauthbot.sqlite"
+	}
+	fullDBPath := filepath.Join(c.DataPath, dbFile)
 	log.Debug("Using database path: ", fullDBPath)
 	return fullDBPath
 }
 
-// ParseEnv parses configurations from environment environment variables
-func (c *Config) ParseEnv() error {
-	var (
-		err         error
-		pollRateSec int64
-	)
-	c.AuthServerIP = os.Getenv("AUTH_SERVER_IP")
-	c.AuthServerPort = os.Getenv("AUTH_SERVER_PORT")
-	c.RTMPServerFQDN = os.Getenv("RTMP_SERVER_FQDN")
-	c.RTMPServerPort = os.Getenv("RTMP_SERVER_PORT")
-	c.TwitchClientID = os.Getenv("TWITCH_CLIENT_ID")
-	c.TwitchClientSecret = os.Getenv("TWITCH_CLIENT_SECRET")
-	c.DiscordWebhook = os.Getenv("DISCORD_WEBHOOK")
-	c.DiscordEnabled, err = strconv.ParseBool(os.Getenv("DISCORD_ENABLED"))
-	if err != nil {
-		c.DiscordEnabled = false
-		log.Debug("error parsing env var: DISCORD_ENABLED")
+// PortalEnabled returns true if the discord oauth2 application of the member
+// portal is configured
+func (c *Config) PortalEnabled() bool {
+	return c.DiscordClientID != "" && c.DiscordClientSecret != "" && c.DiscordRedirectURL != ""
+}
+
+// InteractionsEnabled returns true if the public key of the discord
+// application is configured to verify slash command interactions
+func (c *Config) InteractionsEnabled() bool {
+	return c.DiscordPublicKey != nil
+}
+
+// parser converts raw settings to typed values and records malformed values
+// instead of silently using defaults
+type parser struct {
+	values   map[string]string
+	problems []string
+}
+
+// problem records a malformed setting
+func (p *parser) problem(env, format string, a ...interface{}) {
+	p.problems = append(p.problems, fmt.Sprintf("%s: %s", settingName(env), fmt.Sprintf(format, a...)))
+}
+
+// str returns the trimmed value of a setting
+func (p *parser) str(env string) string {
+	return strings.TrimSpace(p.values[env])
+}
+
+// bool parses a boolean setting
+func (p *parser) bool(env string) bool {
+	value := p.str(env)
+	if value == "" {
+		return false
 	}
-	c.TwitchEnabled, err = strconv.ParseBool(os.Getenv("TWITCH_ENABLED"))
+	b, err := strconv.ParseBool(value)
 	if err != nil {
-		c.TwitchEnabled = false
-		log.Debug("error parsing env var: TWITCH_ENABLED")
+		p.problem(env, "invalid boolean '%s'", value)
 	}
-	pollRateSec, err = strconv.ParseInt(os.Getenv("TWITCH_POLL_RATE"), 0, 0)
+	return b
+}
+
+// int parses an integer setting which must be at least min
+func (p *parser) int(env string, min int) int {
+	value := p.str(env)
+	n, err := strconv.Atoi(value)
 	if err != nil {
-		// Default poll rate to 60sec (far below allowed rate limits)
-		pollRateSec = 60
+		p.problem(env, "invalid number '%s'", value)
+		return min
+	}
+	if n < min {
+		p.problem(env, "must be at least %d", min)
+		return min
+	}
+	return n
+}
+
+// seconds parses a duration in seconds which must be at least min
+func (p *parser) seconds(env string, min int) time.Duration {
+	return time.Duration(p.int(env, min)) * time.Second
+}
+
+// list parses a comma separated setting
+func (p *parser) list(env string) []string {
+	var items []string
+	for _, item := range strings.Split(p.values[env], ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parse sets the configuration from raw settings keyed by environment
+// variable and records malformed values as problems
+func (c *Config) parse(values map[string]string) {
+	p := parser{values: values}
+	c.DataPath = p.str("DATA_PATH")
+	c.DatabaseBackend = strings.ToLower(p.str("DATABASE_BACKEND"))
+	c.AuthServerIP = p.str("AUTH_SERVER_IP")
+	c.AuthServerPort = p.str("AUTH_SERVER_PORT")
+	c.RTMPServerFQDN = p.str("RTMP_SERVER_FQDN")
+	c.RTMPServerPort = p.str("RTMP_SERVER_PORT")
+	c.HLSBaseURL = strings.TrimRight(p.str("HLS_BASE_URL"), "/")
+	c.TwitchClientID = p.str("TWITCH_CLIENT_ID")
+	c.TwitchClientSecret = p.str("TWITCH_CLIENT_SECRET")
+	c.TwitchTokenKey = p.str("TWITCH_TOKEN_ENCRYPTION_KEY")
+	c.DiscordWebhook = p.str("DISCORD_WEBHOOK")
+	c.DiscordClientID = p.str("DISCORD_CLIENT_ID")
+	c.DiscordClientSecret = p.str("DISCORD_CLIENT_SECRET")
+	c.DiscordRedirectURL = p.str("DISCORD_REDIRECT_URL")
+	c.DiscordAuthorizeURL = p.str("DISCORD_AUTHORIZE_URL")
+	c.DiscordTokenURL = p.str("DISCORD_TOKEN_URL")
+	c.DiscordUserURL = p.str("DISCORD_USER_URL")
+	c.DiscordPublicKey = nil
+	if publicKey := p.str("DISCORD_PUBLIC_KEY"); publicKey != "" {
+		key, err := hex.DecodeString(publicKey)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			p.problem("DISCORD_PUBLIC_KEY", "must be a hex encoded ed25519 public key")
+		} else {
+			c.DiscordPublicKey = key
+		}
 	}
-	// ensure a sane minimum twitch poll rate
-	if pollRateSec < 5 {
-		pollRateSec = 5
+	c.DiscordBotToken = p.str("DISCORD_BOT_TOKEN")
+	c.DiscordAdminIDs = p.list("DISCORD_ADMIN_IDS")
+	c.DiscordAPIURL = strings.TrimRight(p.str("DISCORD_API_URL"), "/")
+	c.DiscordEnabled = p.bool("DISCORD_ENABLED")
+	c.TwitchEnabled = p.bool("TWITCH_ENABLED")
+	// poll rates are kept far below the allowed rate limits
+	c.TwitchPollRate = p.seconds("TWITCH_POLL_RATE", 5)
+	c.OwncastEnabled = p.bool("OWNCAST_ENABLED")
+	c.OwncastPollRate = p.seconds("OWNCAST_POLL_RATE", 5)
+	c.PeerTubeEnabled = p.bool("PEERTUBE_ENABLED")
+	c.PeerTubePollRate = p.seconds("PEERTUBE_POLL_RATE", 5)
+	c.OfflineGracePolls = p.int("OFFLINE_GRACE_POLLS", 0)
+	c.OfflineGracePeriod = p.seconds("OFFLINE_GRACE_PERIOD", 0)
+	c.StreamInfoNotify = nil
+	for _, field := range p.list("STREAM_INFO_NOTIFY") {
+		c.StreamInfoNotify = append(c.StreamInfoNotify, strings.ToLower(field))
 	}
-	c.TwitchPollRate = (time.Duration(pollRateSec) * time.Second)
+	c.BackupDir = p.str("BACKUP_DIR")
+	c.BackupInterval = p.seconds("BACKUP_INTERVAL", 60)
+	c.BackupRetention = p.int("BACKUP_RETENTION", 1)
+	c.APIRequireIfMatch = p.bool("API_REQUIRE_IF_MATCH")
+	c.AdminUsername = p.str("ADMIN_USERNAME")
+	c.AdminPassword = p.values["ADMIN_PASSWORD"]
+	c.MetricsToken = p.values["METRICS_TOKEN"]
+	c.ShutdownTimeout = p.seconds("SHUTDOWN_TIMEOUT", 1)
+	c.VaultAddress = strings.TrimRight(p.str("VAULT_ADDR"), "/")
+	c.VaultToken = p.str("VAULT_TOKEN")
+	c.VaultMount = strings.Trim(p.str("VAULT_KV_MOUNT"), "/")
+	c.VaultSecretPath = strings.Trim(p.str("VAULT_SECRET_PATH"), "/")
 
-	return nil
+	c.values = values
+	c.problems = p.problems
 }
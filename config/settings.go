@@ -0,0 +1,430 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// placeholderWebhook is the example discord webhook of the environment
+	// template
+	placeholderWebhook = "https://discordapp.com/api/webhooks/1234567890/abcdefghijklmnopqrstuvwxyz1234567890"
+	// placeholderTwitchCredential is the example twitch client id & secret of
+	// the environment template
+	placeholderTwitchCredential = "abcd1234"
+	// MaskedSecret replaces the values of secrets when printing settings or
+	// returning them from the api
+	MaskedSecret = "********"
+)
+
+// setting describes a configuration value by its config file key and the
+// environment variable overriding it
+type setting struct {
+	Key     string
+	Env     string
+	Default string
+	// Secret values are masked when the configuration is printed
+	Secret bool
+	// AllowEmpty settings are overridden by empty environment variables
+	AllowEmpty bool
+}
+
+// settings lists every configuration value, config file sections are
+// separated from the key by a dot
+var settings = []setting{
+	{Key: "data_path", Env: "DATA_PATH"},
+	{Key: "database_backend", Env: "DATABASE_BACKEND", Default: "bolt"},
+	{Key: "server.ip", Env: "AUTH_SERVER_IP", Default: "127.0.0.1"},
+	{Key: "server.port", Env: "AUTH_SERVER_PORT", Default: "9090"},
+	{Key: "server.shutdown_timeout", Env: "SHUTDOWN_TIMEOUT", Default: "10"},
+	{Key: "rtmp.fqdn", Env: "RTMP_SERVER_FQDN"},
+	{Key: "rtmp.port", Env: "RTMP_SERVER_PORT", Default: "1935"},
+	{Key: "rtmp.hls_base_url", Env: "HLS_BASE_URL"},
+	{Key: "discord.enabled", Env: "DISCORD_ENABLED", Default: "false"},
+	{Key: "discord.webhook", Env: "DISCORD_WEBHOOK", Secret: true},
+	{Key: "discord.client_id", Env: "DISCORD_CLIENT_ID"},
+	{Key: "discord.client_secret", Env: "DISCORD_CLIENT_SECRET", Secret: true},
+	{Key: "discord.redirect_url", Env: "DISCORD_REDIRECT_URL"},
+	{Key: "discord.authorize_url", Env: "DISCORD_AUTHORIZE_URL", Default: "https://discord.com/oauth2/authorize"},
+	{Key: "discord.token_url", Env: "DISCORD_TOKEN_URL", Default: "https://discord.com/api/oauth2/token"},
+	{Key: "discord.user_url", Env: "DISCORD_USER_URL", Default: "https://discord.com/api/users/@me"},
+	{Key: "discord.public_key", Env: "DISCORD_PUBLIC_KEY"},
+	{Key: "discord.bot_token", Env: "DISCORD_BOT_TOKEN", Secret: true},
+	{Key: "discord.admin_ids", Env: "DISCORD_ADMIN_IDS"},
+	{Key: "discord.api_url", Env: "DISCORD_API_URL", Default: "https://discord.com/api/v10"},
+	{Key: "twitch.enabled", Env: "TWITCH_ENABLED", Default: "false"},
+	{Key: "twitch.client_id", Env: "TWITCH_CLIENT_ID"},
+	{Key: "twitch.client_secret", Env: "TWITCH_CLIENT_SECRET", Secret: true},
+	{Key: "twitch.poll_rate", Env: "TWITCH_POLL_RATE", Default: "60"},
+	{Key: "twitch.token_encryption_key", Env: "TWITCH_TOKEN_ENCRYPTION_KEY", Secret: true},
+	{Key: "owncast.enabled", Env: "OWNCAST_ENABLED", Default: "false"},
+	{Key: "owncast.poll_rate", Env: "OWNCAST_POLL_RATE", Default: "60"},
+	{Key: "peertube.enabled", Env: "PEERTUBE_ENABLED", Default: "false"},
+	{Key: "peertube.poll_rate", Env: "PEERTUBE_POLL_RATE", Default: "60"},
+	{Key: "notifications.stream_info", Env: "STREAM_INFO_NOTIFY", Default: "game", AllowEmpty: true},
+	{Key: "notifications.offline_grace_polls", Env: "OFFLINE_GRACE_POLLS", Default: "2"},
+	{Key: "notifications.offline_grace_period", Env: "OFFLINE_GRACE_PERIOD", Default: "0"},
+	{Key: "backup.dir", Env: "BACKUP_DIR"},
+	{Key: "backup.interval", Env: "BACKUP_INTERVAL", Default: "86400"},
+	{Key: "backup.retention", Env: "BACKUP_RETENTION", Default: "7"},
+	{Key: "api.require_if_match", Env: "API_REQUIRE_IF_MATCH", Default: "false"},
+	{Key: "admin.username", Env: "ADMIN_USERNAME", Default: "admin"},
+	{Key: "admin.password", Env: "ADMIN_PASSWORD", Secret: true},
+	{Key: "metrics.token", Env: "METRICS_TOKEN", Secret: true},
+	{Key: "vault.address", Env: "VAULT_ADDR"},
+	{Key: "vault.token", Env: "VAULT_TOKEN", Secret: true},
+	{Key: "vault.mount", Env: "VAULT_KV_MOUNT", Default: "secret"},
+	{Key: "vault.path", Env: "VAULT_SECRET_PATH"},
+}
+
+// streamInfoFields are the stream info fields which may notify when changed
+var streamInfoFields = []string{"title", "game", "tags", "language", "mature"}
+
+// lookupSetting returns the setting of a config file key or environment
+// variable
+func lookupSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.Key == name || s.Env == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// settingName returns the config file key & environment variable of a
+// setting for messages
+func settingName(env string) string {
+	s, ok := lookupSetting(env)
+	if !ok {
+		return env
+	}
+	return fmt.Sprintf("%s (%s)", s.Key, s.Env)
+}
+
+// flatten converts the sections of a decoded config file to dotted keys.
+// Lists are joined with commas like their environment variables.
+func flatten(prefix string, in map[string]interface{}, out map[string]string) {
+	for key, value := range in {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case nil:
+			// an empty value leaves the default in place
+		case map[string]interface{}:
+			flatten(key, v, out)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for i := range v {
+				items = append(items, fmt.Sprint(v[i]))
+			}
+			out[key] = strings.Join(items, ",")
+		default:
+			out[key] = fmt.Sprint(v)
+		}
+	}
+}
+
+// readFile returns the settings of a yaml config file by dotted key
+func readFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %s", path, err)
+	}
+	values := make(map[string]string)
+	flatten("", doc, values)
+	return values, nil
+}
+
+// Load returns the configuration of the optional yaml config file, which is
+// overridden by secrets of the vault kv secret, systemd credentials, files
+// named by *_FILE environment variables, environment variables and finally
+// by the overrides keyed by config file key or environment variable. Unknown
+// & malformed settings are reported by Validate along with all other
+// problems.
+func Load(file string, overrides map[string]string) (*Config, error) {
+	var problems []string
+	values := make(map[string]string)
+	for _, s := range settings {
+		values[s.Env] = s.Default
+	}
+	if file != "" {
+		fileValues, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range sortedKeys(fileValues) {
+			s, ok := lookupSetting(key)
+			if !ok || s.Key != key {
+				problems = append(problems, fmt.Sprintf("%s: unknown setting '%s'", file, key))
+				continue
+			}
+			values[s.Env] = fileValues[key]
+		}
+	}
+
+	// explicit are the settings which are not read from the vault
+	explicit := make(map[string]bool)
+	credentials := os.Getenv("CREDENTIALS_DIRECTORY")
+	for _, s := range settings {
+		if s.Secret && credentials != "" {
+			v, err := readSecret(filepath.Join(credentials, s.Env))
+			if err == nil {
+				values[s.Env], explicit[s.Env] = v, true
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				problems = append(problems, fmt.Sprintf("%s: %s", settingName(s.Env), err))
+			}
+		}
+		if path := os.Getenv(s.Env + "_FILE"); s.Secret && path != "" {
+			if os.Getenv(s.Env) != "" {
+				problems = append(problems, fmt.Sprintf("%s: %s & %s_FILE are both set", settingName(s.Env), s.Env, s.Env))
+			}
+			v, err := readSecret(path)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %s", settingName(s.Env), err))
+			}
+			values[s.Env], explicit[s.Env] = v, true
+		}
+		if v, ok := os.LookupEnv(s.Env); ok && (v != "" || s.AllowEmpty) {
+			values[s.Env], explicit[s.Env] = v, true
+		}
+	}
+	pinned := make(map[string]bool)
+	for name := range overrides {
+		if s, ok := lookupSetting(name); ok {
+			explicit[s.Env], pinned[s.Env] = true, true
+		}
+	}
+
+	c := &Config{pinned: pinned}
+	err := c.apply(values, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if c.VaultAddress != "" && c.VaultSecretPath != "" && c.VaultToken != "" {
+		secrets, err := vaultSecrets(c.VaultAddress, c.VaultToken, c.VaultMount, c.VaultSecretPath)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", settingName("VAULT_SECRET_PATH"), err))
+		}
+		for _, key := range sortedKeys(secrets) {
+			s, ok := lookupSetting(key)
+			if !ok || !s.Secret || s.Env == "VAULT_TOKEN" {
+				problems = append(problems, fmt.Sprintf("vault secret %s: unknown secret '%s'", c.VaultSecretPath, key))
+				continue
+			}
+			if !explicit[s.Env] {
+				c.values[s.Env] = secrets[key]
+			}
+		}
+		c.parse(c.values)
+	}
+	c.sourceProblems = problems
+	return c, nil
+}
+
+// readSecret returns the content of a secret file without trailing newlines
+func readSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// apply parses the raw settings with the overrides keyed by config file key
+// or environment variable
+func (c *Config) apply(values, overrides map[string]string) error {
+	for name, value := range overrides {
+		s, ok := lookupSetting(name)
+		if !ok {
+			return fmt.Errorf("unknown setting: %s", name)
+		}
+		values[s.Env] = value
+	}
+	c.parse(values)
+	return nil
+}
+
+// With returns a copy of the configuration with the overrides keyed by
+// config file key or environment variable applied
+func (c *Config) With(overrides map[string]string) (*Config, error) {
+	values := make(map[string]string, len(c.values))
+	for k, v := range c.values {
+		values[k] = v
+	}
+	conf := &Config{sourceProblems: c.sourceProblems, pinned: c.pinned}
+	err := conf.apply(values, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Value returns the raw value of a setting by config file key or environment
+// variable
+func (c *Config) Value(name string) string {
+	s, ok := lookupSetting(name)
+	if !ok {
+		return ""
+	}
+	return c.values[s.Env]
+}
+
+// Pinned returns true if the setting of the config file key or environment
+// variable is set by a command line override
+func (c *Config) Pinned(name string) bool {
+	s, ok := lookupSetting(name)
+	return ok && c.pinned[s.Env]
+}
+
+// IsSecret returns true if the setting of the config file key or environment
+// variable is a secret
+func IsSecret(name string) bool {
+	s, ok := lookupSetting(name)
+	return ok && s.Secret
+}
+
+// ValidationError lists all problems found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// validURL returns true if the value is an absolute http(s) url
+func validURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// validPort returns true if the value is a tcp port number
+func validPort(value string) bool {
+	n, err := strconv.Atoi(value)
+	return err == nil && n > 0 && n < 65536
+}
+
+// Validate returns a ValidationError listing every problem of the
+// configuration or nil if it is valid
+func (c *Config) Validate() error {
+	problems := append(append([]string{}, c.sourceProblems...), c.problems...)
+	add := func(env, format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf("%s: %s", settingName(env), fmt.Sprintf(format, a...)))
+	}
+
+	if c.DatabaseBackend != "bolt" && c.DatabaseBackend != "sqlite" {
+		add("DATABASE_BACKEND", "unsupported backend '%s', expected bolt or sqlite", c.DatabaseBackend)
+	}
+	if !validPort(c.AuthServerPort) {
+		add("AUTH_SERVER_PORT", "invalid port '%s'", c.AuthServerPort)
+	}
+	if !validPort(c.RTMPServerPort) {
+		add("RTMP_SERVER_PORT", "invalid port '%s'", c.RTMPServerPort)
+	}
+	for _, env := range []string{"HLS_BASE_URL", "DISCORD_WEBHOOK", "DISCORD_REDIRECT_URL",
+		"DISCORD_AUTHORIZE_URL", "DISCORD_TOKEN_URL", "DISCORD_USER_URL", "DISCORD_API_URL", "VAULT_ADDR"} {
+		if value := strings.TrimSpace(c.values[env]); value != "" && !validURL(value) {
+			add(env, "invalid url, expected an absolute http or https url")
+		}
+	}
+
+	if c.DiscordEnabled {
+		switch c.DiscordWebhook {
+		case "":
+			add("DISCORD_WEBHOOK", "required when discord is enabled")
+		case placeholderWebhook:
+			add("DISCORD_WEBHOOK", "the example webhook must be replaced with your channel webhook")
+		}
+	}
+	portal := []string{c.DiscordClientID, c.DiscordClientSecret, c.DiscordRedirectURL}
+	if !c.PortalEnabled() && strings.Join(portal, "") != "" {
+		add("DISCORD_CLIENT_ID", "the member portal requires the client id, client secret & redirect url")
+	}
+	if c.TwitchEnabled {
+		for env, value := range map[string]string{"TWITCH_CLIENT_ID": c.TwitchClientID, "TWITCH_CLIENT_SECRET": c.TwitchClientSecret} {
+			switch value {
+			case "":
+				add(env, "required when twitch is enabled")
+			case placeholderTwitchCredential:
+				add(env, "the example credential must be replaced with your twitch application credentials")
+			}
+		}
+	}
+	if c.VaultAddress != "" && (c.VaultToken == "" || c.VaultSecretPath == "") {
+		add("VAULT_ADDR", "the vault secret requires a token & secret path")
+	}
+	for _, field := range c.StreamInfoNotify {
+		known := false
+		for _, f := range streamInfoFields {
+			known = known || f == field
+		}
+		if !known {
+			add("STREAM_INFO_NOTIFY", "unknown field '%s', expected one of: %s", field, strings.Join(streamInfoFields, ", "))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return &ValidationError{Problems: problems}
+}
+
+// WriteYAML writes the effective settings in the config file format with
+// secrets masked
+func (c *Config) WriteYAML(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	sections := make(map[string]*yaml.Node)
+	for _, s := range settings {
+		value := c.values[s.Env]
+		if s.Secret && value != "" {
+			value = MaskedSecret
+		}
+		parent, key := root, s.Key
+		if section, name, ok := strings.Cut(s.Key, "."); ok {
+			parent = sections[section]
+			if parent == nil {
+				parent = &yaml.Node{Kind: yaml.MappingNode}
+				sections[section] = parent
+				root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: section}, parent)
+			}
+			key = name
+		}
+		parent.Content = append(parent.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: key},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value})
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(root)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
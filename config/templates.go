@@ -35,9 +35,22 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 `
 
 	envVars = `
-# path to database file
+# every variable may also be set in the yaml file given with -config, ie:
+# DISCORD_WEBHOOK is discord.webhook. environment variables override the file
+
+# secrets (DISCORD_WEBHOOK, DISCORD_CLIENT_SECRET, DISCORD_BOT_TOKEN,
+# TWITCH_CLIENT_SECRET, TWITCH_TOKEN_ENCRYPTION_KEY, ADMIN_PASSWORD,
+# METRICS_TOKEN & VAULT_TOKEN) may be read from a file named by the variable with a _FILE
+# suffix, ie: TWITCH_CLIENT_SECRET_FILE=/run/secrets/twitch_client_secret,
+# or from a systemd credential named after the variable
+
+# path to database directory
 DATA_PATH=""
 
+# database backend: bolt or sqlite (default: bolt)
+# bolt stores data in rtmpauthbot.db and sqlite in rtmpauthbot.sqlite
+DATABASE_BACKEND="bolt"
+
 # auth server listen ip
 AUTH_SERVER_IP="127.0.0.1"
 
@@ -50,12 +63,44 @@ RTMP_SERVER_FQDN="stream.mydomain.com"
 # rtmp server port (default: 1935)
 RTMP_SERVER_PORT="1935"
 
+# base url of hls playlists served by nginx, ie: https://stream.mydomain.com/hls
+# (used for public watch links, disabled when empty)
+HLS_BASE_URL=""
+
 # enable/disable discord integrations
 DISCORD_ENABLED=false
 
 # discord channel webhook
 DISCORD_WEBHOOK="https://discordapp.com/api/webhooks/1234567890/abcdefghijklmnopqrstuvwxyz1234567890"
 
+# discord oauth2 application of the member portal (/portal/), which is
+# enabled when the client id, secret & redirect url are set. the redirect url
+# must point to /portal/callback, ie: https://stream.mydomain.com/portal/callback
+DISCORD_CLIENT_ID=""
+DISCORD_CLIENT_SECRET=""
+DISCORD_REDIRECT_URL=""
+
+# discord oauth2 endpoints, only change these for testing
+DISCORD_AUTHORIZE_URL="https://discord.com/oauth2/authorize"
+DISCORD_TOKEN_URL="https://discord.com/api/oauth2/token"
+DISCORD_USER_URL="https://discord.com/api/users/@me"
+
+# discord slash commands (/live, /stream, /publisher). set the interactions
+# endpoint url of the application to /discord/interactions, ie:
+# https://stream.mydomain.com/discord/interactions
+# the public key of the application (enables the interactions endpoint)
+DISCORD_PUBLIC_KEY=""
+
+# bot token used to send stream keys by direct message & to register the
+# slash commands with: rtmpauthbot discord-commands
+DISCORD_BOT_TOKEN=""
+
+# comma separated discord user ids allowed to use /publisher add|remove
+DISCORD_ADMIN_IDS=""
+
+# discord api base url, only change this for testing
+DISCORD_API_URL="https://discord.com/api/v10"
+
 # enable/disable twitch integrations
 TWITCH_ENABLED=false
 
@@ -68,6 +113,66 @@ TWITCH_CLIENT_SECRET="abcd1234"
 # twitch poll rate in seconds
 TWITCH_POLL_RATE="60"
 
+# optional passphrase used to encrypt the cached twitch access token at rest
+TWITCH_TOKEN_ENCRYPTION_KEY=""
+
+# enable/disable owncast live status of linked instance urls
+OWNCAST_ENABLED=false
+
+# owncast poll rate in seconds
+OWNCAST_POLL_RATE="60"
+
+# enable/disable peertube live status of linked video channel urls
+PEERTUBE_ENABLED=false
+
+# peertube poll rate in seconds
+PEERTUBE_POLL_RATE="60"
+
+# consecutive polls a live stream must be missing before it is declared
+# offline (1 declares streams offline immediately)
+OFFLINE_GRACE_POLLS="2"
+
+# seconds a live stream must be missing before it is declared offline
+# (0 disables). streams are declared offline once either limit is reached
+OFFLINE_GRACE_PERIOD="0"
+
+# comma separated stream info fields that notify when changed while live
+# (title, game, tags, language, mature)
+STREAM_INFO_NOTIFY="game"
+
+# require If-Match headers with the publisher ETag when modifying existing
+# publishers through the api (default: false)
+API_REQUIRE_IF_MATCH="false"
+
+# admin dashboard (/admin/) login. the /api routes require a dashboard
+# session or http basic auth with these credentials. the dashboard & /api are
+# disabled until a password is set
+ADMIN_USERNAME="admin"
+ADMIN_PASSWORD=""
+
+# bearer token required to scrape /metrics (metrics are public when empty)
+METRICS_TOKEN=""
+
+# seconds to wait for open requests & pending notifications when stopping
+# (default: 10)
+SHUTDOWN_TIMEOUT="10"
+
+# directory of scheduled database snapshots (disabled when empty)
+BACKUP_DIR=""
+
+# interval between snapshots in seconds (default: 86400, minimum: 60)
+BACKUP_INTERVAL="86400"
+
+# number of snapshots to keep (default: 7)
+BACKUP_RETENTION="7"
+
+# optional hashicorp vault kv version 2 secret providing secrets which are
+# not set otherwise, keyed by variable name, ie: TWITCH_CLIENT_SECRET
+VAULT_ADDR=""
+VAULT_TOKEN=""
+VAULT_KV_MOUNT="secret"
+VAULT_SECRET_PATH=""
+
 `
 	systemdUnit = `
 [Unit]
@@ -79,6 +184,8 @@ Type=simple
 User=nginx
 WorkingDirectory=/var/cache/nginx
 ExecStart=/usr/local/bin/rtmpauthbot
+ExecReload=/bin/kill -HUP $MAINPID
+TimeoutStopSec=30
 
 [Install]
 WantedBy=multi-user.target
@@ -88,15 +195,15 @@ WantedBy=multi-user.target
 
 // PrintLicense simply prints the LICENSE to stdout
 func PrintLicense() {
-	fmt.Println(license)
+	fmt.Print(license)
 }
 
 // PrintEnv simply prints the env vars to stdout
 func PrintEnv() {
-	fmt.Println(envVars)
+	fmt.Print(envVars)
 }
 
 // PrintSystemDUnit simply prints the systemd unitfile to stdout
 func PrintSystemDUnit() {
-	fmt.Println(systemdUnit)
+	fmt.Print(systemdUnit)
 }
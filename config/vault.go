@@ -0,0 +1,46 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// vaultClient is the http client of vault requests
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// vaultResponse is the response of a vault kv version 2 secret
+type vaultResponse struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// vaultSecrets returns the key/value pairs of the latest version of a vault
+// kv version 2 secret
+func vaultSecrets(address, token, mount, path string) (map[string]string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/v1/%s/data/%s", address, mount, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s", resp.Status)
+	}
+	var body vaultResponse
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding vault response: %s", err)
+	}
+	secrets := make(map[string]string, len(body.Data.Data))
+	for k, v := range body.Data.Data {
+		secrets[k] = fmt.Sprint(v)
+	}
+	return secrets, nil
+}
@@ -0,0 +1,406 @@
+// rtmpauthbot admin dashboard. All data is read & modified through the http
+// api documented at /api/openapi.json.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+let editing = null;
+let events = null;
+let settingsLoaded = null;
+
+// api sends a request to the http api and returns the decoded json response
+async function api(method, path, body, headers) {
+  const init = {
+    method: method,
+    credentials: "same-origin",
+    headers: Object.assign({ "X-Requested-With": "rtmpauthbot" }, headers),
+  };
+  if (body !== undefined) {
+    init.headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, init);
+  const text = await resp.text();
+  const data = text ? JSON.parse(text) : null;
+  if (!resp.ok) {
+    const err = new Error(data && data.error ? data.error.message : resp.statusText);
+    err.status = resp.status;
+    err.headers = resp.headers;
+    throw err;
+  }
+  return { data: data, headers: resp.headers };
+}
+
+function publisherPath(name, sub) {
+  return "/api/v1/publishers/" + encodeURIComponent(name) + (sub ? "/" + sub : "");
+}
+
+function ifMatch(p) {
+  return { "If-Match": '"' + p.revision + '"' };
+}
+
+function showMessage(text, isError) {
+  const el = $("message");
+  el.textContent = text;
+  el.className = isError ? "error" : "";
+  el.hidden = false;
+}
+
+// run executes an action & reports errors, logging out on expired sessions
+async function run(action, success) {
+  try {
+    await action();
+    if (success) {
+      showMessage(success, false);
+    }
+  } catch (err) {
+    if (err.status === 401) {
+      showLogin();
+    }
+    showMessage(err.message, true);
+  }
+}
+
+function cell(row, content) {
+  const td = document.createElement("td");
+  if (content instanceof Node) {
+    td.appendChild(content);
+  } else {
+    td.textContent = content === undefined || content === null ? "" : content;
+  }
+  row.appendChild(td);
+  return td;
+}
+
+function button(label, onClick, className) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  if (className) {
+    b.className = className;
+  }
+  b.addEventListener("click", onClick);
+  return b;
+}
+
+function status(live) {
+  const span = document.createElement("span");
+  span.className = live ? "live" : "offline";
+  span.textContent = live ? "LIVE" : "offline";
+  return span;
+}
+
+function isLive(p) {
+  return p.rtmp_live !== "" || p.links.some((l) => l.live !== "");
+}
+
+function formatTime(t) {
+  return t ? new Date(t).toLocaleString() : "";
+}
+
+// listPublishers returns all publishers following the pagination cursors
+async function listPublishers() {
+  let publishers = [];
+  let cursor = "";
+  do {
+    const query = "?limit=1000" + (cursor ? "&cursor=" + encodeURIComponent(cursor) : "");
+    const resp = await api("GET", "/api/v1/publishers" + query);
+    publishers = publishers.concat(resp.data);
+    cursor = resp.headers.get("X-Next-Cursor");
+  } while (cursor);
+  return publishers;
+}
+
+async function loadPublishers() {
+  const publishers = await listPublishers();
+  const tbody = $("publishers");
+  tbody.replaceChildren();
+  for (const p of publishers) {
+    const row = document.createElement("tr");
+    cell(row, p.name);
+    cell(row, status(isLive(p)));
+    cell(row, p.links.map((l) => l.provider + ": " + l.account + (l.live ? " (live)" : "")).join(", "));
+    cell(row, p.unlisted ? "yes" : "");
+    const actions = cell(row, button("Edit", () => run(() => openEditor(p.name))));
+    actions.appendChild(button("Delete", () => deletePublisher(p), "danger"));
+    tbody.appendChild(row);
+  }
+}
+
+async function deletePublisher(p) {
+  if (!confirm("Delete publisher " + p.name + "?")) {
+    return;
+  }
+  await run(async () => {
+    await api("DELETE", publisherPath(p.name), undefined, ifMatch(p));
+    if (editing && editing.name === p.name) {
+      closeEditor();
+    }
+    await loadPublishers();
+  }, "Deleted " + p.name);
+}
+
+async function openEditor(name) {
+  const resp = await api("GET", publisherPath(name));
+  editing = resp.data;
+  renderEditor();
+  const sessions = await api("GET", publisherPath(name, "sessions"));
+  const tbody = $("sessions");
+  tbody.replaceChildren();
+  for (const s of sessions.data) {
+    const row = document.createElement("tr");
+    cell(row, s.provider);
+    cell(row, s.account);
+    cell(row, s.title);
+    cell(row, s.game);
+    cell(row, formatTime(s.started_at));
+    cell(row, s.ended_at ? formatTime(s.ended_at) : status(true));
+    tbody.appendChild(row);
+  }
+  $("editor").hidden = false;
+}
+
+function renderEditor() {
+  const p = editing;
+  $("editor-name").textContent = p.name;
+  const form = $("edit-form");
+  form.key.value = p.key;
+  form.twitch_stream.value = p.twitch_stream;
+  form.discord_id.value = p.discord_id;
+  form.unlisted.checked = p.unlisted;
+  const tbody = $("links");
+  tbody.replaceChildren();
+  for (const l of p.links) {
+    const row = document.createElement("tr");
+    cell(row, l.provider);
+    cell(row, l.account);
+    cell(row, l.state);
+    cell(row, l.stream_info ? l.stream_info.title : "");
+    cell(row, button("Unlink", () => removeLink(l), "danger"));
+    tbody.appendChild(row);
+  }
+}
+
+function closeEditor() {
+  editing = null;
+  $("editor").hidden = true;
+}
+
+// refreshEditor reloads the edited publisher after links were changed
+async function refreshEditor() {
+  const resp = await api("GET", publisherPath(editing.name));
+  editing = resp.data;
+  renderEditor();
+  await loadPublishers();
+}
+
+async function removeLink(l) {
+  const query = "?provider=" + encodeURIComponent(l.provider) + "&account=" + encodeURIComponent(l.account);
+  await run(async () => {
+    await api("DELETE", publisherPath(editing.name, "links") + query, undefined, ifMatch(editing));
+    await refreshEditor();
+  }, "Unlinked " + l.account);
+}
+
+function showLogin() {
+  if (events) {
+    events.close();
+    events = null;
+  }
+  $("nav").hidden = true;
+  $("dashboard").hidden = true;
+  $("editor").hidden = true;
+  $("login").hidden = false;
+}
+
+async function showDashboard(session) {
+  $("login").hidden = true;
+  $("nav").hidden = false;
+  $("logout").hidden = !session.auth_required;
+  $("dashboard").hidden = false;
+  watchEvents();
+  await loadPublishers();
+  await loadAllowList();
+  await loadSettings();
+}
+
+async function loadAllowList() {
+  const resp = await api("GET", "/api/v1/portal/allow-list");
+  $("allow-list-form").entries.value = resp.data.join("\n");
+}
+
+// settingsFields are the runtime settings edited in the settings form
+const settingsFields = [
+  "discord_enabled", "discord_webhook", "rtmp_server_fqdn",
+  "twitch_enabled", "twitch_poll_rate", "owncast_enabled", "owncast_poll_rate",
+  "peertube_enabled", "peertube_poll_rate",
+];
+
+function renderSettings(settings) {
+  settingsLoaded = settings;
+  const form = $("settings-form");
+  for (const field of settingsFields) {
+    const input = form.elements[field];
+    if (input.type === "checkbox") {
+      input.checked = settings[field];
+    } else {
+      input.value = settings[field];
+    }
+    // settings set by -set flags can not be changed
+    input.disabled = settings.pinned.includes(field);
+  }
+}
+
+async function loadSettings() {
+  const resp = await api("GET", "/api/settings");
+  renderSettings(resp.data);
+}
+
+// watchEvents reloads the publishers when live state changes
+function watchEvents() {
+  if (events) {
+    return;
+  }
+  events = new EventSource("/api/events");
+  let timer = null;
+  const reload = () => {
+    clearTimeout(timer);
+    timer = setTimeout(() => {
+      if (!$("dashboard").hidden) {
+        run(loadPublishers);
+      }
+    }, 500);
+  };
+  for (const type of ["publish_start", "publish_stop", "live_start", "live_stop"]) {
+    events.addEventListener(type, reload);
+  }
+}
+
+$("login-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  run(async () => {
+    const resp = await api("POST", "/api/session", {
+      username: form.username.value,
+      password: form.password.value,
+    });
+    form.password.value = "";
+    $("message").hidden = true;
+    await showDashboard(resp.data);
+  });
+});
+
+$("logout").addEventListener("click", () => {
+  run(async () => {
+    await api("DELETE", "/api/session");
+    closeEditor();
+    showLogin();
+  }, "Logged out");
+});
+
+$("test-notification").addEventListener("click", () => {
+  run(() => api("POST", "/api/v1/notifications/test"), "Test notification sent");
+});
+
+$("create-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  const body = { name: form.name.value, unlisted: form.unlisted.checked };
+  if (form.key.value) {
+    body.key = form.key.value;
+  }
+  if (form.twitch_stream.value) {
+    body.twitch_stream = form.twitch_stream.value;
+  }
+  run(async () => {
+    await api("POST", "/api/v1/publishers", body);
+    form.reset();
+    await loadPublishers();
+  }, "Added " + body.name);
+});
+
+$("edit-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  const patch = {
+    key: form.key.value,
+    twitch_stream: form.twitch_stream.value || null,
+    discord_id: form.discord_id.value || null,
+    unlisted: form.unlisted.checked,
+  };
+  run(async () => {
+    const resp = await api("PATCH", publisherPath(editing.name), patch, ifMatch(editing));
+    editing = resp.data;
+    renderEditor();
+    await loadPublishers();
+  }, "Saved " + editing.name);
+});
+
+$("rotate-key").addEventListener("click", () => {
+  if (!confirm("Replace the stream key of " + editing.name + "?")) {
+    return;
+  }
+  run(async () => {
+    await api("POST", publisherPath(editing.name, "key"), undefined, ifMatch(editing));
+    await refreshEditor();
+  }, "Rotated the key of " + editing.name);
+});
+
+$("allow-list-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const entries = e.target.entries.value.split("\n");
+  run(async () => {
+    const resp = await api("PUT", "/api/v1/portal/allow-list", entries);
+    e.target.entries.value = resp.data.join("\n");
+  }, "Saved the allow-list");
+});
+
+$("settings-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  // only changed fields are stored, others keep following the configuration
+  const settings = {};
+  for (const field of settingsFields) {
+    const input = form.elements[field];
+    let value = input.value;
+    if (input.type === "checkbox") {
+      value = input.checked;
+    } else if (input.type === "number") {
+      value = Number(input.value);
+    }
+    if (value !== settingsLoaded[field]) {
+      settings[field] = value;
+    }
+  }
+  run(async () => {
+    const resp = await api("PUT", "/api/settings", settings);
+    renderSettings(resp.data);
+  }, "Saved the settings");
+});
+
+$("close-editor").addEventListener("click", closeEditor);
+
+$("link-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  const link = { provider: form.provider.value, account: form.account.value };
+  run(async () => {
+    await api("POST", publisherPath(editing.name, "links"), link, ifMatch(editing));
+    form.account.value = "";
+    await refreshEditor();
+  }, "Linked " + link.account);
+});
+
+run(async () => {
+  let resp;
+  try {
+    resp = await api("GET", "/api/session");
+  } catch (err) {
+    if (err.status !== 401) {
+      throw err;
+    }
+    showLogin();
+    return;
+  }
+  await showDashboard(resp.data);
+});
@@ -2,16 +2,73 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
 	log "github.com/sirupsen/logrus"
 )
 
+// validationError is returned for invalid client input
+type validationError struct {
+	msg string
+}
+
+func (e *validationError) Error() string {
+	return e.msg
+}
+
+// invalidf returns a formatted validationError
+func invalidf(format string, a ...interface{}) error {
+	return &validationError{msg: fmt.Sprintf(format, a...)}
+}
+
+// errConflict is returned when creating a publisher which already exists
+var errConflict = errors.New("publisher already exists")
+
+// errorStatus returns the http status code & machine readable error code for
+// an error
+func errorStatus(err error) (int, string) {
+	var invalid *validationError
+	switch {
+	case errors.As(err, &invalid):
+		return http.StatusBadRequest, "invalid_request"
+	case errors.Is(err, store.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, errConflict):
+		return http.StatusConflict, "conflict"
+	case errors.Is(err, errPreconditionFailed):
+		return http.StatusPreconditionFailed, "precondition_failed"
+	case errors.Is(err, errPreconditionRequired):
+		return http.StatusPreconditionRequired, "precondition_required"
+	}
+	return http.StatusInternalServerError, "internal_error"
+}
+
+// errorMessage returns the client facing message of an error. The details of
+// internal errors are only logged.
+func errorMessage(err error, status int) string {
+	if status == http.StatusInternalServerError {
+		log.Error(err)
+		return http.StatusText(status)
+	}
+	return err.Error()
+}
+
+// writeError writes a plain text error response with the status code of the
+// error
+func writeError(w http.ResponseWriter, err error) {
+	status, _ := errorStatus(err)
+	http.Error(w, errorMessage(err, status), status)
+}
+
 // PublisherAPIHandler manages publisher database records
 func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request) {
 
-	var p Publisher
+	var p models.Publisher
 
 	w.Header().Add("Content-Type", "application/json")
 
@@ -19,10 +76,14 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 	if r.Method == "GET" {
 		name, ok := r.URL.Query()["name"]
 		if !ok || len(name[0]) < 1 {
-			publishers, err := c.getAllPublisher()
+			// legacy listings are only paginated when a limit is requested
+			publishers, err := c.queryPublishers(w, r, 0)
 			if err != nil {
 				log.Debug("error retrieving all publishers: ", err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeError(w, err)
+				return
+			}
+			if notModified(w, r, listETag(publishers)) {
 				return
 			}
 			content, err := json.Marshal(publishers)
@@ -43,6 +104,9 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		if notModified(w, r, publisherETag(&p)) {
+			return
+		}
 		content, err := json.Marshal(p)
 		if err != nil {
 			log.Debug(err)
@@ -75,12 +139,13 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		err = c.updatePublisher(p)
+		updated, err := c.updatePublisher(p, c.ifMatch(r))
 		if err != nil {
 			log.Debugf("error updating publisher '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
+		w.Header().Set("ETag", publisherETag(&updated))
 		log.Infof("publisher updated: %s", p.Name)
 		w.WriteHeader(http.StatusCreated)
 		return
@@ -100,16 +165,10 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		_, err = c.getPublisher(p.Name)
-		if err != nil {
-			log.Debugf("error retrieving publisher for deletion '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusNotFound)
-			return
-		}
-		err = c.deletePublisher(p.Name)
+		err = c.deletePublisher(p.Name, c.ifMatch(r))
 		if err != nil {
 			log.Debugf("error deleting publisher '%s': %s\n", p.Name, err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 		log.Infof("publisher deleted: %s", p.Name)
@@ -120,3 +179,71 @@ func (c *Controller) PublisherAPIHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNotImplemented)
 	return
 }
+
+// PublisherItemHandler is the http handler for "/api/publisher/{name}".
+// PATCH applies a JSON Merge Patch and PUT replaces the publisher.
+func (c *Controller) PublisherItemHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	if r.Method == "GET" {
+		p, err := c.getPublisher(name)
+		if err != nil {
+			log.Debugf("error retrieving publisher '%s': %s", name, err)
+			writeError(w, err)
+			return
+		}
+		if notModified(w, r, publisherETag(&p)) {
+			return
+		}
+		content, err := json.Marshal(p)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(content)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Debugf("error reading %s body: %s", r.Method, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	patch, err := parsePublisherPatch(name, body)
+	if err != nil {
+		log.Debug(err)
+		writeError(w, err)
+		return
+	}
+
+	create := false
+	if r.Method == "PUT" {
+		err = patch.replace()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		create = true
+	}
+
+	p, created, err := c.applyPublisherPatch(name, patch, create, c.ifMatch(r))
+	if err != nil {
+		log.Debugf("error updating publisher '%s': %s", name, err)
+		writeError(w, err)
+		return
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("publisher updated: %s", name)
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("ETag", publisherETag(&p))
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(content)
+}
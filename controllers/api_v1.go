@@ -0,0 +1,389 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIError is the body of all error responses of the versioned api
+type APIError struct {
+	Error APIErrorDetail `json:"error"`
+}
+
+// APIErrorDetail contains a machine readable error code & a description
+type APIErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// keyResponse is the body of the publisher key sub-resource
+type keyResponse struct {
+	Key string `json:"key"`
+}
+
+// writeJSON writes v as a json response with the status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// writeAPIError writes a json error response
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	content, _ := json.Marshal(APIError{Error: APIErrorDetail{Code: code, Message: message}})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(content)
+}
+
+// writeJSONError writes a json error response with the status & code of err
+func writeJSONError(w http.ResponseWriter, err error) {
+	status, code := errorStatus(err)
+	writeAPIError(w, status, code, errorMessage(err, status))
+}
+
+// NotFoundHandler responds to requests which match no route
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no route for %s", r.URL.Path))
+}
+
+// MethodNotAllowedHandler responds to requests with an unsupported method
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed",
+		fmt.Sprintf("method %s is not allowed, allowed methods: %s", r.Method, w.Header().Get("Allow")))
+}
+
+// readBody reads the request body
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, invalidf("error reading request body: %s", err)
+	}
+	return body, nil
+}
+
+// decodeBody decodes the json request body into v
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return invalidf("invalid json body: %s", err)
+	}
+	return nil
+}
+
+// publisherError adds the publisher name to not found errors of the store
+func publisherError(name string, err error) error {
+	if err == store.ErrNotFound {
+		return fmt.Errorf("publisher %w: %s", err, name)
+	}
+	return err
+}
+
+// generateKey returns a random stream key
+func generateKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// writePublisher writes a publisher response with its ETag
+func writePublisher(w http.ResponseWriter, status int, p *models.Publisher) {
+	w.Header().Set("ETag", publisherETag(p))
+	writeJSON(w, status, p)
+}
+
+// ListPublishersHandler is the http handler for "GET /api/v1/publishers".
+// Publishers are paginated with the limit & cursor query parameters.
+func (c *Controller) ListPublishersHandler(w http.ResponseWriter, r *http.Request) {
+	publishers, err := c.queryPublishers(w, r, defaultPageLimit)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if notModified(w, r, listETag(publishers)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, publishers)
+}
+
+// CreatePublisherHandler is the http handler for "POST /api/v1/publishers".
+// A random key is generated if none is provided.
+func (c *Controller) CreatePublisherHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := readBody(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	var p struct {
+		Name string `json:"name"`
+	}
+	err = json.Unmarshal(body, &p)
+	if err != nil {
+		writeJSONError(w, invalidf("invalid json body: %s", err))
+		return
+	}
+	if p.Name == "" || strings.Contains(p.Name, "/") {
+		writeJSONError(w, invalidf("name must be a non-empty string without slashes"))
+		return
+	}
+	patch, err := parsePublisherPatch(p.Name, body)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if patch.Key == nil {
+		key, err := generateKey()
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		patch.Key = &key
+	}
+	created, _, err := c.applyPublisherPatch(p.Name, patch, true, func(p *models.Publisher, exists bool) error {
+		if exists {
+			return errConflict
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	log.Infof("publisher created: %s", created.Name)
+	w.Header().Set("Location", "/api/v1/publishers/"+url.PathEscape(created.Name))
+	writePublisher(w, http.StatusCreated, &created)
+}
+
+// GetPublisherHandler is the http handler for "GET /api/v1/publishers/{name}"
+func (c *Controller) GetPublisherHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	p, err := c.Store.GetPublisher(name)
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	if notModified(w, r, publisherETag(&p)) {
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// UpdatePublisherHandler is the http handler for "PUT" & "PATCH" of
+// "/api/v1/publishers/{name}". PATCH applies a JSON Merge Patch and PUT
+// replaces the publisher, creating it if needed.
+func (c *Controller) UpdatePublisherHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	body, err := readBody(r)
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	patch, err := parsePublisherPatch(name, body)
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	create := r.Method == "PUT"
+	if create {
+		err = patch.replace()
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+	}
+	p, created, err := c.applyPublisherPatch(name, patch, create, c.ifMatch(r))
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	log.Infof("publisher updated: %s", name)
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writePublisher(w, status, &p)
+}
+
+// DeletePublisherHandler is the http handler for
+// "DELETE /api/v1/publishers/{name}"
+func (c *Controller) DeletePublisherHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	err := c.deletePublisher(name, c.ifMatch(r))
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	log.Infof("publisher deleted: %s", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PublisherKeyHandler is the http handler for "/api/v1/publishers/{name}/key".
+// GET returns the stream key, PUT sets the provided key and POST rotates the
+// key to a new random key.
+func (c *Controller) PublisherKeyHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if r.Method == "GET" {
+		p, err := c.Store.GetPublisher(name)
+		if err != nil {
+			writeJSONError(w, publisherError(name, err))
+			return
+		}
+		w.Header().Set("ETag", publisherETag(&p))
+		writeJSON(w, http.StatusOK, keyResponse{Key: p.Key})
+		return
+	}
+
+	var key keyResponse
+	if r.Method == "PUT" {
+		err := decodeBody(r, &key)
+		if err != nil {
+			writeJSONError(w, publisherError(name, err))
+			return
+		}
+	} else {
+		var err error
+		key.Key, err = generateKey()
+		if err != nil {
+			writeJSONError(w, publisherError(name, err))
+			return
+		}
+	}
+	if key.Key == "" {
+		writeJSONError(w, invalidf("key must be a non-empty string"))
+		return
+	}
+	p, _, err := c.applyPublisherPatch(name, publisherPatch{Key: &key.Key}, false, c.ifMatch(r))
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	log.Infof("publisher key updated: %s", name)
+	w.Header().Set("ETag", publisherETag(&p))
+	writeJSON(w, http.StatusOK, keyResponse{Key: p.Key})
+}
+
+// PublisherSessionsHandler is the http handler for
+// "GET /api/v1/publishers/{name}/sessions"
+func (c *Controller) PublisherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	_, err := c.Store.GetPublisher(name)
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	sessions, err := c.Store.ListSessions(name)
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// PublisherLinksHandler is the http handler for
+// "/api/v1/publishers/{name}/links". GET lists the links, PUT replaces all
+// links, POST adds a link and DELETE removes the link identified by the
+// provider & account query parameters.
+func (c *Controller) PublisherLinksHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	var (
+		p   models.Publisher
+		err error
+	)
+	switch r.Method {
+	case "GET":
+		p, err = c.Store.GetPublisher(name)
+		if err == nil {
+			w.Header().Set("ETag", publisherETag(&p))
+		}
+	case "PUT":
+		links := []models.StreamLink{}
+		err = decodeBody(r, &links)
+		if err == nil {
+			p, _, err = c.applyPublisherPatch(name, publisherPatch{Links: &links}, false, c.ifMatch(r))
+		}
+	case "POST":
+		var link models.StreamLink
+		err = decodeBody(r, &link)
+		if err == nil {
+			p, err = c.addLink(name, link, c.ifMatch(r))
+		}
+	case "DELETE":
+		q := r.URL.Query()
+		p, err = c.removeLink(name, q.Get("provider"), q.Get("account"), c.ifMatch(r))
+	}
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = http.StatusCreated
+	}
+	if r.Method != "GET" {
+		log.Infof("publisher links updated: %s", name)
+		w.Header().Set("ETag", publisherETag(&p))
+	}
+	writeJSON(w, status, p.Links)
+}
+
+// addLink links an additional provider account to a publisher
+func (c *Controller) addLink(name string, link models.StreamLink, check precondition) (models.Publisher, error) {
+	resolved, err := c.resolveLinks([]models.StreamLink{link})
+	if err != nil {
+		return models.Publisher{}, err
+	}
+	link = resolved[0]
+	link.Normalize()
+	return c.Store.UpdatePublisher(name, func(p *models.Publisher) error {
+		err := check(p, true)
+		if err != nil {
+			return err
+		}
+		for i := range p.Links {
+			if p.Links[i].Provider == link.Provider && strings.EqualFold(p.Links[i].Account, link.Account) {
+				return invalidf("%s account is already linked: %s", link.Provider, link.Account)
+			}
+		}
+		p.Links = append(p.Links, link)
+		return nil
+	})
+}
+
+// removeLink unlinks a provider account from a publisher
+func (c *Controller) removeLink(name, provider, account string, check precondition) (models.Publisher, error) {
+	if provider == "" || account == "" {
+		return models.Publisher{}, invalidf("provider and account query parameters are required")
+	}
+	return c.Store.UpdatePublisher(name, func(p *models.Publisher) error {
+		err := check(p, true)
+		if err != nil {
+			return err
+		}
+		for i := range p.Links {
+			if p.Links[i].Provider == provider && strings.EqualFold(p.Links[i].Account, account) {
+				p.Links = append(p.Links[:i:i], p.Links[i+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s account is not linked: %s", store.ErrNotFound, provider, account)
+	})
+}
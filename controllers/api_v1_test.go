@@ -0,0 +1,20 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreatePublisherLocation(t *testing.T) {
+	c := newTestController(t, nil)
+	w := httptest.NewRecorder()
+	c.CreatePublisherHandler(w, httptest.NewRequest("POST", "/api/v1/publishers", strings.NewReader(`{"name": "dj alice?#1"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the publisher to be created, got %d %s", w.Code, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "/api/v1/publishers/dj%20alice%3F%231" {
+		t.Errorf("expected an escaped location, got %s", location)
+	}
+}
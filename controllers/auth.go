@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionCookie is the name of the admin dashboard session cookie
+	sessionCookie = "rtmpauthbot_session"
+	// sessionTTL is the lifetime of admin dashboard & portal sessions
+	sessionTTL = 12 * time.Hour
+	// requestedWithHeader must be sent by browsers using a session cookie to
+	// modify resources. Cross-site requests cannot set custom headers.
+	requestedWithHeader = "X-Requested-With"
+)
+
+// adminDisabled explains why the admin dashboard & api refuse all requests
+const adminDisabled = "the admin dashboard & api are disabled until ADMIN_PASSWORD is set"
+
+// session is a logged in admin or portal user
+type session struct {
+	Subject string
+	Expires time.Time
+}
+
+// sessionStore tracks logged in sessions by their random token
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+// create returns the token of a new session of the subject
+func (s *sessionStore) create(subject string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]session)
+	}
+	now := time.Now()
+	for t, expired := range s.sessions {
+		if now.After(expired.Expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = session{Subject: subject, Expires: now.Add(sessionTTL)}
+	return token, nil
+}
+
+// get returns the subject of a session if it exists & has not expired
+func (s *sessionStore) get(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.sessions[token]
+	if !ok || time.Now().After(current.Expires) {
+		return "", false
+	}
+	return current.Subject, true
+}
+
+// remove ends a session
+func (s *sessionStore) remove(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+// setSessionCookie sends a session cookie, an empty token removes it
+func setSessionCookie(w http.ResponseWriter, r *http.Request, name, token string) {
+	maxAge := int(sessionTTL.Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// authEnabled returns true if an admin password is configured
+func (c *Controller) authEnabled() bool {
+	return c.Config().AdminPassword != ""
+}
+
+// secureEqual compares secrets in constant time
+func secureEqual(a, b string) bool {
+	ha, hb := sha256.Sum256([]byte(a)), sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// checkCredentials returns true if the username & password are the
+// configured admin credentials
+func (c *Controller) checkCredentials(username, password string) bool {
+	// evaluate both to avoid leaking which one is wrong through timing
+	userOK := secureEqual(username, c.Config().AdminUsername)
+	passOK := secureEqual(password, c.Config().AdminPassword)
+	return userOK && passOK
+}
+
+// sessionToken returns the admin session token of the request if it is valid
+func (c *Controller) sessionToken(r *http.Request) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	_, ok := c.adminSessions.get(cookie.Value)
+	return cookie.Value, ok
+}
+
+// authorized returns true if the request may access the api. Requests are
+// authorized with http basic auth or a dashboard session, which additionally
+// requires the X-Requested-With header to modify resources. No request is
+// authorized until an admin password is configured.
+func (c *Controller) authorized(r *http.Request) bool {
+	if !c.authEnabled() {
+		return false
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return c.checkCredentials(username, password)
+	}
+	if _, ok := c.sessionToken(r); !ok {
+		return false
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return r.Header.Get(requestedWithHeader) != ""
+}
+
+// requestUser returns the admin user of an authorized request for auditing
+func (c *Controller) requestUser(r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok {
+		return username
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if subject, ok := c.adminSessions.get(cookie.Value); ok {
+			return subject
+		}
+	}
+	return "unknown"
+}
+
+// RequireAuth rejects unauthorized requests to the "/api" routes, all of them
+// when no admin password is configured. The session & openapi routes remain
+// public, "/metrics" is protected by its own token.
+func (c *Controller) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		public := !strings.HasPrefix(path, "/api/") || path == "/api/session" || path == "/api/openapi.json"
+		if public || c.authorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// browsers using the dashboard should not prompt for basic auth
+		if r.Header.Get(requestedWithHeader) == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="rtmpauthbot"`)
+		}
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+	})
+}
+
+// sessionResponse describes the current admin session
+type sessionResponse struct {
+	Username     string `json:"username,omitempty"`
+	AuthRequired bool   `json:"auth_required"`
+}
+
+// SessionHandler is the http handler for "/api/session". GET returns the
+// current session, POST logs in with a json username & password and DELETE
+// logs out.
+func (c *Controller) SessionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !c.authorized(r) {
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "authentication required")
+			return
+		}
+		writeJSON(w, http.StatusOK, sessionResponse{Username: c.Config().AdminUsername, AuthRequired: true})
+	case "POST":
+		var login struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		err := decodeBody(r, &login)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		if !c.authEnabled() {
+			writeAPIError(w, http.StatusConflict, "conflict", adminDisabled)
+			return
+		}
+		if !c.checkCredentials(login.Username, login.Password) {
+			log.Warnf("admin login failed for '%s' from %s", login.Username, r.RemoteAddr)
+			// slow down password guessing
+			time.Sleep(time.Second)
+			writeAPIError(w, http.StatusUnauthorized, "unauthorized", "invalid username or password")
+			return
+		}
+		token, err := c.adminSessions.create(login.Username)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		log.Infof("admin login: %s from %s", login.Username, r.RemoteAddr)
+		setSessionCookie(w, r, sessionCookie, token)
+		writeJSON(w, http.StatusOK, sessionResponse{Username: login.Username, AuthRequired: true})
+	case "DELETE":
+		if token, ok := c.sessionToken(r); ok {
+			c.adminSessions.remove(token)
+		}
+		setSessionCookie(w, r, sessionCookie, "")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,92 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authRequest is a request to a route behind RequireAuth
+type authRequest struct {
+	method, path string
+	basicAuth    []string
+	session      bool
+	requestedBy  bool
+	status       int
+}
+
+func checkAuth(t *testing.T, c *Controller, tests []authRequest) {
+	t.Helper()
+	handler := c.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	token, err := c.adminSessions.create("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.basicAuth != nil {
+			r.SetBasicAuth(tc.basicAuth[0], tc.basicAuth[1])
+		}
+		if tc.session {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+		}
+		if tc.requestedBy {
+			r.Header.Set(requestedWithHeader, "XMLHttpRequest")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s %s %+v: expected %d, got %d", tc.method, tc.path, tc, tc.status, w.Code)
+		}
+	}
+}
+
+func TestRequireAuthWithoutPassword(t *testing.T) {
+	c := newTestController(t, map[string]string{"ADMIN_PASSWORD": ""})
+	checkAuth(t, c, []authRequest{
+		{method: "GET", path: "/api/v1/publishers", status: http.StatusUnauthorized},
+		{method: "POST", path: "/api/v1/publishers", status: http.StatusUnauthorized},
+		{method: "PUT", path: "/api/settings", status: http.StatusUnauthorized},
+		{method: "GET", path: "/metrics", status: http.StatusOK},
+		{method: "GET", path: "/api/v1/publishers", basicAuth: []string{"admin", ""}, status: http.StatusUnauthorized},
+		{method: "DELETE", path: "/api/publisher", session: true, requestedBy: true, status: http.StatusUnauthorized},
+		{method: "GET", path: "/api/openapi.json", status: http.StatusOK},
+		{method: "POST", path: "/on_publish", status: http.StatusOK},
+		{method: "GET", path: "/public/live", status: http.StatusOK},
+	})
+
+	w := httptest.NewRecorder()
+	c.DashboardHandler(w, httptest.NewRequest("GET", "/admin/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected the dashboard to be unavailable, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	c.SessionHandler(w, httptest.NewRequest("GET", "/api/session", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected no session, got %d", w.Code)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	c := newTestController(t, map[string]string{"ADMIN_USERNAME": "admin", "ADMIN_PASSWORD": "secret"})
+	checkAuth(t, c, []authRequest{
+		{method: "GET", path: "/api/v1/publishers", status: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/publishers", basicAuth: []string{"admin", "secret"}, status: http.StatusOK},
+		{method: "POST", path: "/api/v1/publishers", basicAuth: []string{"admin", "secret"}, status: http.StatusOK},
+		{method: "GET", path: "/api/v1/publishers", basicAuth: []string{"admin", "wrong"}, status: http.StatusUnauthorized},
+		{method: "GET", path: "/api/v1/publishers", basicAuth: []string{"root", "secret"}, status: http.StatusUnauthorized},
+		{method: "GET", path: "/metrics", status: http.StatusOK},
+		{method: "GET", path: "/api/v1/publishers", session: true, status: http.StatusOK},
+		{method: "POST", path: "/api/v1/publishers", session: true, status: http.StatusUnauthorized},
+		{method: "POST", path: "/api/v1/publishers", session: true, requestedBy: true, status: http.StatusOK},
+		{method: "GET", path: "/api/session", status: http.StatusOK},
+	})
+
+	w := httptest.NewRecorder()
+	c.DashboardHandler(w, httptest.NewRequest("GET", "/admin/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the dashboard, got %d", w.Code)
+	}
+}
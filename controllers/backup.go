@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// snapshotPrefix is the file name prefix of database snapshots
+const snapshotPrefix = "rtmpauthbot-"
+
+// snapshotName returns the file name of a database snapshot taken at t
+func (c *Controller) snapshotName(t time.Time) string {
+	ext := filepath.Ext(c.Config().DatabasePath())
+	return snapshotPrefix + t.UTC().Format("20060102T150405Z") + ext
+}
+
+// BackupHandler is the http handler for "/api/admin/backup". A consistent
+// snapshot of the database is streamed while the server keeps running.
+func (c *Controller) BackupHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.snapshotName(time.Now())))
+	n, err := c.Store.Backup(w)
+	if err != nil {
+		// headers are already sent, the client receives a truncated file
+		log.Error("error streaming database backup: ", err)
+		return
+	}
+	log.Infof("streamed database backup (%d bytes)", n)
+}
+
+// writeSnapshot writes a database snapshot to dir and returns its path. The
+// snapshot is written to a temporary file first so an interrupted backup
+// never leaves a partial snapshot behind.
+func (c *Controller) writeSnapshot(dir string, now time.Time) (string, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = c.Store.Backup(f)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, c.snapshotName(now))
+	return path, os.Rename(f.Name(), path)
+}
+
+// pruneSnapshots removes the oldest snapshots in dir keeping retention
+// snapshots
+func (c *Controller) pruneSnapshots(dir string, retention int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	ext := filepath.Ext(c.Config().DatabasePath())
+	var snapshots []string
+	for i := range entries {
+		name := entries[i].Name()
+		if entries[i].Type().IsRegular() && strings.HasPrefix(name, snapshotPrefix) && filepath.Ext(name) == ext {
+			snapshots = append(snapshots, name)
+		}
+	}
+	// timestamped names sort chronologically
+	sort.Strings(snapshots)
+	for len(snapshots) > retention {
+		log.Info("removing expired database snapshot: ", snapshots[0])
+		err = os.Remove(filepath.Join(dir, snapshots[0]))
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+func (c *Controller) backupMain() {
+	path, err := c.writeSnapshot(c.Config().BackupDir, time.Now())
+	if err != nil {
+		log.Error("error writing database snapshot: ", err)
+		return
+	}
+	log.Info("wrote database snapshot: ", path)
+	err = c.pruneSnapshots(c.Config().BackupDir, c.Config().BackupRetention)
+	if err != nil {
+		log.Error("error pruning database snapshots: ", err)
+	}
+}
+
+// BackupScheduler periodically writes database snapshots to the backup
+// directory until the context is cancelled
+func (c *Controller) BackupScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.backupMain()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
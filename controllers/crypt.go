@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// sealedPrefix identifies values encrypted at rest by sealValue
+	sealedPrefix = "enc:"
+	// sealedVersion identifies the key derivation of sealed values. Values of
+	// earlier versions, keyed by the sha256 of the passphrase, are no longer
+	// opened; cached tokens sealed by them are requested again.
+	sealedVersion = "v2:"
+	// saltSize is the size of the random salt stored with each sealed value
+	saltSize = 16
+)
+
+// isSealed returns true if the value was encrypted by sealValue
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// sealKey derives an AES-256 key from the configured passphrase & salt with
+// scrypt, making brute-forcing the passphrase of a leaked database costly
+func sealKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// sealCipher returns the AES-GCM cipher of the passphrase & salt
+func sealCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := sealKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts a value with AES-GCM using a key derived from passphrase
+// and a random salt, which is stored with the nonce in the sealed value
+func sealValue(passphrase, value string) (string, error) {
+	salt := make([]byte, saltSize)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := sealCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(append(salt, nonce...), nonce, []byte(value), nil)
+	return sealedPrefix + sealedVersion + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openValue decrypts a value encrypted by sealValue
+func openValue(passphrase, value string) (string, error) {
+	if !isSealed(value) {
+		return "", errors.New("value is not encrypted")
+	}
+	encoded := strings.TrimPrefix(value, sealedPrefix)
+	if !strings.HasPrefix(encoded, sealedVersion) {
+		return "", errors.New("value is encrypted with an unsupported key derivation")
+	}
+	if passphrase == "" {
+		return "", errors.New("value is encrypted but no encryption key is configured")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(encoded, sealedVersion))
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < saltSize {
+		return "", errors.New("encrypted value is too short")
+	}
+	salt, sealed := sealed[:saltSize], sealed[saltSize:]
+	gcm, err := sealCipher(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
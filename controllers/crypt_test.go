@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSealValue(t *testing.T) {
+	sealed, err := sealValue("passphrase", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isSealed(sealed) || strings.Contains(sealed, "token") {
+		t.Fatalf("unexpected sealed value: %s", sealed)
+	}
+	again, err := sealValue("passphrase", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("expected a random salt & nonce for each sealed value")
+	}
+
+	value, err := openValue("passphrase", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "token" {
+		t.Errorf("expected token, got %s", value)
+	}
+	_, err = openValue("wrong", sealed)
+	if err == nil {
+		t.Error("expected an error opening with the wrong passphrase")
+	}
+	_, err = openValue("", sealed)
+	if err == nil {
+		t.Error("expected an error opening without a passphrase")
+	}
+	// values sealed with the sha256 of the passphrase are no longer opened
+	_, err = openValue("passphrase", "enc:v1:AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA")
+	if err == nil {
+		t.Error("expected an error opening a legacy value")
+	}
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// adminAssets contains the static files of the admin dashboard
+//
+//go:embed admin
+var adminAssets embed.FS
+
+// DashboardHandler is the http handler for "/admin/". The dashboard is a
+// static page which logs in & manages publishers through the http api. It is
+// unavailable until an admin password is configured.
+func (c *Controller) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.authEnabled() {
+		http.Error(w, adminDisabled, http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path == "/admin" {
+		http.Redirect(w, r, "/admin/", http.StatusMovedPermanently)
+		return
+	}
+	assets, err := fs.Sub(adminAssets, "admin")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.StripPrefix("/admin", http.FileServer(http.FS(assets))).ServeHTTP(w, r)
+}
@@ -2,9 +2,12 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,13 +19,27 @@ type DiscordWebhook struct {
 	Content string `json:"content"`
 }
 
-func (c *Controller) callWebhook(message string) error {
+func (c *Controller) callWebhook(ctx context.Context, message string) error {
 
-	webhookURL := c.Config.DiscordWebhook
+	webhookURL := c.Config().DiscordWebhook
 	if webhookURL == defaultWebhookURL {
+		notificationsTotal.Inc("discord_webhook", "skipped")
 		err := errors.New("Default webhook value detected. Skipping webhook call")
 		return err
 	}
+	err := postWebhook(ctx, webhookURL, message)
+	notificationDelivered("discord_webhook", err)
+	if err != nil {
+		return err
+	}
+
+	log.Info("message posted to webhook: ", message)
+
+	return nil
+}
+
+// postWebhook posts a message to the discord webhook
+func postWebhook(ctx context.Context, webhookURL, message string) error {
 	body := DiscordWebhook{}
 	body.Content = message
 
@@ -31,15 +48,50 @@ func (c *Controller) callWebhook(message string) error {
 		return err
 	}
 
-	contentType := "application/json"
+	r, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewBuffer(b))
+	if err != nil {
+		return errors.New("invalid discord webhook url")
+	}
+	r.Header.Set("Content-Type", "application/json")
 
-	resp, err := http.Post(c.Config.DiscordWebhook, contentType, bytes.NewBuffer(b))
+	resp, err := providerClient.Do(r)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// the webhook url includes its token and must not be logged
+		return fmt.Errorf("error calling discord webhook: %s", urlErr.Err)
+	}
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discord webhook returned %s", resp.Status)
+	}
+	return nil
+}
 
-	log.Info("message posted to webhook: ", message)
+// SendTestNotification posts a test message to the discord webhook
+func (c *Controller) SendTestNotification(ctx context.Context) error {
+	if !c.Config().DiscordEnabled {
+		return invalidf("discord notifications are disabled")
+	}
+	return c.callWebhook(ctx, ":white_check_mark: rtmpauthbot test notification")
+}
 
-	return nil
+// TestNotificationHandler is the http handler for
+// "POST /api/v1/notifications/test". A test message is posted to the discord
+// webhook to verify the notification settings.
+func (c *Controller) TestNotificationHandler(w http.ResponseWriter, r *http.Request) {
+	err := c.SendTestNotification(r.Context())
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		writeJSONError(w, err)
+		return
+	}
+	if err != nil {
+		log.Error("error sending test notification: ", err)
+		writeAPIError(w, http.StatusBadGateway, "notification_failed", "error calling the discord webhook, see the server log for details")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
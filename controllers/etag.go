@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+var (
+	// errPreconditionFailed is returned when If-Match does not match the
+	// current revision of a publisher
+	errPreconditionFailed = errors.New("publisher has been modified, fetch the latest revision and retry")
+	// errPreconditionRequired is returned when If-Match is required but missing
+	errPreconditionRequired = errors.New("If-Match header is required to modify a publisher")
+)
+
+// publisherETag returns the entity tag of a publisher revision
+func publisherETag(p *models.Publisher) string {
+	return fmt.Sprintf("\"%d\"", p.Revision)
+}
+
+// listETag returns the entity tag of a list of publishers which changes when
+// any publisher is added, removed or modified
+func listETag(publishers []models.Publisher) string {
+	h := sha256.New()
+	for i := range publishers {
+		fmt.Fprintf(h, "%s:%d\n", publishers[i].Name, publishers[i].Revision)
+	}
+	return "\"" + hex.EncodeToString(h.Sum(nil))[:16] + "\""
+}
+
+// etagMatches returns true if the If-Match or If-None-Match header value
+// matches the entity tag. Weak comparison is used so W/ prefixes are ignored.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header and returns true after writing a 304 Not
+// Modified response if the If-None-Match header matches
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ifMatch returns the precondition of a modifying request which is checked
+// against the stored publisher within the update transaction. New publishers
+// may be created without If-Match even when it is required.
+func (c *Controller) ifMatch(r *http.Request) func(p *models.Publisher, exists bool) error {
+	header := r.Header.Get("If-Match")
+	return func(p *models.Publisher, exists bool) error {
+		if header == "" {
+			if exists && c.Config().APIRequireIfMatch {
+				return errPreconditionRequired
+			}
+			return nil
+		}
+		if !exists || !etagMatches(header, publisherETag(p)) {
+			return errPreconditionFailed
+		}
+		return nil
+	}
+}
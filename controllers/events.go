@@ -0,0 +1,376 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/websocket"
+)
+
+// Event types pushed to event stream subscribers
+const (
+	EventPublishStart = "publish_start"
+	EventPublishStop  = "publish_stop"
+	EventViewerCount  = "viewer_count"
+	EventLiveStart    = "live_start"
+	EventLiveStop     = "live_stop"
+)
+
+// eventKeepAlive is the interval of comments sent to idle event streams so
+// proxies do not close the connection
+const eventKeepAlive = 25 * time.Second
+
+// Event is a live state change of a publisher. Provider & Account are empty
+// for events of the local rtmp server.
+type Event struct {
+	ID         uint64             `json:"id"`
+	Type       string             `json:"type"`
+	Time       time.Time          `json:"time"`
+	Publisher  string             `json:"publisher"`
+	Provider   string             `json:"provider,omitempty"`
+	Account    string             `json:"account,omitempty"`
+	Viewers    *int               `json:"viewers,omitempty"`
+	StreamInfo *models.StreamInfo `json:"stream_info,omitempty"`
+}
+
+// EventHub fans out events to subscribers and keeps the most recent events
+// in a ring buffer so reconnecting subscribers can resume where they left off
+type EventHub struct {
+	mu          sync.Mutex
+	seq         uint64
+	ring        []Event
+	next        int
+	subscribers map[chan Event]struct{}
+	viewers     map[streamKey]int
+	closed      bool
+}
+
+// NewEventHub returns an event hub buffering up to size events
+func NewEventHub(size int) *EventHub {
+	return &EventHub{
+		ring:        make([]Event, 0, size),
+		subscribers: make(map[chan Event]struct{}),
+		viewers:     make(map[streamKey]int),
+	}
+}
+
+// streamKey identifies a publisher's stream on a provider, the provider &
+// account are empty for the local rtmp server
+type streamKey struct {
+	publisher string
+	provider  string
+	account   string
+}
+
+// viewerKey identifies the viewer count of a publisher's stream on a provider
+func viewerKey(publisher, provider, account string) streamKey {
+	return streamKey{publisher: publisher, provider: provider, account: strings.ToLower(account)}
+}
+
+// addViewers adjusts the tracked viewer count of a stream and returns the new
+// count, which never drops below zero
+func (h *EventHub) addViewers(key streamKey, delta int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.viewers[key] + delta
+	if n < 0 {
+		n = 0
+	}
+	h.viewers[key] = n
+	return n
+}
+
+// setViewers sets the tracked viewer count of a stream and returns true if the
+// count changed
+func (h *EventHub) setViewers(key streamKey, n int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	previous, ok := h.viewers[key]
+	h.viewers[key] = n
+	return !ok || previous != n
+}
+
+// viewerCount returns the tracked viewer count of a stream
+func (h *EventHub) viewerCount(key streamKey) (int, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, ok := h.viewers[key]
+	return n, ok
+}
+
+// viewerCounts returns the tracked viewer counts of all streams by viewer key
+func (h *EventHub) viewerCounts() map[streamKey]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := make(map[streamKey]int, len(h.viewers))
+	for key, n := range h.viewers {
+		counts[key] = n
+	}
+	return counts
+}
+
+// resetViewers stops tracking the viewer count of a stream
+func (h *EventHub) resetViewers(key streamKey) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.viewers, key)
+}
+
+// Publish assigns the next event id and sends the event to all subscribers.
+// Subscribers which are not keeping up are disconnected.
+func (h *EventHub) Publish(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	e.ID = h.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, e)
+	} else if cap(h.ring) > 0 {
+		h.ring[h.next] = e
+		h.next = (h.next + 1) % cap(h.ring)
+	}
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events after lastID and a channel of new
+// events. The channel is closed by unsubscribe or when the subscriber falls
+// behind.
+func (h *EventHub) Subscribe(lastID uint64) ([]Event, chan Event, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var backlog []Event
+	for i := range h.ring {
+		e := h.ring[(h.next+i)%len(h.ring)]
+		if e.ID > lastID {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, 64)
+	if h.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	h.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subscribers[ch]; ok {
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+	return backlog, ch, unsubscribe
+}
+
+// Close disconnects all subscribers so long-lived event streams end when the
+// server shuts down. Later subscribers receive a closed channel.
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subscribers {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// emit publishes an event if the event hub is enabled
+func (c *Controller) emit(e Event) {
+	if c.Events != nil {
+		c.Events.Publish(e)
+	}
+}
+
+// emitViewers publishes a viewer count event for the rtmp stream of a
+// publisher after adjusting the tracked count by delta
+func (c *Controller) emitViewers(publisher string, delta int) {
+	if c.Events == nil {
+		return
+	}
+	n := c.Events.addViewers(viewerKey(publisher, "", ""), delta)
+	c.emit(Event{Type: EventViewerCount, Publisher: publisher, Viewers: &n})
+}
+
+// emitLiveStatus publishes the live transitions & viewer count changes of a
+// publisher's links on a provider
+func (c *Controller) emitLiveStatus(sp StreamProvider, p models.Publisher, streams []LiveStream, transitions []liveTransition) {
+	if c.Events == nil {
+		return
+	}
+	for _, t := range transitions {
+		e := Event{Publisher: p.Name, Provider: sp.Name(), Account: t.Account}
+		if t.Live {
+			info := t.Info
+			e.Type, e.StreamInfo = EventLiveStart, &info
+		} else {
+			e.Type = EventLiveStop
+			c.Events.resetViewers(viewerKey(p.Name, sp.Name(), t.Account))
+		}
+		c.emit(e)
+	}
+	for _, l := range p.Links {
+		if l.Provider != sp.Name() {
+			continue
+		}
+		for s := range streams {
+			if !strings.EqualFold(streams[s].Account, l.Account) {
+				continue
+			}
+			n := streams[s].ViewerCount
+			if c.Events.setViewers(viewerKey(p.Name, sp.Name(), l.Account), n) {
+				c.emit(Event{Type: EventViewerCount, Publisher: p.Name, Provider: sp.Name(), Account: l.Account, Viewers: &n})
+			}
+			break
+		}
+	}
+}
+
+// lastEventID returns the id of the last event received by a reconnecting
+// client from the Last-Event-ID header or last_event_id query parameter
+func lastEventID(r *http.Request) uint64 {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	id, _ := strconv.ParseUint(value, 10, 64)
+	return id
+}
+
+// EventsHandler is the http handler for "/api/events". Events are streamed as
+// Server-Sent Events and buffered events after Last-Event-ID are replayed.
+func (c *Controller) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	c.streamEvents(w, r, nil)
+}
+
+// streamEvents streams the events matching visible as Server-Sent Events, all
+// events are streamed if visible is nil
+func (c *Controller) streamEvents(w http.ResponseWriter, r *http.Request, visible func(e Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok || c.Events == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "event streaming is not supported")
+		return
+	}
+	backlog, events, unsubscribe := c.Events.Subscribe(lastEventID(r))
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e Event) error {
+		if visible != nil && !visible(e) {
+			return nil
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		return err
+	}
+	for i := range backlog {
+		if send(backlog[i]) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if send(e) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// EventsWebSocketHandler is the http handler for "/api/events/ws". Events are
+// sent as json text messages, buffered events after the last_event_id query
+// parameter are replayed.
+func (c *Controller) EventsWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	c.streamEventsWebSocket(w, r, nil)
+}
+
+// streamEventsWebSocket sends the events matching visible over a WebSocket,
+// all events are sent if visible is nil
+func (c *Controller) streamEventsWebSocket(w http.ResponseWriter, r *http.Request, visible func(e Event) bool) {
+	if c.Events == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "event streaming is not supported")
+		return
+	}
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+		backlog, events, unsubscribe := c.Events.Subscribe(lastEventID(r))
+		defer unsubscribe()
+
+		// the client does not send messages, a failed read means it is gone
+		closed := make(chan struct{})
+		go func() {
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		send := func(e Event) error {
+			if visible != nil && !visible(e) {
+				return nil
+			}
+			return websocket.JSON.Send(ws, e)
+		}
+		for i := range backlog {
+			if send(backlog[i]) != nil {
+				return
+			}
+		}
+		for {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				err := send(e)
+				if err != nil {
+					log.Debug("websocket event client disconnected: ", err)
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}).ServeHTTP(w, r)
+}
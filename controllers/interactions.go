@@ -0,0 +1,564 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// discord interaction & response types
+const (
+	interactionPing               = 1
+	interactionApplicationCommand = 2
+	responsePong                  = 1
+	responseChannelMessage        = 4
+	// responseDeferredChannelMessage acknowledges a command which is answered
+	// later by editing the original response
+	responseDeferredChannelMessage = 5
+	// messageEphemeral only shows a response to the user of the command
+	messageEphemeral = 1 << 6
+)
+
+// discord application command option types
+const (
+	optionSubCommand = 1
+	optionString     = 3
+	optionUser       = 6
+)
+
+// interactionOption is an option of an application command interaction.
+// Sub commands contain their own options.
+type interactionOption struct {
+	Name    string              `json:"name"`
+	Type    int                 `json:"type"`
+	Value   json.RawMessage     `json:"value,omitempty"`
+	Options []interactionOption `json:"options,omitempty"`
+}
+
+// interactionMaxAge is the maximum difference between the signed timestamp of
+// an interaction and the server time, older interactions may be replayed
+const interactionMaxAge = 5 * time.Minute
+
+// interaction is a slash command or ping received from discord
+type interaction struct {
+	Type int `json:"type"`
+	Data struct {
+		Name     string              `json:"name"`
+		Options  []interactionOption `json:"options"`
+		Resolved struct {
+			Users map[string]DiscordUser `json:"users"`
+		} `json:"resolved"`
+	} `json:"data"`
+	// Member is set for commands used in a guild & User in direct messages
+	Member *struct {
+		User DiscordUser `json:"user"`
+	} `json:"member"`
+	User *DiscordUser `json:"user"`
+	// ApplicationID & Token identify the webhook answering the interaction,
+	// the token is valid for 15 minutes
+	ApplicationID string `json:"application_id"`
+	Token         string `json:"token"`
+}
+
+// caller returns the discord user who used the command
+func (in *interaction) caller() DiscordUser {
+	if in.Member != nil {
+		return in.Member.User
+	}
+	if in.User != nil {
+		return *in.User
+	}
+	return DiscordUser{}
+}
+
+// option returns the string value of a named option or an empty string
+func option(options []interactionOption, name string) string {
+	for _, o := range options {
+		if o.Name == name {
+			var value string
+			json.Unmarshal(o.Value, &value)
+			return value
+		}
+	}
+	return ""
+}
+
+// interactionMessage is the message of an interaction response
+type interactionMessage struct {
+	Content         string          `json:"content,omitempty"`
+	Flags           int             `json:"flags,omitempty"`
+	AllowedMentions allowedMentions `json:"allowed_mentions"`
+}
+
+// allowedMentions restricts the users & roles notified by a message
+type allowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// interactionResponse is the response to an interaction
+type interactionResponse struct {
+	Type int                 `json:"type"`
+	Data *interactionMessage `json:"data,omitempty"`
+}
+
+// reply returns a message response which never mentions anyone
+func reply(content string, flags int) interactionResponse {
+	return interactionResponse{
+		Type: responseChannelMessage,
+		Data: &interactionMessage{
+			Content:         content,
+			Flags:           flags,
+			AllowedMentions: allowedMentions{Parse: []string{}},
+		},
+	}
+}
+
+// deferred returns the response acknowledging a command, the flags of the
+// message answering the command can not be changed later
+func deferred(flags int) interactionResponse {
+	return interactionResponse{
+		Type: responseDeferredChannelMessage,
+		Data: &interactionMessage{Flags: flags, AllowedMentions: allowedMentions{Parse: []string{}}},
+	}
+}
+
+// errorReply returns an ephemeral response describing the error. The
+// details of internal errors are only logged.
+func errorReply(err error) interactionResponse {
+	status, _ := errorStatus(err)
+	message := errorMessage(err, status)
+	if status == http.StatusInternalServerError {
+		message = "something went wrong, see the server log for details"
+	}
+	return reply(":x: "+message, messageEphemeral)
+}
+
+// commandOption describes an option of a registered application command
+type commandOption struct {
+	Type        int             `json:"type"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Required    bool            `json:"required,omitempty"`
+	Options     []commandOption `json:"options,omitempty"`
+}
+
+// applicationCommand describes a slash command registered with discord
+type applicationCommand struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Options     []commandOption `json:"options,omitempty"`
+	// DefaultMemberPermissions "0" hides a command from non-administrators
+	DefaultMemberPermissions *string `json:"default_member_permissions,omitempty"`
+}
+
+// slashCommands returns the slash commands handled by the interactions
+// endpoint
+func slashCommands() []applicationCommand {
+	adminOnly := "0"
+	return []applicationCommand{
+		{
+			Name:        "live",
+			Description: "Show who is streaming right now",
+		},
+		{
+			Name:        "stream",
+			Description: "Manage your stream",
+			Options: []commandOption{
+				{Type: optionSubCommand, Name: "key", Description: "Send your stream key by direct message"},
+				{Type: optionSubCommand, Name: "rotate", Description: "Replace your stream key with a new key"},
+				{Type: optionSubCommand, Name: "twitch", Description: "Set or remove your twitch channel", Options: []commandOption{
+					{Type: optionString, Name: "login", Description: "Twitch login, omit to remove the channel"},
+				}},
+			},
+		},
+		{
+			Name:        "publisher",
+			Description: "Manage publishers",
+			Options: []commandOption{
+				{Type: optionSubCommand, Name: "add", Description: "Add a publisher for a discord user", Options: []commandOption{
+					{Type: optionUser, Name: "user", Description: "Discord user of the publisher", Required: true},
+					{Type: optionString, Name: "name", Description: "Publisher name, defaults to the username"},
+				}},
+				{Type: optionSubCommand, Name: "remove", Description: "Remove a publisher", Options: []commandOption{
+					{Type: optionString, Name: "name", Description: "Publisher name", Required: true},
+				}},
+			},
+			DefaultMemberPermissions: &adminOnly,
+		},
+	}
+}
+
+// discordAPI sends an authenticated request to the discord api with the bot
+// token and decodes the json response into out if it is not nil
+func (c *Controller) discordAPI(method, path string, body, out interface{}) error {
+	if c.Config().DiscordBotToken == "" {
+		return errors.New("DISCORD_BOT_TOKEN is not set")
+	}
+	return c.discordRequest(method, path, "Bot "+c.Config().DiscordBotToken, body, out)
+}
+
+// redactPath removes the interaction token from a webhook path of the discord
+// api so it can be logged
+func redactPath(path string) string {
+	parts := strings.SplitN(path, "/", 5)
+	if len(parts) >= 4 && parts[1] == "webhooks" {
+		parts[3] = "{token}"
+	}
+	return strings.Join(parts, "/")
+}
+
+// discordRequest sends a json request to the discord api, authorized with the
+// authorization header if it is not empty, and decodes the json response into
+// out if it is not nil
+func (c *Controller) discordRequest(method, path, authorization string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, c.Config().DiscordAPIURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := providerClient.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// the url may include an interaction token and must not be logged
+		return fmt.Errorf("discord api %s %s: %s", method, redactPath(path), urlErr.Err)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("discord api %s %s returned %s", method, redactPath(path), resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// RegisterCommands registers the slash commands with the discord application,
+// replacing any previously registered commands
+func (c *Controller) RegisterCommands() error {
+	if c.Config().DiscordClientID == "" {
+		return errors.New("DISCORD_CLIENT_ID is not set")
+	}
+	path := fmt.Sprintf("/applications/%s/commands", c.Config().DiscordClientID)
+	return c.discordAPI("PUT", path, slashCommands(), nil)
+}
+
+// sendDirectMessage sends a direct message to a discord user
+func (c *Controller) sendDirectMessage(userID, content string) error {
+	var channel struct {
+		ID string `json:"id"`
+	}
+	err := c.discordAPI("POST", "/users/@me/channels", map[string]string{"recipient_id": userID}, &channel)
+	if err == nil {
+		message := interactionMessage{Content: content, AllowedMentions: allowedMentions{Parse: []string{}}}
+		err = c.discordAPI("POST", "/channels/"+channel.ID+"/messages", message, nil)
+	}
+	notificationDelivered("discord_dm", err)
+	return err
+}
+
+// sendKey delivers the stream key of a publisher to a discord user by direct
+// message and returns the reply to the command. The key is included in the
+// ephemeral reply when the direct message cannot be sent.
+func (c *Controller) sendKey(userID string, p *models.Publisher) string {
+	message := fmt.Sprintf("Stream key of **%s**: `%s`", p.Name, p.Key)
+	err := c.sendDirectMessage(userID, message)
+	if err == nil {
+		return fmt.Sprintf("The stream key of **%s** was sent by direct message.", p.Name)
+	}
+	log.Warnf("discord: error sending direct message to %s: %s", userID, err)
+	return message
+}
+
+// isDiscordAdmin returns true if the discord user may manage publishers
+func (c *Controller) isDiscordAdmin(userID string) bool {
+	for _, id := range c.Config().DiscordAdminIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyInteraction checks the ed25519 signature discord sends with every
+// interaction over the timestamp & body. Interactions signed more than
+// interactionMaxAge before or after now are rejected to prevent replays.
+func verifyInteraction(key ed25519.PublicKey, signature, timestamp string, body []byte, now time.Time) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(signed, 0))
+	if age > interactionMaxAge || age < -interactionMaxAge {
+		return false
+	}
+	message := append([]byte(timestamp), body...)
+	return ed25519.Verify(key, message, sig)
+}
+
+// DiscordInteractionsHandler is the http handler for "/discord/interactions".
+// Slash commands are received from discord after verifying the request
+// signature with the public key of the application. Commands are acknowledged
+// with a deferred response and answered in the background, as discord only
+// waits 3 seconds for the response.
+func (c *Controller) DiscordInteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.Config().InteractionsEnabled() {
+		NotFoundHandler(w, r)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	signature := r.Header.Get("X-Signature-Ed25519")
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	if !verifyInteraction(c.Config().DiscordPublicKey, signature, timestamp, body, time.Now()) {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "invalid request signature")
+		return
+	}
+	var in interaction
+	err = json.Unmarshal(body, &in)
+	if err != nil {
+		writeJSONError(w, invalidf("invalid interaction: %s", err))
+		return
+	}
+	switch in.Type {
+	case interactionPing:
+		writeJSON(w, http.StatusOK, interactionResponse{Type: responsePong})
+	case interactionApplicationCommand:
+		flags := commandFlags(&in)
+		writeJSON(w, http.StatusOK, deferred(flags))
+		// the original response must exist before it is edited
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		c.commands.Add(1)
+		go func() {
+			defer c.commands.Done()
+			c.answerCommand(&in)
+		}()
+	default:
+		writeJSONError(w, invalidf("unsupported interaction type: %d", in.Type))
+	}
+}
+
+// commandFlags returns the flags of the message answering a command, only
+// /live is answered publicly
+func commandFlags(in *interaction) int {
+	if in.Data.Name == "live" {
+		return 0
+	}
+	return messageEphemeral
+}
+
+// answerCommand runs a deferred slash command and edits the original
+// response with the result through the interaction webhook
+func (c *Controller) answerCommand(in *interaction) {
+	resp := c.handleCommand(in)
+	path := fmt.Sprintf("/webhooks/%s/%s/messages/@original", in.ApplicationID, in.Token)
+	err := c.discordRequest("PATCH", path, "", resp.Data, nil)
+	if err != nil {
+		log.Errorf("discord: error answering /%s: %s", in.Data.Name, err)
+	}
+}
+
+// Wait waits for the slash commands which are still being answered until
+// the context is done
+func (c *Controller) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.commands.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleCommand runs a slash command & returns the response
+func (c *Controller) handleCommand(in *interaction) interactionResponse {
+	user := in.caller()
+	log.Debugf("discord: /%s used by %s (%s)", in.Data.Name, user.Username, user.ID)
+	var sub interactionOption
+	if len(in.Data.Options) > 0 && in.Data.Options[0].Type == optionSubCommand {
+		sub = in.Data.Options[0]
+	}
+	switch in.Data.Name {
+	case "live":
+		return c.liveCommand()
+	case "stream":
+		return c.streamCommand(user, sub)
+	case "publisher":
+		if !c.isDiscordAdmin(user.ID) {
+			log.Warnf("discord: %s (%s) is not allowed to use /publisher", user.Username, user.ID)
+			return reply(":no_entry: only admins may manage publishers", messageEphemeral)
+		}
+		return c.publisherCommand(in, sub)
+	}
+	return reply(":x: unknown command: "+in.Data.Name, messageEphemeral)
+}
+
+// liveCommand lists the listed publishers which are live with watch links
+func (c *Controller) liveCommand() interactionResponse {
+	live := true
+	publishers, _, err := c.Store.QueryPublishers(store.PublisherQuery{Live: &live})
+	if err != nil {
+		return errorReply(err)
+	}
+	var lines []string
+	for i := range publishers {
+		if publishers[i].Unlisted {
+			continue
+		}
+		pub := c.publicPublisher(&publishers[i])
+		lines = append(lines, fmt.Sprintf(":red_circle: **%s**", pub.Name))
+		if pub.RTMP != nil {
+			watch := pub.RTMP.HLSURL
+			if watch == "" {
+				watch = pub.RTMP.URL
+			}
+			if watch != "" {
+				lines = append(lines, "    "+watch)
+			}
+		}
+		for _, s := range pub.Streams {
+			line := fmt.Sprintf("    %s: <%s>", s.Provider, s.URL)
+			if s.Title != "" {
+				line += " " + s.Title
+			}
+			if s.Game != "" {
+				line += " (" + s.Game + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		return reply("Nobody is live right now.", 0)
+	}
+	return reply(strings.Join(lines, "\n"), 0)
+}
+
+// streamCommand manages the publisher linked to the discord user
+func (c *Controller) streamCommand(user DiscordUser, sub interactionOption) interactionResponse {
+	p, err := c.Store.GetPublisherByDiscordID(user.ID)
+	if err == store.ErrNotFound {
+		return reply(":x: your discord account is not linked to a publisher", messageEphemeral)
+	}
+	if err != nil {
+		return errorReply(err)
+	}
+	// fail if an admin unlinked the publisher in the meantime
+	check := func(record *models.Publisher, exists bool) error {
+		if record.DiscordID != user.ID {
+			return errPreconditionFailed
+		}
+		return nil
+	}
+	name := p.Name
+	switch sub.Name {
+	case "key":
+		return reply(c.sendKey(user.ID, &p), messageEphemeral)
+	case "rotate":
+		key, err := generateKey()
+		if err != nil {
+			return errorReply(err)
+		}
+		p, _, err = c.applyPublisherPatch(name, publisherPatch{Key: &key}, false, check)
+		if err != nil {
+			return errorReply(publisherError(name, err))
+		}
+		log.Infof("publisher key rotated by discord user %s: %s", user.ID, p.Name)
+		return reply(c.sendKey(user.ID, &p), messageEphemeral)
+	case "twitch":
+		login := option(sub.Options, "login")
+		p, _, err = c.applyPublisherPatch(name, publisherPatch{TwitchStream: &login}, false, check)
+		if err != nil {
+			return errorReply(publisherError(name, err))
+		}
+		log.Infof("publisher twitch stream updated by discord user %s: %s", user.ID, p.Name)
+		if login == "" {
+			return reply(fmt.Sprintf("Removed the twitch channel of **%s**.", p.Name), messageEphemeral)
+		}
+		return reply(fmt.Sprintf("The twitch channel of **%s** is now **%s**.", p.Name, login), messageEphemeral)
+	}
+	return reply(":x: unknown command: /stream "+sub.Name, messageEphemeral)
+}
+
+// publisherCommand adds & removes publishers
+func (c *Controller) publisherCommand(in *interaction, sub interactionOption) interactionResponse {
+	switch sub.Name {
+	case "add":
+		userID := option(sub.Options, "user")
+		member, ok := in.Data.Resolved.Users[userID]
+		if !ok {
+			return reply(":x: unknown discord user", messageEphemeral)
+		}
+		name := option(sub.Options, "name")
+		if name == "" {
+			name = strings.ToLower(member.Username)
+		}
+		if name == "" || strings.Contains(name, "/") {
+			return errorReply(invalidf("name must be a non-empty string without slashes"))
+		}
+		key, err := generateKey()
+		if err != nil {
+			return errorReply(err)
+		}
+		patch := publisherPatch{Key: &key, DiscordID: &userID}
+		p, _, err := c.applyPublisherPatch(name, patch, true, func(p *models.Publisher, exists bool) error {
+			if exists {
+				return errConflict
+			}
+			return nil
+		})
+		if err != nil {
+			return errorReply(err)
+		}
+		log.Infof("publisher created by discord user %s: %s", in.caller().ID, p.Name)
+		err = c.sendDirectMessage(userID, fmt.Sprintf("You were added as publisher **%s**, your stream key is `%s`", p.Name, p.Key))
+		if err != nil {
+			log.Warnf("discord: error sending direct message to %s: %s", userID, err)
+			return reply(fmt.Sprintf("Added publisher **%s** for <@%s>, stream key: `%s`", p.Name, userID, p.Key), messageEphemeral)
+		}
+		return reply(fmt.Sprintf("Added publisher **%s** for <@%s>, the stream key was sent by direct message.", p.Name, userID), messageEphemeral)
+	case "remove":
+		name := option(sub.Options, "name")
+		err := c.deletePublisher(name, anyRevision)
+		if err != nil {
+			return errorReply(publisherError(name, err))
+		}
+		log.Infof("publisher deleted by discord user %s: %s", in.caller().ID, name)
+		return reply(fmt.Sprintf("Removed publisher **%s**.", name), messageEphemeral)
+	}
+	return reply(":x: unknown command: /publisher "+sub.Name, messageEphemeral)
+}
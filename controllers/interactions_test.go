@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// signInteraction returns the signature & timestamp headers of a body
+func signInteraction(key ed25519.PrivateKey, body []byte, signed time.Time) (string, string) {
+	timestamp := strconv.FormatInt(signed.Unix(), 10)
+	return hex.EncodeToString(ed25519.Sign(key, append([]byte(timestamp), body...))), timestamp
+}
+
+func TestVerifyInteraction(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"type":1}`)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		signed time.Time
+		body   []byte
+		valid  bool
+	}{
+		{"current", now, body, true},
+		{"late delivery", now.Add(-time.Minute), body, true},
+		{"replayed", now.Add(-interactionMaxAge - time.Second), body, false},
+		{"future", now.Add(interactionMaxAge + time.Second), body, false},
+		{"modified", now, []byte(`{"type":2}`), false},
+	}
+	for _, tc := range tests {
+		signature, timestamp := signInteraction(private, body, tc.signed)
+		if verifyInteraction(public, signature, timestamp, tc.body, now) != tc.valid {
+			t.Errorf("%s: expected valid=%t", tc.name, tc.valid)
+		}
+	}
+	signature, _ := signInteraction(private, body, now)
+	if verifyInteraction(public, signature, "", body, now) {
+		t.Error("expected an interaction without a timestamp to be invalid")
+	}
+}
+
+// webhookEdit is a request editing the original response of an interaction
+type webhookEdit struct {
+	path    string
+	message interactionMessage
+}
+
+func TestDiscordInteractionsHandler(t *testing.T) {
+	var mu sync.Mutex
+	var edits []webhookEdit
+	discord := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message interactionMessage
+		json.NewDecoder(r.Body).Decode(&message)
+		if r.Method != "PATCH" || r.Header.Get("Authorization") != "" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		mu.Lock()
+		edits = append(edits, webhookEdit{r.URL.Path, message})
+		mu.Unlock()
+	}))
+	defer discord.Close()
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestController(t, map[string]string{
+		"DISCORD_PUBLIC_KEY": hex.EncodeToString(public),
+		"DISCORD_API_URL":    discord.URL,
+	})
+	send := func(body string, signed time.Time) *httptest.ResponseRecorder {
+		signature, timestamp := signInteraction(private, []byte(body), signed)
+		r := httptest.NewRequest("POST", "/discord/interactions", strings.NewReader(body))
+		r.Header.Set("X-Signature-Ed25519", signature)
+		r.Header.Set("X-Signature-Timestamp", timestamp)
+		w := httptest.NewRecorder()
+		c.DiscordInteractionsHandler(w, r)
+		return w
+	}
+
+	w := send(`{"type":1}`, time.Now())
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"type":1`)) {
+		t.Fatalf("expected a pong, got %d %s", w.Code, w.Body)
+	}
+	w = send(`{"type":1}`, time.Now().Add(-time.Hour))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a replayed interaction to be rejected, got %d", w.Code)
+	}
+
+	tests := []struct {
+		token   string
+		data    string
+		flags   int
+		content string
+	}{
+		{"live-token", `{"name":"live"}`, 0, "Nobody is live"},
+		{"stream-token", `{"name":"stream","options":[{"name":"key","type":1}]}`, messageEphemeral, "not linked"},
+	}
+	for _, tc := range tests {
+		w = send(`{"type":2,"application_id":"app","token":"`+tc.token+`","data":`+tc.data+`,"user":{"id":"1"}}`, time.Now())
+		var resp interactionResponse
+		err = json.Unmarshal(w.Body.Bytes(), &resp)
+		if err != nil || resp.Type != responseDeferredChannelMessage || resp.Data.Flags != tc.flags {
+			t.Fatalf("expected a deferred response with flags %d, got %s (%v)", tc.flags, w.Body, err)
+		}
+	}
+	c.Wait(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	if len(edits) != len(tests) {
+		t.Fatalf("expected %d edited responses, got %+v", len(tests), edits)
+	}
+	for _, tc := range tests {
+		found := false
+		for _, edit := range edits {
+			if edit.path == "/webhooks/app/"+tc.token+"/messages/@original" {
+				found = true
+				if !strings.Contains(edit.message.Content, tc.content) {
+					t.Errorf("%s: expected %q in %q", tc.token, tc.content, edit.message.Content)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("%s: original response was not edited: %+v", tc.token, edits)
+		}
+	}
+}
+
+func TestRedactPath(t *testing.T) {
+	tests := map[string]string{
+		"/webhooks/app/secret/messages/@original": "/webhooks/app/{token}/messages/@original",
+		"/users/@me/channels":                     "/users/@me/channels",
+	}
+	for path, want := range tests {
+		if got := redactPath(path); got != want {
+			t.Errorf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
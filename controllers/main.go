@@ -2,42 +2,73 @@ package controllers
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
 
 	"github.com/bcambl/rtmpauthbot/config"
-	bolt "go.etcd.io/bbolt"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
 )
 
 // Controller struct to provide the database to all handlers
 type Controller struct {
-	Config *config.Config
-	DB     *bolt.DB
+	Store  store.Store
+	Events *EventHub
+	// Reload re-reads the configuration & applies it to the running server,
+	// nil when the configuration can not be reloaded
+	Reload func() error
+	// ConfigChanged is called after the runtime settings were changed
+	ConfigChanged func()
+
+	// config is the configuration with the runtime settings applied
+	config atomic.Pointer[config.Config]
+	// base is the configuration without runtime settings
+	settingsMu sync.Mutex
+	base       *config.Config
+
+	mu        sync.RWMutex
+	providers map[string]StreamProvider
+	// logged in admin dashboard & member portal sessions
+	adminSessions  sessionStore
+	portalSessions sessionStore
+	// slash commands answered in the background
+	commands sync.WaitGroup
 }
 
-// IndexHandler is the http handler for "/".
-func (c *Controller) IndexHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "application/json")
-	w.Write([]byte(`{"handler": "index"}`))
+// NewController returns a controller using the configuration & database
+func NewController(conf *config.Config, st store.Store) *Controller {
+	c := &Controller{Store: st}
+	c.SetConfig(conf)
+	return c
+}
 
+// Config returns the current configuration, which may be replaced while the
+// server is running
+func (c *Controller) Config() *config.Config {
+	return c.config.Load()
 }
 
-func (c *Controller) setBucketValue(bucket, key, value string) error {
-	err := c.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		err := b.Put([]byte(key), []byte(value))
-		return err
-	})
+// SetConfig atomically replaces the configuration, the runtime settings
+// stored in the database are applied to it unless they are invalid
+func (c *Controller) SetConfig(conf *config.Config) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	effective, err := c.withSettings(conf)
+	if err == nil && conf.Validate() == nil {
+		// settings making a valid configuration invalid are ignored
+		err = effective.Validate()
+	}
 	if err != nil {
-		return err
+		log.Error("runtime settings ignored: ", err)
+		effective = conf
 	}
-	return nil
+	c.base = conf
+	c.config.Store(effective)
 }
 
-func (c *Controller) getBucketValue(bucket, key string) ([]byte, error) {
-	var result []byte
-	err := c.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		result = b.Get([]byte(key))
-		return nil
-	})
-	return result, err
+// IndexHandler is the http handler for "/".
+func (c *Controller) IndexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	w.Write([]byte(`{"handler": "index"}`))
+
 }
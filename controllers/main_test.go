@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.PanicLevel)
+}
+
+// newTestController returns a controller using a temporary bbolt database and
+// the default configuration with the overrides applied
+func newTestController(t *testing.T, overrides map[string]string) *Controller {
+	t.Helper()
+	conf, err := config.Load("", overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.OpenBolt(filepath.Join(t.TempDir(), "rtmpauthbot.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	c := NewController(conf, st)
+	c.Events = NewEventHub(16)
+	return c
+}
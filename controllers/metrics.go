@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/metrics"
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	callbacksTotal = metrics.NewCounter("rtmpauthbot_callbacks_total",
+		"nginx-rtmp callbacks by handler & outcome.", "handler", "outcome")
+	twitchRequestsTotal = metrics.NewCounter("rtmpauthbot_twitch_requests_total",
+		"Twitch api requests by endpoint & response status code, 'error' if no response was received.", "endpoint", "code")
+	twitchRequestDuration = metrics.NewHistogram("rtmpauthbot_twitch_request_duration_seconds",
+		"Latency of twitch api requests.", metrics.DefaultBuckets, "endpoint")
+	twitchErrorsTotal = metrics.NewCounter("rtmpauthbot_twitch_errors_total",
+		"Twitch api requests which failed or were not successful.", "endpoint")
+	twitchRateLimitRemaining = metrics.NewGauge("rtmpauthbot_twitch_ratelimit_remaining",
+		"Remaining twitch api requests of the rate limit bucket reported by the last response.")
+	notificationsTotal = metrics.NewCounter("rtmpauthbot_notifications_total",
+		"Notification deliveries by notifier & status.", "notifier", "status")
+)
+
+// callbackOutcome records the outcome of an nginx-rtmp callback
+func callbackOutcome(handler string, authorized bool) {
+	outcome := "authorized"
+	if !authorized {
+		outcome = "unauthorized"
+	}
+	callbacksTotal.Inc(handler, outcome)
+}
+
+// notificationDelivered records the delivery of a notification
+func notificationDelivered(notifier string, err error) {
+	status := "sent"
+	if err != nil {
+		status = "failed"
+	}
+	notificationsTotal.Inc(notifier, status)
+}
+
+// observeTwitchRequest records a twitch api request, resp is nil if the
+// request failed
+func observeTwitchRequest(endpoint string, started time.Time, resp *http.Response) {
+	twitchRequestDuration.Observe(time.Since(started).Seconds(), endpoint)
+	if resp == nil {
+		twitchRequestsTotal.Inc(endpoint, "error")
+		twitchErrorsTotal.Inc(endpoint)
+		return
+	}
+	twitchRequestsTotal.Inc(endpoint, strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		twitchErrorsTotal.Inc(endpoint)
+	}
+	remaining, err := strconv.Atoi(resp.Header.Get("Ratelimit-Remaining"))
+	if err == nil {
+		twitchRateLimitRemaining.Set(float64(remaining))
+	}
+}
+
+// liveMetrics returns the live publishers by provider & the tracked viewers of
+// their streams
+func (c *Controller) liveMetrics() ([]metrics.Metric, error) {
+	live := metrics.NewGauge("rtmpauthbot_live_publishers",
+		"Publishers which are live by provider, 'rtmp' for the local server.", "provider")
+	viewers := metrics.NewGauge("rtmpauthbot_stream_viewers",
+		"Viewers of live streams by publisher, provider & account.", "publisher", "provider", "account")
+
+	publishers, err := c.Store.ListPublishers()
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{models.SessionProviderRTMP: 0}
+	for _, name := range c.providerNames() {
+		counts[name] = 0
+	}
+	for i := range publishers {
+		if publishers[i].RTMPLive != "" {
+			counts[models.SessionProviderRTMP]++
+		}
+		// publishers with several live accounts on a provider count once
+		seen := make(map[string]bool)
+		for _, l := range publishers[i].Links {
+			if l.Live != "" && !seen[l.Provider] {
+				seen[l.Provider] = true
+				counts[l.Provider]++
+			}
+		}
+	}
+	for provider, n := range counts {
+		live.Set(float64(n), provider)
+	}
+
+	if c.Events != nil {
+		for key, n := range c.Events.viewerCounts() {
+			provider := key.provider
+			if provider == "" {
+				provider = models.SessionProviderRTMP
+			}
+			viewers.Set(float64(n), key.publisher, provider, key.account)
+		}
+	}
+	return []metrics.Metric{live, viewers}, nil
+}
+
+// boltMetrics returns the transaction statistics of the bbolt database, none
+// are returned for other databases
+func (c *Controller) boltMetrics() []metrics.Metric {
+	bs, ok := c.Store.(*store.BoltStore)
+	if !ok {
+		return nil
+	}
+	stats := bs.DB().Stats()
+
+	readTx := metrics.NewCounter("rtmpauthbot_bolt_read_tx_total", "Read transactions started.")
+	readTx.Set(float64(stats.TxN))
+	openReadTx := metrics.NewGauge("rtmpauthbot_bolt_open_read_tx", "Currently open read transactions.")
+	openReadTx.Set(float64(stats.OpenTxN))
+	freePages := metrics.NewGauge("rtmpauthbot_bolt_freelist_pages", "Pages on the freelist by state.", "state")
+	freePages.Set(float64(stats.FreePageN), "free")
+	freePages.Set(float64(stats.PendingPageN), "pending")
+
+	tx := stats.TxStats
+	txOps := metrics.NewCounter("rtmpauthbot_bolt_tx_operations_total",
+		"Operations performed by write transactions.", "operation")
+	for operation, n := range map[string]int{
+		"page_alloc": tx.PageCount,
+		"cursor":     tx.CursorCount,
+		"node_alloc": tx.NodeCount,
+		"node_deref": tx.NodeDeref,
+		"rebalance":  tx.Rebalance,
+		"split":      tx.Split,
+		"spill":      tx.Spill,
+		"write":      tx.Write,
+	} {
+		txOps.Set(float64(n), operation)
+	}
+	txAllocated := metrics.NewCounter("rtmpauthbot_bolt_tx_page_alloc_bytes_total", "Bytes allocated for pages by write transactions.")
+	txAllocated.Set(float64(tx.PageAlloc))
+	txTime := metrics.NewCounter("rtmpauthbot_bolt_tx_seconds_total",
+		"Time spent by write transactions by phase.", "phase")
+	txTime.Set(tx.RebalanceTime.Seconds(), "rebalance")
+	txTime.Set(tx.SpillTime.Seconds(), "spill")
+	txTime.Set(tx.WriteTime.Seconds(), "write")
+
+	return []metrics.Metric{readTx, openReadTx, freePages, txOps, txAllocated, txTime}
+}
+
+// metricsAuthorized returns true if the request may scrape the metrics, which
+// requires the bearer token if METRICS_TOKEN is set
+func (c *Controller) metricsAuthorized(r *http.Request) bool {
+	token := c.Config().MetricsToken
+	if token == "" {
+		return true
+	}
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && secureEqual(bearer, token)
+}
+
+// MetricsHandler is the http handler for "/metrics" which exposes the metrics
+// in the prometheus text format
+func (c *Controller) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.metricsAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rtmpauthbot"`)
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "metrics token required")
+		return
+	}
+	live, err := c.liveMetrics()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	collected := []metrics.Metric{
+		callbacksTotal,
+		twitchRequestsTotal,
+		twitchRequestDuration,
+		twitchErrorsTotal,
+		twitchRateLimitRemaining,
+		notificationsTotal,
+	}
+	collected = append(collected, live...)
+	collected = append(collected, c.boltMetrics()...)
+
+	w.Header().Set("Content-Type", metrics.ContentType)
+	err = metrics.Write(w, collected...)
+	if err != nil {
+		log.Debug("error writing metrics: ", err)
+	}
+}
@@ -0,0 +1,51 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	tests := []struct {
+		token         string
+		authorization string
+		status        int
+	}{
+		{"", "", http.StatusOK},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Basic c2VjcmV0", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+	for _, tc := range tests {
+		c := newTestController(t, map[string]string{"METRICS_TOKEN": tc.token})
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.authorization != "" {
+			r.Header.Set("Authorization", tc.authorization)
+		}
+		w := httptest.NewRecorder()
+		c.MetricsHandler(w, r)
+		if w.Code != tc.status {
+			t.Errorf("token %q with %q: expected %d, got %d", tc.token, tc.authorization, tc.status, w.Code)
+		}
+	}
+}
+
+func TestViewerMetrics(t *testing.T) {
+	c := newTestController(t, nil)
+	c.Events.addViewers(viewerKey("alice/bob", "", ""), 2)
+	c.Events.setViewers(viewerKey("carol", "owncast", "https://Owncast.example.com/live"), 5)
+
+	w := httptest.NewRecorder()
+	c.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`rtmpauthbot_stream_viewers{publisher="alice/bob",provider="rtmp",account=""} 2`,
+		`rtmpauthbot_stream_viewers{publisher="carol",provider="owncast",account="https://owncast.example.com/live"} 5`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("expected %s in:\n%s", want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package controllers
+
+import (
+	_ "embed" // embeds the openapi document
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI 3 document describing the http api
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// OpenAPIHandler is the http handler for "/api/openapi.json"
+func (c *Controller) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
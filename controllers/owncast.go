@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// OwncastStatusResponse to marshal the json response from /api/status
+type OwncastStatusResponse struct {
+	Online          bool   `json:"online"`
+	ViewerCount     int    `json:"viewerCount"`
+	StreamTitle     string `json:"streamTitle"`
+	LastConnectTime string `json:"lastConnectTime"`
+}
+
+// OwncastProvider implements the StreamProvider interface for self-hosted
+// owncast instances. Linked accounts are the base urls of the instances.
+type OwncastProvider struct{}
+
+// NewOwncastProvider returns an owncast stream provider
+func NewOwncastProvider() *OwncastProvider {
+	return &OwncastProvider{}
+}
+
+// Name returns the provider identifier
+func (o *OwncastProvider) Name() string {
+	return "owncast"
+}
+
+// StreamURL returns the public link to an owncast instance
+func (o *OwncastProvider) StreamURL(account string) string {
+	return account
+}
+
+func (o *OwncastProvider) getStatus(ctx context.Context, account string) (OwncastStatusResponse, error) {
+	var status OwncastStatusResponse
+	u, err := instanceURL(account)
+	if err != nil {
+		return status, err
+	}
+	err = getJSON(ctx, u.String()+"/api/status", &status)
+	return status, err
+}
+
+// ResolveAccount normalizes the instance url & verifies it is an owncast server
+func (o *OwncastProvider) ResolveAccount(ctx context.Context, account string) (string, error) {
+	u, err := instanceURL(account)
+	if err != nil {
+		return "", err
+	}
+	_, err = o.getStatus(ctx, u.String())
+	return u.String(), err
+}
+
+// LiveStreams returns the owncast instances which are currently online.
+// Unreachable instances are considered offline.
+func (o *OwncastProvider) LiveStreams(ctx context.Context, accounts []string) ([]LiveStream, error) {
+	streams := []LiveStream{}
+	for i := range accounts {
+		status, err := o.getStatus(ctx, accounts[i])
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Warnf("owncast: unable to query %s: %s", accounts[i], err)
+			continue
+		}
+		if !status.Online {
+			continue
+		}
+		log.Debug("Live Now:", accounts[i])
+		streams = append(streams, LiveStream{
+			Account:     accounts[i],
+			Type:        "live",
+			Title:       status.StreamTitle,
+			ViewerCount: status.ViewerCount,
+			StartedAt:   status.LastConnectTime,
+		})
+	}
+	return streams, nil
+}
+
+// StreamInfo returns the metadata of a live owncast stream
+func (o *OwncastProvider) StreamInfo(ctx context.Context, s LiveStream) (models.StreamInfo, error) {
+	return models.StreamInfo{Title: s.Title}, nil
+}
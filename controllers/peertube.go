@@ -0,0 +1,151 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// peertubeStatePublished is the video state of a live video that is streaming
+const peertubeStatePublished = 1
+
+// PeerTubeVideosResponse to marshal the json response from
+// /api/v1/video-channels/{channel}/videos
+type PeerTubeVideosResponse struct {
+	Total int             `json:"total"`
+	Data  []PeerTubeVideo `json:"data"`
+}
+
+// PeerTubeVideo to marshal the inner data of the PeerTubeVideosResponse
+type PeerTubeVideo struct {
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`
+	IsLive      bool   `json:"isLive"`
+	Nsfw        bool   `json:"nsfw"`
+	Viewers     int    `json:"viewers"`
+	PublishedAt string `json:"publishedAt"`
+	Language    struct {
+		ID    string `json:"id"`
+		Label string `json:"label"`
+	} `json:"language"`
+	State struct {
+		ID    int    `json:"id"`
+		Label string `json:"label"`
+	} `json:"state"`
+	Category struct {
+		ID    int    `json:"id"`
+		Label string `json:"label"`
+	} `json:"category"`
+}
+
+// PeerTubeProvider implements the StreamProvider interface for self-hosted
+// peertube instances. Linked accounts are video channel urls on an instance
+// (ie: https://peertube.example.com/c/channel_name).
+type PeerTubeProvider struct{}
+
+// NewPeerTubeProvider returns a peertube stream provider
+func NewPeerTubeProvider() *PeerTubeProvider {
+	return &PeerTubeProvider{}
+}
+
+// Name returns the provider identifier
+func (pt *PeerTubeProvider) Name() string {
+	return "peertube"
+}
+
+// StreamURL returns the public link to a peertube video channel
+func (pt *PeerTubeProvider) StreamURL(account string) string {
+	return account
+}
+
+// parseChannel splits a video channel url into the instance url & channel name
+func parseChannel(account string) (*url.URL, string, error) {
+	u, err := instanceURL(account)
+	if err != nil {
+		return nil, "", err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) != 2 || (parts[0] != "c" && parts[0] != "video-channels") || parts[1] == "" {
+		return nil, "", errors.New("peertube accounts must be a video channel url (https://host/c/channel)")
+	}
+	u.Path = ""
+	return u, parts[1], nil
+}
+
+func (pt *PeerTubeProvider) getLiveVideos(ctx context.Context, account string) ([]PeerTubeVideo, error) {
+	u, channel, err := parseChannel(account)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("isLive", "true")
+	query.Set("sort", "-publishedAt")
+	query.Set("count", "10")
+	u.Path = path.Join("/api/v1/video-channels", channel, "videos")
+	u.RawQuery = query.Encode()
+
+	videos := PeerTubeVideosResponse{}
+	err = getJSON(ctx, u.String(), &videos)
+	return videos.Data, err
+}
+
+// ResolveAccount normalizes the video channel url & verifies the channel exists
+func (pt *PeerTubeProvider) ResolveAccount(ctx context.Context, account string) (string, error) {
+	u, channel, err := parseChannel(account)
+	if err != nil {
+		return "", err
+	}
+	resolved := u.String() + "/c/" + channel
+	_, err = pt.getLiveVideos(ctx, resolved)
+	return resolved, err
+}
+
+// LiveStreams returns the peertube channels which are currently streaming.
+// Unreachable instances are considered offline.
+func (pt *PeerTubeProvider) LiveStreams(ctx context.Context, accounts []string) ([]LiveStream, error) {
+	streams := []LiveStream{}
+	for i := range accounts {
+		videos, err := pt.getLiveVideos(ctx, accounts[i])
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			log.Warnf("peertube: unable to query %s: %s", accounts[i], err)
+			continue
+		}
+		for _, v := range videos {
+			if !v.IsLive || v.State.ID != peertubeStatePublished {
+				continue
+			}
+			log.Debug("Live Now:", accounts[i])
+			streams = append(streams, LiveStream{
+				Account:     accounts[i],
+				Type:        "live",
+				Title:       v.Name,
+				Category:    v.Category.Label,
+				Language:    v.Language.ID,
+				Mature:      v.Nsfw,
+				ViewerCount: v.Viewers,
+				StartedAt:   v.PublishedAt,
+			})
+			break
+		}
+	}
+	return streams, nil
+}
+
+// StreamInfo returns the metadata of a live peertube stream. The video
+// category is used as the game.
+func (pt *PeerTubeProvider) StreamInfo(ctx context.Context, s LiveStream) (models.StreamInfo, error) {
+	return models.StreamInfo{
+		Title:    s.Title,
+		GameName: s.Category,
+		Language: s.Language,
+		Mature:   s.Mature,
+	}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/bcambl/rtmpauthbot/models"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -14,14 +15,17 @@ func (c *Controller) OnPlayHandler(w http.ResponseWriter, r *http.Request) {
 	p, err := c.getPublisher(streamName)
 	if err != nil {
 		log.Warnf("on_play: stream not found: %s\n", streamName)
+		callbackOutcome("on_play", false)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	log.Printf("on_play: %s\n", p.Name)
+	callbackOutcome("on_play", true)
+	c.emitViewers(p.Name, 1)
 
-	if c.Config.DiscordEnabled {
+	if c.Config().DiscordEnabled && !p.IsMuted(models.NotifyViewers) {
 		content := fmt.Sprintf(":chart_with_upwards_trend: %s gained a viewer.", streamName)
-		err := c.callWebhook(content)
+		err := c.callWebhook(r.Context(), content)
 		if err != nil {
 			log.Error(err)
 		}
@@ -37,14 +41,17 @@ func (c *Controller) OnPlayDoneHandler(w http.ResponseWriter, r *http.Request) {
 	p, err := c.getPublisher(streamName)
 	if err != nil {
 		log.Warnf("on_play_done: stream not found: %s\n", streamName)
+		callbackOutcome("on_play_done", false)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	log.Printf("on_play_done: %s\n", p.Name)
+	callbackOutcome("on_play_done", true)
+	c.emitViewers(p.Name, -1)
 
-	if c.Config.DiscordEnabled {
+	if c.Config().DiscordEnabled && !p.IsMuted(models.NotifyViewers) {
 		content := fmt.Sprintf(":chart_with_downwards_trend: %s lost a viewer.", streamName)
-		err := c.callWebhook(content)
+		err := c.callWebhook(r.Context(), content)
 		if err != nil {
 			log.Error(err)
 		}
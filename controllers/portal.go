@@ -0,0 +1,434 @@
+package controllers
+
+import (
+	"context"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// portalCookie is the name of the member portal session cookie
+	portalCookie = "rtmpauthbot_portal"
+	// oauthStateCookie holds the oauth2 state while logging in with discord
+	oauthStateCookie = "rtmpauthbot_oauth_state"
+	// allowListKey is the config key of the portal self-registration
+	// allow-list
+	allowListKey = "portal_allow_list"
+)
+
+var (
+	// errNotAllowed is returned when a discord user is not on the allow-list
+	errNotAllowed = errors.New("discord user is not allowed to register")
+	// errUnauthorized is returned for requests without a valid portal session
+	errUnauthorized = errors.New("login required")
+)
+
+// portalAssets contains the static files of the member portal
+//
+//go:embed portal
+var portalAssets embed.FS
+
+// DiscordUser is the response of the discord users/@me endpoint
+type DiscordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+}
+
+// oauthConfig returns the discord oauth2 configuration of the portal
+func (c *Controller) oauthConfig() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.Config().DiscordClientID,
+		ClientSecret: c.Config().DiscordClientSecret,
+		RedirectURL:  c.Config().DiscordRedirectURL,
+		Scopes:       []string{"identify"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   c.Config().DiscordAuthorizeURL,
+			TokenURL:  c.Config().DiscordTokenURL,
+			AuthStyle: oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+// allowList returns the discord user ids & usernames which may self-register
+func (c *Controller) allowList() ([]string, error) {
+	entries := []string{}
+	value, err := c.Store.GetConfig(allowListKey)
+	if err == store.ErrNotFound {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entries, json.Unmarshal([]byte(value), &entries)
+}
+
+// allowed returns true if the id of the discord user is on the allow-list.
+// Usernames are not matched as they can be changed & reused.
+func (c *Controller) allowed(user DiscordUser) (bool, error) {
+	entries, err := c.allowList()
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry == user.ID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isDiscordID returns true if s is a discord user id (snowflake)
+func isDiscordID(s string) bool {
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// AllowListHandler is the http handler for "/api/v1/portal/allow-list". The
+// allow-list contains the discord user ids which may register a publisher
+// through the member portal.
+func (c *Controller) AllowListHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var entries []string
+		err := decodeBody(r, &entries)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		cleaned := []string{}
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if !isDiscordID(entry) {
+				writeJSONError(w, invalidf("allow-list entries must be discord user ids: %s", entry))
+				return
+			}
+			cleaned = append(cleaned, entry)
+		}
+		value, err := json.Marshal(cleaned)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		err = c.Store.SetConfig(allowListKey, string(value))
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		log.Infof("portal allow-list updated (%d entries)", len(cleaned))
+	}
+	entries, err := c.allowList()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// fetchDiscordUser exchanges an authorization code & returns the discord user
+func (c *Controller) fetchDiscordUser(ctx context.Context, code string) (DiscordUser, error) {
+	var user DiscordUser
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, providerClient)
+	conf := c.oauthConfig()
+	token, err := conf.Exchange(ctx, code)
+	if err != nil {
+		return user, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", c.Config().DiscordUserURL, nil)
+	if err != nil {
+		return user, err
+	}
+	token.SetAuthHeader(req)
+	resp, err := providerClient.Do(req)
+	if err != nil {
+		return user, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return user, fmt.Errorf("discord user request returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&user)
+	if err == nil && user.ID == "" {
+		err = errors.New("discord user response without id")
+	}
+	return user, err
+}
+
+// registerMember returns the publisher of a discord user. Allow-listed users
+// without a publisher register a new publisher named after their username.
+// Existing publishers are never claimed, linking them is left to an admin.
+func (c *Controller) registerMember(user DiscordUser) (models.Publisher, error) {
+	p, err := c.Store.GetPublisherByDiscordID(user.ID)
+	if err != store.ErrNotFound {
+		return p, err
+	}
+	ok, err := c.allowed(user)
+	if err != nil {
+		return p, err
+	}
+	if !ok {
+		return p, errNotAllowed
+	}
+	key, err := generateKey()
+	if err != nil {
+		return p, err
+	}
+	name := strings.ToLower(user.Username)
+	p, err = c.Store.UpsertPublisher(name, func(record *models.Publisher) error {
+		if record.Key != "" {
+			return errConflict
+		}
+		log.Infof("portal: registering publisher %s for discord user %s", name, user.ID)
+		record.Key = key
+		record.DiscordID = user.ID
+		return nil
+	})
+	var taken *store.DiscordIDTakenError
+	if errors.As(err, &taken) {
+		// registered by a concurrent login or linked by an admin meanwhile
+		return c.Store.GetPublisherByDiscordID(user.ID)
+	}
+	return p, err
+}
+
+// portalRedirect redirects to the portal page with an error code
+func portalRedirect(w http.ResponseWriter, r *http.Request, code string) {
+	target := "/portal/"
+	if code != "" {
+		target += "?" + url.Values{"error": {code}}.Encode()
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// PortalLoginHandler is the http handler for "/portal/login". The member is
+// redirected to discord to authorize the portal.
+func (c *Controller) PortalLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.Config().PortalEnabled() {
+		portalRedirect(w, r, "disabled")
+		return
+	}
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	state := hex.EncodeToString(b)
+	// discord redirects back cross-site, which requires a lax cookie
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/portal/",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, c.oauthConfig().AuthCodeURL(state), http.StatusFound)
+}
+
+// PortalCallbackHandler is the http handler for "/portal/callback". The
+// authorization code is exchanged & the discord user is mapped to their
+// publisher before a portal session is started.
+func (c *Controller) PortalCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := r.Cookie(oauthStateCookie)
+	if err != nil || state.Value == "" || !secureEqual(state.Value, r.URL.Query().Get("state")) {
+		portalRedirect(w, r, "invalid_state")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/portal/", MaxAge: -1})
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		// the member declined the authorization
+		portalRedirect(w, r, "access_denied")
+		return
+	}
+	user, err := c.fetchDiscordUser(r.Context(), code)
+	if err != nil {
+		log.Error("portal: discord login failed: ", err)
+		portalRedirect(w, r, "login_failed")
+		return
+	}
+	p, err := c.registerMember(user)
+	switch {
+	case err == errNotAllowed:
+		log.Warnf("portal: discord user %s (%s) is not on the allow-list", user.Username, user.ID)
+		portalRedirect(w, r, "not_allowed")
+		return
+	case err == errConflict:
+		log.Warnf("portal: publisher %s already exists, an admin may link it to discord user %s", strings.ToLower(user.Username), user.ID)
+		portalRedirect(w, r, "conflict")
+		return
+	case err != nil:
+		log.Error("portal: error registering discord user: ", err)
+		portalRedirect(w, r, "login_failed")
+		return
+	}
+	token, err := c.portalSessions.create(user.ID)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	log.Infof("portal login: %s (discord user %s)", p.Name, user.ID)
+	setSessionCookie(w, r, portalCookie, token)
+	portalRedirect(w, r, "")
+}
+
+// portalMember returns the publisher of the portal session
+func (c *Controller) portalMember(r *http.Request) (models.Publisher, error) {
+	cookie, err := r.Cookie(portalCookie)
+	if err != nil {
+		return models.Publisher{}, errUnauthorized
+	}
+	id, ok := c.portalSessions.get(cookie.Value)
+	if !ok {
+		return models.Publisher{}, errUnauthorized
+	}
+	p, err := c.Store.GetPublisherByDiscordID(id)
+	if err == store.ErrNotFound {
+		// the publisher was deleted or unlinked by an admin
+		c.portalSessions.remove(cookie.Value)
+		return p, errUnauthorized
+	}
+	return p, err
+}
+
+// PortalLogoutHandler is the http handler for "/portal/logout"
+func (c *Controller) PortalLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(portalCookie); err == nil {
+		c.portalSessions.remove(cookie.Value)
+	}
+	setSessionCookie(w, r, portalCookie, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// portalRequest returns the publisher of the portal session & the check of
+// its modifications or writes an error response. Modifications require the
+// X-Requested-With header which cross-site requests cannot set.
+func (c *Controller) portalRequest(w http.ResponseWriter, r *http.Request) (models.Publisher, precondition, bool) {
+	p, err := c.portalMember(r)
+	if err == errUnauthorized {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", err.Error())
+		return p, nil, false
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return p, nil, false
+	}
+	if r.Method != "GET" && r.Header.Get(requestedWithHeader) == "" {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "missing "+requestedWithHeader+" header")
+		return p, nil, false
+	}
+	// fail if an admin unlinked the publisher in the meantime
+	check := func(record *models.Publisher, exists bool) error {
+		if record.DiscordID != p.DiscordID {
+			return errPreconditionFailed
+		}
+		return nil
+	}
+	return p, check, true
+}
+
+// PortalMeHandler is the http handler for "/portal/api/me". Members may read
+// their publisher and change their twitch channel, muted notifications &
+// unlisted flag.
+func (c *Controller) PortalMeHandler(w http.ResponseWriter, r *http.Request) {
+	p, check, ok := c.portalRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	patch, err := parsePublisherPatch(p.Name, body)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	if patch.Key != nil || patch.Links != nil || patch.DiscordID != nil {
+		writeJSONError(w, invalidf("only twitch_stream, muted & unlisted may be changed"))
+		return
+	}
+	updated, _, err := c.applyPublisherPatch(p.Name, patch, false, check)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	log.Infof("portal: %s updated their publisher", p.Name)
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// PortalKeyHandler is the http handler for "POST /portal/api/me/key" which
+// rotates the stream key of the member
+func (c *Controller) PortalKeyHandler(w http.ResponseWriter, r *http.Request) {
+	p, check, ok := c.portalRequest(w, r)
+	if !ok {
+		return
+	}
+	key, err := generateKey()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	_, _, err = c.applyPublisherPatch(p.Name, publisherPatch{Key: &key}, false, check)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	log.Infof("portal: %s rotated their stream key", p.Name)
+	writeJSON(w, http.StatusOK, keyResponse{Key: key})
+}
+
+// PortalSessionsHandler is the http handler for "GET /portal/api/me/sessions"
+func (c *Controller) PortalSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	p, _, ok := c.portalRequest(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := c.Store.ListSessions(p.Name)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// PortalHandler is the http handler for "/portal/" which serves the static
+// member portal page
+func (c *Controller) PortalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/portal" {
+		http.Redirect(w, r, "/portal/", http.StatusMovedPermanently)
+		return
+	}
+	assets, err := fs.Sub(portalAssets, "portal")
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.StripPrefix("/portal", http.FileServer(http.FS(assets))).ServeHTTP(w, r)
+}
@@ -0,0 +1,161 @@
+// rtmpauthbot member portal. Members manage their own publisher through the
+// /portal/api routes after logging in with discord.
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+
+const loginErrors = {
+  disabled: "The member portal is not configured.",
+  invalid_state: "The login expired, please try again.",
+  access_denied: "The Discord authorization was declined.",
+  login_failed: "Logging in with Discord failed, please try again later.",
+  not_allowed: "Your Discord account is not allowed to register, please ask an admin.",
+  conflict: "A stream with your username already exists, please ask an admin to link it to your Discord account.",
+};
+
+let member = null;
+
+async function api(method, path, body) {
+  const init = {
+    method: method,
+    credentials: "same-origin",
+    headers: { "X-Requested-With": "rtmpauthbot" },
+  };
+  if (body !== undefined) {
+    init.headers["Content-Type"] = "application/json";
+    init.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, init);
+  const text = await resp.text();
+  const data = text ? JSON.parse(text) : null;
+  if (!resp.ok) {
+    const err = new Error(data && data.error ? data.error.message : resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  return data;
+}
+
+function showMessage(text, isError) {
+  const el = $("message");
+  el.textContent = text;
+  el.className = isError ? "error" : "";
+  el.hidden = false;
+}
+
+async function run(action, success) {
+  try {
+    await action();
+    if (success) {
+      showMessage(success, false);
+    }
+  } catch (err) {
+    if (err.status === 401) {
+      showLogin();
+    }
+    showMessage(err.message, true);
+  }
+}
+
+function showLogin() {
+  $("nav").hidden = true;
+  $("profile").hidden = true;
+  $("login").hidden = false;
+}
+
+function formatTime(t) {
+  return t ? new Date(t).toLocaleString() : "";
+}
+
+function render() {
+  $("name").textContent = member.name;
+  $("key").type = "password";
+  $("key").value = member.key;
+  $("show-key").textContent = "Show";
+  const form = $("settings-form");
+  form.twitch_stream.value = member.twitch_stream;
+  form.unlisted.checked = member.unlisted;
+  for (const box of form.querySelectorAll("input[name=muted]")) {
+    box.checked = member.muted.includes(box.value);
+  }
+}
+
+async function loadSessions() {
+  const sessions = await api("GET", "/portal/api/me/sessions");
+  const tbody = $("sessions");
+  tbody.replaceChildren();
+  for (const s of sessions) {
+    const row = document.createElement("tr");
+    for (const value of [s.provider, s.account, s.title, s.game, formatTime(s.started_at), s.ended_at ? formatTime(s.ended_at) : "live"]) {
+      const td = document.createElement("td");
+      td.textContent = value || "";
+      row.appendChild(td);
+    }
+    tbody.appendChild(row);
+  }
+}
+
+async function load() {
+  member = await api("GET", "/portal/api/me");
+  render();
+  $("login").hidden = true;
+  $("nav").hidden = false;
+  $("profile").hidden = false;
+  await loadSessions();
+}
+
+$("show-key").addEventListener("click", () => {
+  const hidden = $("key").type === "password";
+  $("key").type = hidden ? "text" : "password";
+  $("show-key").textContent = hidden ? "Hide" : "Show";
+});
+
+$("rotate-key").addEventListener("click", () => {
+  if (!confirm("Replace your stream key? Your streaming software must be updated with the new key.")) {
+    return;
+  }
+  run(async () => {
+    const resp = await api("POST", "/portal/api/me/key");
+    member.key = resp.key;
+    render();
+  }, "Your stream key was rotated");
+});
+
+$("settings-form").addEventListener("submit", (e) => {
+  e.preventDefault();
+  const form = e.target;
+  const muted = Array.from(form.querySelectorAll("input[name=muted]:checked"), (box) => box.value);
+  run(async () => {
+    member = await api("PATCH", "/portal/api/me", {
+      twitch_stream: form.twitch_stream.value || null,
+      unlisted: form.unlisted.checked,
+      muted: muted,
+    });
+    render();
+  }, "Settings saved");
+});
+
+$("logout").addEventListener("click", () => {
+  run(async () => {
+    await api("POST", "/portal/logout");
+    showLogin();
+  }, "Logged out");
+});
+
+const loginError = new URLSearchParams(window.location.search).get("error");
+if (loginError) {
+  history.replaceState(null, "", "/portal/");
+  showLogin();
+  showMessage(loginErrors[loginError] || loginError, true);
+} else {
+  run(async () => {
+    try {
+      await load();
+    } catch (err) {
+      if (err.status !== 401) {
+        throw err;
+      }
+      showLogin();
+    }
+  });
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+func TestRegisterMember(t *testing.T) {
+	c := newTestController(t, nil)
+	err := c.Store.SetConfig(allowListKey, `["111", "222", "bob"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Store.UpsertPublisher("bob", func(p *models.Publisher) error {
+		p.Key = "bobkey"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// usernames on the allow-list are not matched
+	_, err = c.registerMember(DiscordUser{ID: "333", Username: "bob"})
+	if err != errNotAllowed {
+		t.Errorf("expected errNotAllowed, got %v", err)
+	}
+
+	alice := DiscordUser{ID: "111", Username: "Alice"}
+	p, err := c.registerMember(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "alice" || p.Key == "" || p.DiscordID != alice.ID {
+		t.Errorf("expected a new publisher of alice, got %+v", p)
+	}
+	again, err := c.registerMember(alice)
+	if err != nil || again.Key != p.Key || again.Revision != p.Revision {
+		t.Errorf("expected the registered publisher, got %+v (%v)", again, err)
+	}
+
+	// existing publishers are never claimed
+	_, err = c.registerMember(DiscordUser{ID: "222", Username: "bob"})
+	if err != errConflict {
+		t.Errorf("expected errConflict, got %v", err)
+	}
+	bob, err := c.Store.GetPublisher("bob")
+	if err != nil || bob.DiscordID != "" || bob.Key != "bobkey" {
+		t.Errorf("expected bob to be unchanged, got %+v (%v)", bob, err)
+	}
+}
+
+func TestAllowListHandler(t *testing.T) {
+	c := newTestController(t, nil)
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`["123456789012345678", " 223456789012345678 ", ""]`, http.StatusOK},
+		{`["123456789012345678", "discord_username"]`, http.StatusBadRequest},
+		{`["-1"]`, http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		c.AllowListHandler(w, httptest.NewRequest("PUT", "/api/v1/portal/allow-list", strings.NewReader(tc.body)))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.body, tc.status, w.Code)
+		}
+	}
+	entries, err := c.allowList()
+	if err != nil || strings.Join(entries, ",") != "123456789012345678,223456789012345678" {
+		t.Errorf("expected the valid allow-list to be kept, got %q (%v)", entries, err)
+	}
+}
@@ -0,0 +1,456 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// errAccountNotFound is returned by a provider when an account does not exist
+var errAccountNotFound = errors.New("account not found")
+
+// StreamProvider is implemented by each external streaming platform that
+// publishers may link accounts on (twitch, youtube, owncast, etc.)
+type StreamProvider interface {
+	// Name returns the identifier used to key links & live state (ie: "twitch")
+	Name() string
+	// ResolveAccount normalizes an account name & verifies it exists if possible
+	ResolveAccount(ctx context.Context, account string) (string, error)
+	// LiveStreams returns the streams currently live for the provided accounts
+	LiveStreams(ctx context.Context, accounts []string) ([]LiveStream, error)
+	// StreamInfo returns the metadata of a live stream
+	StreamInfo(ctx context.Context, s LiveStream) (models.StreamInfo, error)
+	// StreamURL returns the public link used to watch an account
+	StreamURL(account string) string
+}
+
+// providerClient is used for requests to stream providers & discord, the
+// timeout bounds requests which are not cancelled by their context
+var providerClient = &http.Client{Timeout: 10 * time.Second}
+
+// LiveStream is the provider agnostic representation of a live stream
+type LiveStream struct {
+	Account     string
+	Type        string
+	Title       string
+	CategoryID  string
+	Category    string
+	Tags        []string
+	Language    string
+	Mature      bool
+	ViewerCount int
+	StartedAt   string
+}
+
+// RegisterProvider makes a stream provider available for publisher links
+func (c *Controller) RegisterProvider(p StreamProvider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.providers == nil {
+		c.providers = make(map[string]StreamProvider)
+	}
+	c.providers[p.Name()] = p
+}
+
+// SetProviders replaces the stream providers available for publisher links
+func (c *Controller) SetProviders(providers ...StreamProvider) {
+	m := make(map[string]StreamProvider)
+	for _, p := range providers {
+		m[p.Name()] = p
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.providers = m
+}
+
+// provider returns the registered stream provider by name
+func (c *Controller) provider(name string) (StreamProvider, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sp, ok := c.providers[name]
+	return sp, ok
+}
+
+// providerNames returns the names of the registered stream providers
+func (c *Controller) providerNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.providers))
+	for name := range c.providers {
+		names = append(names, name)
+	}
+	return names
+}
+
+// resolveLinks normalizes the accounts of the provided links. Links to
+// providers which are not enabled are stored as-is and tracked once enabled.
+// Accounts are resolved within the provider client timeout.
+func (c *Controller) resolveLinks(links []models.StreamLink) ([]models.StreamLink, error) {
+	resolved := []models.StreamLink{}
+	seen := make(map[string]bool)
+	for i := range links {
+		l := models.StreamLink{
+			Provider: strings.ToLower(strings.TrimSpace(links[i].Provider)),
+			Account:  strings.TrimSpace(links[i].Account),
+		}
+		if l.Provider == "" || l.Account == "" {
+			return nil, invalidf("stream links require a provider and account")
+		}
+		if sp, ok := c.provider(l.Provider); ok {
+			account, err := sp.ResolveAccount(context.Background(), l.Account)
+			if err == errAccountNotFound {
+				return nil, invalidf("%s account not found: %s", l.Provider, l.Account)
+			}
+			if err != nil {
+				log.Warnf("unable to verify %s account '%s': %s", l.Provider, l.Account, err)
+			}
+			if account != "" {
+				l.Account = account
+			}
+		}
+		k := l.Provider + "/" + strings.ToLower(l.Account)
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		resolved = append(resolved, l)
+	}
+	return resolved, nil
+}
+
+// instanceURL normalizes the base url of a self-hosted provider instance
+func instanceURL(account string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(account))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid instance url: %s", account)
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u, nil
+}
+
+// getJSON queries a provider endpoint and unmarshals the json response into v
+func getJSON(ctx context.Context, endpoint string, v interface{}) error {
+	r, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := providerClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return errAccountNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s response status code: %d", endpoint, resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// linkedAccounts returns the unique accounts linked on a provider
+func linkedAccounts(publishers []models.Publisher, provider string) []string {
+	var accounts []string
+	seen := make(map[string]bool)
+	for i := range publishers {
+		for _, l := range publishers[i].Links {
+			if l.Provider != provider || seen[l.Account] {
+				continue
+			}
+			seen[l.Account] = true
+			accounts = append(accounts, l.Account)
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// offlineGraceExpired returns true once a missing stream has been absent for
+// the configured number of polls or duration, whichever comes first
+func (c *Controller) offlineGraceExpired(state models.LinkState, now time.Time) bool {
+	polls := c.Config().OfflineGracePolls
+	period := c.Config().OfflineGracePeriod
+	if polls <= 1 && period <= 0 {
+		return true
+	}
+	if polls > 1 && state.Missed >= polls {
+		return true
+	}
+	if period > 0 && now.Sub(state.MissedSince) >= period {
+		return true
+	}
+	return false
+}
+
+// liveTransition records a linked account going live or offline
+type liveTransition struct {
+	Account string
+	Live    bool
+	Info    models.StreamInfo
+}
+
+// applyLiveStatus transitions the state of a publisher's links on a provider
+// based on the currently live streams & their stream info
+func (c *Controller) applyLiveStatus(sp StreamProvider, p *models.Publisher, streams []LiveStream, infos []models.StreamInfo, now time.Time) []liveTransition {
+	var transitions []liveTransition
+	for x := range p.Links {
+		l := &p.Links[x]
+		if l.Provider != sp.Name() {
+			continue
+		}
+		live := -1
+		for s := range streams {
+			if strings.EqualFold(streams[s].Account, l.Account) {
+				live = s
+				break
+			}
+		}
+
+		// mark previous live streams -> offline once the grace period expires
+		if live < 0 {
+			if !l.IsLive() {
+				continue
+			}
+			l.Missed++
+			if l.MissedSince.IsZero() {
+				l.MissedSince = now
+			}
+			l.State = models.StateMaybeOffline
+			if c.offlineGraceExpired(l.LinkState, now) {
+				l.Live = ""
+				l.State = models.StateOffline
+				l.Missed = 0
+				l.MissedSince = time.Time{}
+				l.StreamInfo = models.StreamInfo{}
+				l.Notification = fmt.Sprintf(":checkered_flag: %s finished streaming on %s", p.Name, sp.Name())
+				transitions = append(transitions, liveTransition{Account: l.Account})
+			} else {
+				log.Debugf("%s: %s (%s) missing from poll %d", sp.Name(), p.Name, l.Account, l.Missed)
+			}
+			continue
+		}
+
+		stream, streamInfo := streams[live], infos[live]
+
+		// mark live streams -> online
+		if !l.IsLive() {
+			l.Live = stream.Type
+			l.State = models.StateLive
+			l.StreamInfo = streamInfo
+			l.Notification = fmt.Sprintf(":movie_camera: %s started streaming on %s!"+
+				"\n%s\nwatch now: `%s`", p.Name, sp.Name(), streamInfo, sp.StreamURL(l.Account))
+			transitions = append(transitions, liveTransition{Account: l.Account, Live: true, Info: streamInfo})
+			continue
+		}
+
+		// stream returned within the grace period, continue the session
+		if l.State == models.StateMaybeOffline {
+			log.Debugf("%s: %s (%s) returned after %d missed polls", sp.Name(), p.Name, l.Account, l.Missed)
+			l.State = models.StateLive
+			l.Missed = 0
+			l.MissedSince = time.Time{}
+		}
+
+		// streamer changed their stream info, set notification if any of
+		// the changed fields are opted-in to notifications
+		changes := streamInfo.Diff(l.StreamInfo)
+		if len(changes) > 0 {
+			l.StreamInfo = streamInfo
+			notification := infoChangeNotification(p.Name, sp.Name(), changes, c.Config().StreamInfoNotify)
+			if notification != "" {
+				l.Notification = notification
+			}
+		}
+	}
+	return transitions
+}
+
+// recordSessions starts & ends the provider sessions of live transitions
+func (c *Controller) recordSessions(sp StreamProvider, name string, transitions []liveTransition, now time.Time) {
+	for _, t := range transitions {
+		var err error
+		if t.Live {
+			_, err = c.Store.StartSession(models.Session{
+				Publisher: name,
+				Provider:  sp.Name(),
+				Account:   t.Account,
+				Title:     t.Info.Title,
+				Game:      t.Info.GameName,
+				StartedAt: now,
+			})
+		} else {
+			err = c.Store.EndSession(name, sp.Name(), t.Account, now)
+		}
+		if err != nil {
+			log.Errorf("error recording %s session of %s: %s", sp.Name(), name, err)
+		}
+	}
+}
+
+func (c *Controller) updateLiveStatus(ctx context.Context, sp StreamProvider, streams []LiveStream) error {
+
+	// retrieve stream info prior to updating publishers to avoid provider
+	// requests while holding a database transaction
+	infos := make([]models.StreamInfo, len(streams))
+	for i := range streams {
+		streamInfo, err := sp.StreamInfo(ctx, streams[i])
+		if err != nil {
+			return err
+		}
+		infos[i] = streamInfo
+	}
+
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range publishers {
+		if publishers[i].Link(sp.Name()) == nil {
+			continue
+		}
+		var transitions []liveTransition
+		_, err = c.Store.UpdatePublisher(publishers[i].Name, func(p *models.Publisher) error {
+			transitions = c.applyLiveStatus(sp, p, streams, infos, now)
+			return nil
+		})
+		if err != nil && err != store.ErrNotFound {
+			return err
+		}
+		c.recordSessions(sp, publishers[i].Name, transitions, now)
+		c.emitLiveStatus(sp, publishers[i], streams, transitions)
+	}
+
+	return nil
+}
+
+func (c *Controller) processNotifications(ctx context.Context, sp StreamProvider) error {
+
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		return err
+	}
+
+	for i := range publishers {
+		p := publishers[i]
+		for x := range p.Links {
+			l := p.Links[x]
+			if l.Provider != sp.Name() || l.Notification == "" {
+				continue
+			}
+			log.Debug("notification: ", l.Notification)
+			if c.Config().DiscordEnabled && !p.IsMuted(models.NotifyLive) {
+				log.Debug("sending discord notification: ", l.Notification)
+				err := c.callWebhook(ctx, l.Notification)
+				if err != nil {
+					return err
+				}
+			}
+			log.Debugf("resetting notification for %s (%s/%s)", p.Name, l.Provider, l.Account)
+			_, err = c.Store.UpdatePublisher(p.Name, func(p *models.Publisher) error {
+				for y := range p.Links {
+					sent := &p.Links[y]
+					if sent.Provider == l.Provider && sent.Account == l.Account && sent.Notification == l.Notification {
+						sent.Notification = ""
+					}
+				}
+				return nil
+			})
+			if err != nil && err != store.ErrNotFound {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *Controller) providerMain(ctx context.Context, sp StreamProvider) {
+	publishers, err := c.getAllPublisher()
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	accounts := linkedAccounts(publishers, sp.Name())
+	if len(accounts) == 0 {
+		log.Debugf("%s: no linked accounts to query", sp.Name())
+		return
+	}
+
+	streams, err := sp.LiveStreams(ctx, accounts)
+	if err != nil {
+		log.Debug(err)
+		return
+	}
+
+	err = c.updateLiveStatus(ctx, sp, streams)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	err = c.processNotifications(ctx, sp)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+}
+
+// ProviderScheduler runs the stream query & notification process of a stream
+// provider at the poll rate until the context is cancelled. A running poll is
+// cancelled with the context, its unsent notifications are kept and sent by
+// the next poll.
+func (c *Controller) ProviderScheduler(ctx context.Context, sp StreamProvider, pollRate time.Duration) {
+	ticker := time.NewTicker(pollRate)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.providerMain(ctx, sp)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// infoChangeNotification returns the notification for the stream info changes
+// of the opted-in fields or an empty string if no opted-in field changed
+func infoChangeNotification(name, provider string, changes []models.InfoChange, fields []string) string {
+	enabled := make(map[string]bool)
+	for i := range fields {
+		enabled[fields[i]] = true
+	}
+	var lines []string
+	for i := range changes {
+		if enabled[changes[i].Field] {
+			lines = append(lines, changes[i].Message)
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	if len(lines) == 1 {
+		return fmt.Sprintf("%s %s on %s", name, lines[0], provider)
+	}
+	return fmt.Sprintf("%s updated their %s stream:\n- %s", name, provider, strings.Join(lines, "\n- "))
+}
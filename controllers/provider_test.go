@@ -0,0 +1,195 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+// newOwncastServer returns a fake owncast instance reporting the status
+func newOwncastServer(t *testing.T, status OwncastStatusResponse) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(status)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOwncastLiveStreams(t *testing.T) {
+	live := newOwncastServer(t, OwncastStatusResponse{Online: true, ViewerCount: 4, StreamTitle: "speedrun"})
+	offline := newOwncastServer(t, OwncastStatusResponse{Online: false})
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	o := NewOwncastProvider()
+	streams, err := o.LiveStreams(context.Background(), []string{live.URL, offline.URL, missing.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("expected 1 live stream, got %d", len(streams))
+	}
+	s := streams[0]
+	if s.Account != live.URL || s.Title != "speedrun" || s.ViewerCount != 4 {
+		t.Errorf("unexpected live stream: %+v", s)
+	}
+}
+
+func TestOwncastResolveAccount(t *testing.T) {
+	srv := newOwncastServer(t, OwncastStatusResponse{})
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	o := NewOwncastProvider()
+	account, err := o.ResolveAccount(context.Background(), srv.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account != srv.URL {
+		t.Errorf("expected %s, got %s", srv.URL, account)
+	}
+	_, err = o.ResolveAccount(context.Background(), missing.URL)
+	if err != errAccountNotFound {
+		t.Errorf("expected errAccountNotFound, got %v", err)
+	}
+	_, err = o.ResolveAccount(context.Background(), "ftp://example.com")
+	if err == nil {
+		t.Error("expected an error for a non-http instance url")
+	}
+}
+
+// newPeerTubeServer returns a fake peertube instance with the videos of the
+// channels, other channels do not exist
+func newPeerTubeServer(t *testing.T, channels map[string][]PeerTubeVideo) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/video-channels/{channel}/videos", func(w http.ResponseWriter, r *http.Request) {
+		videos, ok := channels[r.PathValue("channel")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("isLive") != "true" {
+			t.Errorf("expected a query of live videos, got %s", r.URL.RawQuery)
+		}
+		json.NewEncoder(w).Encode(PeerTubeVideosResponse{Total: len(videos), Data: videos})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPeerTubeLiveStreams(t *testing.T) {
+	streaming := PeerTubeVideo{Name: "live coding", IsLive: true, Viewers: 7, Nsfw: true}
+	streaming.State.ID = peertubeStatePublished
+	streaming.Category.Label = "Science & Technology"
+	streaming.Language.ID = "en"
+	// live videos which are not streaming yet are waiting for the publisher
+	waiting := PeerTubeVideo{Name: "scheduled", IsLive: true}
+	waiting.State.ID = 4
+
+	srv := newPeerTubeServer(t, map[string][]PeerTubeVideo{
+		"live":    {streaming},
+		"waiting": {waiting},
+		"empty":   {},
+	})
+	pt := NewPeerTubeProvider()
+	accounts := []string{srv.URL + "/c/live", srv.URL + "/c/waiting", srv.URL + "/c/empty", srv.URL + "/c/missing"}
+	streams, err := pt.LiveStreams(context.Background(), accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 {
+		t.Fatalf("expected 1 live stream, got %d", len(streams))
+	}
+	info, err := pt.StreamInfo(context.Background(), streams[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := models.StreamInfo{Title: "live coding", GameName: "Science & Technology", Language: "en", Mature: true}
+	if streams[0].Account != accounts[0] || streams[0].ViewerCount != 7 || len(info.Diff(want)) > 0 {
+		t.Errorf("unexpected live stream: %+v (%+v)", streams[0], info)
+	}
+}
+
+func TestPeerTubeResolveAccount(t *testing.T) {
+	srv := newPeerTubeServer(t, map[string][]PeerTubeVideo{"channel": {}})
+	pt := NewPeerTubeProvider()
+
+	account, err := pt.ResolveAccount(context.Background(), srv.URL+"/video-channels/channel/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account != srv.URL+"/c/channel" {
+		t.Errorf("expected %s/c/channel, got %s", srv.URL, account)
+	}
+	_, err = pt.ResolveAccount(context.Background(), srv.URL+"/c/missing")
+	if err != errAccountNotFound {
+		t.Errorf("expected errAccountNotFound, got %v", err)
+	}
+	_, err = pt.ResolveAccount(context.Background(), srv.URL+"/a/user")
+	if err == nil {
+		t.Error("expected an error for an account url")
+	}
+}
+
+func TestApplyLiveStatusGracePeriod(t *testing.T) {
+	c := newTestController(t, map[string]string{"OFFLINE_GRACE_POLLS": "3", "OFFLINE_GRACE_PERIOD": "0"})
+	sp := NewOwncastProvider()
+	account := "https://owncast.example.com"
+	p := &models.Publisher{Name: "alice", Links: []models.StreamLink{{Provider: "owncast", Account: account}}}
+	live := []LiveStream{{Account: account, Type: "live", Title: "hello"}}
+	infos := []models.StreamInfo{{Title: "hello"}}
+	now := time.Now()
+
+	transitions := c.applyLiveStatus(sp, p, live, infos, now)
+	if len(transitions) != 1 || !transitions[0].Live || p.Links[0].State != models.StateLive {
+		t.Fatalf("expected the link to go live, got %+v", p.Links[0])
+	}
+
+	// missing polls within the grace period keep the stream live
+	for poll := 1; poll <= 2; poll++ {
+		transitions = c.applyLiveStatus(sp, p, nil, nil, now.Add(time.Duration(poll)*time.Minute))
+		if len(transitions) != 0 || p.Links[0].State != models.StateMaybeOffline || p.Links[0].Missed != poll {
+			t.Fatalf("poll %d: expected maybe-offline, got %+v", poll, p.Links[0])
+		}
+	}
+
+	// a stream returning within the grace period continues the session
+	transitions = c.applyLiveStatus(sp, p, live, infos, now.Add(3*time.Minute))
+	if len(transitions) != 0 || p.Links[0].State != models.StateLive || p.Links[0].Missed != 0 {
+		t.Fatalf("expected the stream to continue, got %+v", p.Links[0])
+	}
+
+	for poll := 1; poll <= 3; poll++ {
+		transitions = c.applyLiveStatus(sp, p, nil, nil, now.Add(time.Duration(3+poll)*time.Minute))
+	}
+	if len(transitions) != 1 || transitions[0].Live || p.Links[0].State != models.StateOffline || p.Links[0].Live != "" {
+		t.Fatalf("expected the link to go offline after 3 missed polls, got %+v", p.Links[0])
+	}
+}
+
+func TestApplyLiveStatusGraceDuration(t *testing.T) {
+	c := newTestController(t, map[string]string{"OFFLINE_GRACE_POLLS": "0", "OFFLINE_GRACE_PERIOD": "120"})
+	sp := NewOwncastProvider()
+	account := "https://owncast.example.com"
+	p := &models.Publisher{Name: "alice", Links: []models.StreamLink{{Provider: "owncast", Account: account}}}
+	now := time.Now()
+	c.applyLiveStatus(sp, p, []LiveStream{{Account: account, Type: "live"}}, []models.StreamInfo{{}}, now)
+
+	c.applyLiveStatus(sp, p, nil, nil, now.Add(time.Minute))
+	transitions := c.applyLiveStatus(sp, p, nil, nil, now.Add(2*time.Minute))
+	if len(transitions) != 0 || p.Links[0].State != models.StateMaybeOffline {
+		t.Fatalf("expected maybe-offline within the grace period, got %+v", p.Links[0])
+	}
+	transitions = c.applyLiveStatus(sp, p, nil, nil, now.Add(3*time.Minute+time.Second))
+	if len(transitions) != 1 || p.Links[0].State != models.StateOffline {
+		t.Fatalf("expected offline after the grace period, got %+v", p.Links[0])
+	}
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+)
+
+// publicMaxAge is the number of seconds public responses may be cached
+const publicMaxAge = 15
+
+// PublicPublisher is the public live status of a publisher. Stream keys and
+// internal link state are never included.
+type PublicPublisher struct {
+	Name    string         `json:"name"`
+	RTMP    *PublicRTMP    `json:"rtmp,omitempty"`
+	Streams []PublicStream `json:"streams"`
+}
+
+// PublicRTMP contains the watch links of a stream on the local rtmp server
+type PublicRTMP struct {
+	URL     string `json:"url,omitempty"`
+	HLSURL  string `json:"hls_url,omitempty"`
+	Viewers *int   `json:"viewers,omitempty"`
+}
+
+// PublicStream is a live stream of a linked provider account
+type PublicStream struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account"`
+	URL      string `json:"url,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Game     string `json:"game,omitempty"`
+	Viewers  *int   `json:"viewers,omitempty"`
+}
+
+// viewerCount returns the tracked viewer count of a stream if known
+func (c *Controller) viewerCount(publisher, provider, account string) *int {
+	if c.Events == nil {
+		return nil
+	}
+	n, ok := c.Events.viewerCount(viewerKey(publisher, provider, account))
+	if !ok {
+		return nil
+	}
+	return &n
+}
+
+// publicPublisher returns the public live status of a publisher
+func (c *Controller) publicPublisher(p *models.Publisher) PublicPublisher {
+	out := PublicPublisher{Name: p.Name, Streams: []PublicStream{}}
+	if p.RTMPLive != "" {
+		out.RTMP = &PublicRTMP{Viewers: c.viewerCount(p.Name, "", "")}
+		if c.Config().RTMPServerFQDN != "" {
+			out.RTMP.URL = fmt.Sprintf("rtmp://%s:%s/stream/%s", c.Config().RTMPServerFQDN, c.Config().RTMPServerPort, p.Name)
+		}
+		if c.Config().HLSBaseURL != "" {
+			out.RTMP.HLSURL = fmt.Sprintf("%s/%s.m3u8", c.Config().HLSBaseURL, url.PathEscape(p.Name))
+		}
+	}
+	for _, l := range p.Links {
+		if !l.IsLive() {
+			continue
+		}
+		s := PublicStream{
+			Provider: l.Provider,
+			Account:  l.Account,
+			Title:    l.StreamInfo.Title,
+			Game:     l.StreamInfo.GameName,
+			Viewers:  c.viewerCount(p.Name, l.Provider, l.Account),
+		}
+		if sp, ok := c.provider(l.Provider); ok {
+			s.URL = sp.StreamURL(l.Account)
+		}
+		out.Streams = append(out.Streams, s)
+	}
+	return out
+}
+
+// setPublicHeaders allows cross-origin requests & caching of public responses
+func setPublicHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "If-None-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "ETag")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", publicMaxAge))
+}
+
+// PublicLiveHandler is the http handler for "/public/live". Currently live
+// publishers which have not opted out with the unlisted flag are returned
+// with their watch links.
+func (c *Controller) PublicLiveHandler(w http.ResponseWriter, r *http.Request) {
+	setPublicHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	live := true
+	publishers, _, err := c.Store.QueryPublishers(store.PublisherQuery{Live: &live})
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	out := []PublicPublisher{}
+	for i := range publishers {
+		if publishers[i].Unlisted {
+			continue
+		}
+		out = append(out, c.publicPublisher(&publishers[i]))
+	}
+	content, err := json.Marshal(out)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	sum := sha256.Sum256(content)
+	if notModified(w, r, fmt.Sprintf("\"%x\"", sum[:8])) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(content)
+}
+
+// badgeTextWidth approximates the rendered width of badge text in pixels
+func badgeTextWidth(s string) int {
+	return len([]rune(s))*7 + 10
+}
+
+// renderBadge returns an svg status badge with the label & status
+func renderBadge(label, status, color string) string {
+	lw, sw := badgeTextWidth(label), badgeTextWidth(status)
+	label, status = html.EscapeString(label), html.EscapeString(status)
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">`+
+		`<title>%[4]s: %[5]s</title>`+
+		`<rect width="%[2]d" height="20" fill="#555"/>`+
+		`<rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/>`+
+		`<g fill="#fff" text-anchor="middle" font-family="Verdana,DejaVu Sans,sans-serif" font-size="11">`+
+		`<text x="%[7]d" y="14">%[4]s</text>`+
+		`<text x="%[8]d" y="14">%[5]s</text>`+
+		`</g></svg>`,
+		lw+sw, lw, sw, label, status, color, lw/2, lw+sw/2)
+}
+
+// PublicBadgeHandler is the http handler for "/public/badge/{name}.svg".
+// An embeddable LIVE/OFFLINE badge of a listed publisher is returned.
+func (c *Controller) PublicBadgeHandler(w http.ResponseWriter, r *http.Request) {
+	setPublicHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	name, ok := strings.CutSuffix(r.PathValue("badge"), ".svg")
+	if !ok {
+		NotFoundHandler(w, r)
+		return
+	}
+	p, err := c.Store.GetPublisher(name)
+	if err == nil && p.Unlisted {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		writeJSONError(w, publisherError(name, err))
+		return
+	}
+	status, color := "OFFLINE", "#9f9f9f"
+	if p.IsLive() {
+		status, color = "LIVE", "#e05d44"
+	}
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Write([]byte(renderBadge(p.Name, status, color)))
+}
+
+// listedEvent returns true if the publisher of an event exists and has not
+// opted out with the unlisted flag
+func (c *Controller) listedEvent(e Event) bool {
+	p, err := c.Store.GetPublisher(e.Publisher)
+	return err == nil && !p.Unlisted
+}
+
+// PublicEventsHandler is the http handler for "/public/events". The events of
+// publishers which are not unlisted are streamed as Server-Sent Events.
+func (c *Controller) PublicEventsHandler(w http.ResponseWriter, r *http.Request) {
+	setPublicHeaders(w)
+	w.Header().Set("Access-Control-Allow-Headers", "Last-Event-ID")
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	c.streamEvents(w, r, c.listedEvent)
+}
+
+// PublicEventsWebSocketHandler is the http handler for "/public/events/ws".
+// The events of publishers which are not unlisted are sent over a WebSocket.
+func (c *Controller) PublicEventsWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	c.streamEventsWebSocket(w, r, c.listedEvent)
+}
@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+func TestPublicEventsHandler(t *testing.T) {
+	c := newTestController(t, nil)
+	for _, name := range []string{"alice", "bob"} {
+		_, err := c.Store.UpsertPublisher(name, func(p *models.Publisher) error {
+			p.Key = name + "key"
+			p.Unlisted = name == "bob"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		c.emit(Event{Type: EventPublishStart, Publisher: name})
+	}
+
+	// the buffered events are replayed until the client disconnects
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	c.PublicEventsHandler(w, httptest.NewRequest("GET", "/public/events", nil).WithContext(ctx))
+	body := w.Body.String()
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("expected a cross-origin event stream, got %v", w.Header())
+	}
+	if !strings.Contains(body, `"publisher":"alice"`) {
+		t.Errorf("expected the events of alice, got %q", body)
+	}
+	if strings.Contains(body, `"publisher":"bob"`) || strings.Contains(body, `"publisher":"carol"`) {
+		t.Errorf("expected the events of unlisted & unknown publishers to be left out, got %q", body)
+	}
+}
@@ -1,183 +1,376 @@
 package controllers
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
 	log "github.com/sirupsen/logrus"
-	bolt "go.etcd.io/bbolt"
 )
 
-// Publisher struct contains rtmp stream name, stream key, twitch channel name
-type Publisher struct {
-	Name               string `json:"name"`
-	Key                string `json:"key"`
-	RTMPLive           string `json:"rtmp_live"`
-	TwitchStream       string `json:"twitch_stream"`
-	TwitchLive         string `json:"twitch_live"`
-	TwitchNotification string `json:"-"`
-	StreamInfo         string `json:"-"`
-}
-
-// IsValid perform basic validations on a publisher record
-func (p *Publisher) IsValid() error {
-	var err error
-	if len(p.Name) < 1 {
-		err = errors.New("missing parameter: name")
-		return err
-	}
-	if len(p.Key) < 1 {
-		err = errors.New("missing parameter: key")
-		return err
+// setPrimaryLink replaces the account of the first link to a provider or
+// prepends a new link if the publisher has no accounts on the provider
+func setPrimaryLink(links []models.StreamLink, provider, account string) []models.StreamLink {
+	for i := range links {
+		if links[i].Provider == provider {
+			links[i] = models.StreamLink{Provider: provider, Account: account}
+			return links
+		}
 	}
-	return nil
+	return append([]models.StreamLink{{Provider: provider, Account: account}}, links...)
 }
 
-// IsTwitchLive returns a boolean based on string value of TwitchLive field
-func (p *Publisher) IsTwitchLive() bool {
-	if p.TwitchLive != "" {
-		return true
+// removePrimaryLink removes the first link to a provider
+func removePrimaryLink(links []models.StreamLink, provider string) []models.StreamLink {
+	for i := range links {
+		if links[i].Provider == provider {
+			return append(links[:i:i], links[i+1:]...)
+		}
 	}
-	return false
+	return links
 }
 
 // FetchPublisher populates the publisher struct from the database
-func (c *Controller) FetchPublisher(p *Publisher) error {
-	var b []byte
-	var err error
-	b, err = c.getBucketValue("RTMPLiveBucket", p.Name)
-	if err != nil {
-		return err
-	}
-	p.RTMPLive = string(b)
-	b, err = c.getBucketValue("TwitchStreamBucket", p.Name)
-	if err != nil {
-		return err
-	}
-	p.TwitchStream = string(b)
-	b, err = c.getBucketValue("TwitchLiveBucket", p.Name)
-	if err != nil {
-		return err
-	}
-	p.TwitchLive = string(b)
-	b, err = c.getBucketValue("TwitchNotificationBucket", p.Name)
+func (c *Controller) FetchPublisher(p *models.Publisher) error {
+	record, err := c.Store.GetPublisher(p.Name)
 	if err != nil {
 		return err
 	}
-	p.TwitchNotification = string(b)
-	b, err = c.getBucketValue("StreamInfoBucket", p.Name)
-	if err != nil {
-		return err
-	}
-	p.StreamInfo = string(b)
-
+	*p = record
 	return nil
 }
 
-func (c *Controller) getAllPublisher() ([]Publisher, error) {
-	var err error
-	publishers := []Publisher{}
-	c.DB.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("PublisherBucket"))
-		c := b.Cursor()
-		for k, v := c.First(); k != nil; k, v = c.Next() {
-			var p Publisher
-			p.Name = string(k)
-			p.Key = string(v)
-			publishers = append(publishers, p)
+func (c *Controller) getAllPublisher() ([]models.Publisher, error) {
+	return c.Store.ListPublishers()
+}
+
+func (c *Controller) getPublisher(name string) (models.Publisher, error) {
+	p := models.Publisher{Name: name}
+	err := c.FetchPublisher(&p)
+	return p, err
+}
+
+// mergeLinks returns the updated links, retaining the state of accounts
+// which were already linked
+func mergeLinks(existing, updated []models.StreamLink) []models.StreamLink {
+	merged := []models.StreamLink{}
+	for i := range updated {
+		l := updated[i]
+		for x := range existing {
+			if existing[x].Provider == l.Provider && existing[x].Account == l.Account {
+				l.LinkState = existing[x].LinkState
+				break
+			}
 		}
-		return nil
-	})
+		merged = append(merged, l)
+	}
+	return merged
+}
+
+// precondition is checked against the stored publisher before it is
+// modified, exists is false if the publisher is about to be created
+type precondition func(p *models.Publisher, exists bool) error
 
-	for i := range publishers {
-		p := &publishers[i]
-		err = c.FetchPublisher(p)
+// updatePublisher creates or updates a publisher of the legacy api. The
+// stream links are only updated if links or a twitch stream are provided,
+// which are merged with the stored links within the update transaction.
+func (c *Controller) updatePublisher(p models.Publisher, check precondition) (models.Publisher, error) {
+	var (
+		updated models.Publisher
+		links   []models.StreamLink
+		twitch  string
+		err     error
+	)
+	if p.Links != nil {
+		links, err = c.resolveLinks(p.Links)
+		if err != nil {
+			return updated, err
+		}
+	}
+	if p.TwitchStream != "" {
+		resolved, err := c.resolveLinks([]models.StreamLink{{Provider: "twitch", Account: p.TwitchStream}})
 		if err != nil {
-			return nil, err
+			return updated, err
 		}
+		twitch = resolved[0].Account
 	}
 
-	return publishers, nil
+	return c.Store.UpsertPublisher(p.Name, func(record *models.Publisher) error {
+		err := check(record, record.Key != "")
+		if err != nil {
+			return err
+		}
+		record.Key = p.Key
+		if p.Links == nil && twitch == "" {
+			return nil
+		}
+		updatedLinks := append([]models.StreamLink{}, record.Links...)
+		if p.Links != nil {
+			updatedLinks = links
+		}
+		if twitch != "" {
+			updatedLinks = setPrimaryLink(updatedLinks, "twitch", twitch)
+		}
+		record.Links = mergeLinks(record.Links, updatedLinks)
+		return nil
+	})
 }
 
-func (c *Controller) getPublisher(name string) (Publisher, error) {
-	var keyBytes []byte
-	var err error
-
-	p := Publisher{}
+// publisherPatch contains the changes of a publisher update. Nil fields are
+// left unchanged.
+type publisherPatch struct {
+	Key          *string
+	TwitchStream *string
+	Links        *[]models.StreamLink
+	Unlisted     *bool
+	DiscordID    *string
+	Muted        *[]string
+}
 
-	keyBytes, err = c.getBucketValue("PublisherBucket", name)
+// parsePublisherPatch decodes a JSON Merge Patch (RFC 7396) of a publisher.
+// An explicit null clears twitch_stream & links while read-only fields are
+// ignored.
+func parsePublisherPatch(name string, body []byte) (publisherPatch, error) {
+	var patch publisherPatch
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(body, &fields)
 	if err != nil {
-		return p, err
+		return patch, invalidf("invalid merge patch: %s", err)
 	}
-	p.Key = string(keyBytes)
-
-	if len(p.Key) < 1 {
-		return p, errors.New("publisher not found")
+	empty := ""
+	for field, raw := range fields {
+		null := string(raw) == "null"
+		switch field {
+		case "name":
+			var n string
+			if null || json.Unmarshal(raw, &n) != nil || n != name {
+				return patch, invalidf("name does not match publisher '%s'", name)
+			}
+		case "key":
+			var key string
+			if null || json.Unmarshal(raw, &key) != nil || key == "" {
+				return patch, invalidf("key must be a non-empty string")
+			}
+			patch.Key = &key
+		case "twitch_stream":
+			patch.TwitchStream = &empty
+			if !null && json.Unmarshal(raw, patch.TwitchStream) != nil {
+				return patch, invalidf("twitch_stream must be a string or null")
+			}
+		case "links":
+			links := []models.StreamLink{}
+			if !null && json.Unmarshal(raw, &links) != nil {
+				return patch, invalidf("links must be an array of stream links or null")
+			}
+			patch.Links = &links
+		case "unlisted":
+			var unlisted bool
+			if null || json.Unmarshal(raw, &unlisted) != nil {
+				return patch, invalidf("unlisted must be a boolean")
+			}
+			patch.Unlisted = &unlisted
+		case "discord_id":
+			patch.DiscordID = &empty
+			if !null && json.Unmarshal(raw, patch.DiscordID) != nil {
+				return patch, invalidf("discord_id must be a string or null")
+			}
+		case "muted":
+			muted := []string{}
+			if !null && json.Unmarshal(raw, &muted) != nil {
+				return patch, invalidf("muted must be an array of notification kinds or null")
+			}
+			muted, err = normalizeMuted(muted)
+			if err != nil {
+				return patch, err
+			}
+			patch.Muted = &muted
+		case "rtmp_live", "twitch_live", "revision":
+			// live status is maintained by the server
+		default:
+			return patch, invalidf("unknown field: %s", field)
+		}
 	}
+	return patch, nil
+}
 
-	err = c.FetchPublisher(&p)
-	if err != nil {
-		return p, err
+// replace turns the patch into a full replacement of a publisher, which
+// resets all omitted fields. A key is required.
+func (patch *publisherPatch) replace() error {
+	if patch.Key == nil {
+		return invalidf("missing parameter: key")
 	}
-
-	return p, nil
+	if patch.Links == nil {
+		patch.Links = &[]models.StreamLink{}
+	}
+	if patch.Unlisted == nil {
+		patch.Unlisted = new(bool)
+	}
+	if patch.DiscordID == nil {
+		patch.DiscordID = new(string)
+	}
+	if patch.Muted == nil {
+		patch.Muted = &[]string{}
+	}
+	return nil
 }
 
-func (c *Controller) updatePublisher(p Publisher) error {
-	var err error
-	c.DB.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("PublisherBucket"))
-		err = b.Put([]byte(p.Name), []byte(p.Key))
-		return err
-	})
-
-	// debug only. live status is managed internally
-	// c.DB.Update(func(tx *bolt.Tx) error {
-	// 	b := tx.Bucket([]byte("RTMPLiveBucket"))
-	// 	err = b.Put([]byte(p.Name), []byte(p.LocalLive))
-	// 	return err
-	// })
+// applyPublisherPatch applies the changes to a publisher in a single
+// transaction and returns the updated publisher. The publisher is created if
+// create is set, in which case a key is required. Accounts are resolved with
+// the providers before the transaction is started.
+func (c *Controller) applyPublisherPatch(name string, patch publisherPatch, create bool, check precondition) (models.Publisher, bool, error) {
+	var (
+		updated models.Publisher
+		created bool
+		links   []models.StreamLink
+		twitch  string
+		err     error
+	)
+	if patch.Links != nil {
+		links, err = c.resolveLinks(*patch.Links)
+		if err != nil {
+			return updated, false, err
+		}
+	}
+	if patch.TwitchStream != nil && *patch.TwitchStream != "" {
+		resolved, err := c.resolveLinks([]models.StreamLink{{Provider: "twitch", Account: *patch.TwitchStream}})
+		if err != nil {
+			return updated, false, err
+		}
+		twitch = resolved[0].Account
+	}
 
-	if p.TwitchStream != "" {
-		// only update the stream if a value is provided
-		c.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte("TwitchStreamBucket"))
-			err = b.Put([]byte(p.Name), []byte(p.TwitchStream))
+	fn := func(p *models.Publisher) error {
+		created = p.Key == ""
+		err := check(p, !created)
+		if err != nil {
 			return err
-		})
+		}
+		if patch.Key != nil {
+			p.Key = *patch.Key
+		}
+		if patch.Unlisted != nil {
+			p.Unlisted = *patch.Unlisted
+		}
+		if patch.DiscordID != nil {
+			p.DiscordID = *patch.DiscordID
+		}
+		if patch.Muted != nil {
+			p.Muted = *patch.Muted
+		}
+		updatedLinks := append([]models.StreamLink{}, p.Links...)
+		if patch.Links != nil {
+			updatedLinks = links
+		}
+		if patch.TwitchStream != nil {
+			if twitch == "" {
+				updatedLinks = removePrimaryLink(updatedLinks, "twitch")
+			} else {
+				updatedLinks = setPrimaryLink(updatedLinks, "twitch", twitch)
+			}
+		}
+		p.Links = mergeLinks(p.Links, updatedLinks)
+		for i := range p.Links {
+			p.Links[i].Normalize()
+		}
+		err = p.IsValid()
+		if err != nil {
+			return invalidf("%s", err)
+		}
+		return nil
 	}
 
-	// debug only. live status is managed internally
-	// c.DB.Update(func(tx *bolt.Tx) error {
-	// 	b := tx.Bucket([]byte("TwitchLiveBucket"))
-	// 	err = b.Put([]byte(p.Name), []byte(p.TwitchLive))
-	// 	return err
-	// })
+	if create {
+		updated, err = c.Store.UpsertPublisher(name, fn)
+	} else {
+		updated, err = c.Store.UpdatePublisher(name, fn)
+	}
+	var taken *store.DiscordIDTakenError
+	if errors.As(err, &taken) {
+		err = invalidf("discord_id is already linked to publisher '%s'", taken.Publisher)
+	}
+	return updated, created, err
+}
 
-	return nil
+// normalizeMuted validates muted notification kinds & removes duplicates
+func normalizeMuted(muted []string) ([]string, error) {
+	known := make(map[string]bool)
+	for _, kind := range models.NotificationKinds {
+		known[kind] = true
+	}
+	seen := make(map[string]bool)
+	normalized := []string{}
+	for _, kind := range muted {
+		if !known[kind] {
+			return nil, invalidf("unknown notification kind '%s', expected one of: %s", kind, strings.Join(models.NotificationKinds, ", "))
+		}
+		if !seen[kind] {
+			seen[kind] = true
+			normalized = append(normalized, kind)
+		}
+	}
+	return normalized, nil
 }
 
-func (c *Controller) deletePublisher(name string) error {
+func (c *Controller) deletePublisher(name string, check precondition) error {
 	log.Debug("deleting ", name)
-	buckets := []string{
-		"PublisherBucket",
-		"RTMPLiveBucket",
-		"TwitchStreamBucket",
-		"TwitchLiveBucket",
-		"TwitchNotificationBucket",
-	}
-	for i := range buckets {
-		c.DB.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(buckets[i]))
-			err := b.Delete([]byte(name))
-			return err
-		})
-	}
+	return c.Store.DeletePublisher(name, func(p *models.Publisher) error {
+		return check(p, true)
+	})
+}
+
+// anyRevision is the precondition of modifications without an expected
+// revision
+func anyRevision(p *models.Publisher, exists bool) error {
 	return nil
 }
 
+// CreatePublisher creates a publisher with the key, or a random key if the
+// key is empty, and an optional twitch stream
+func (c *Controller) CreatePublisher(name, key, twitch string) (models.Publisher, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return models.Publisher{}, invalidf("name must be a non-empty string without slashes")
+	}
+	if key == "" {
+		var err error
+		key, err = generateKey()
+		if err != nil {
+			return models.Publisher{}, err
+		}
+	}
+	patch := publisherPatch{Key: &key}
+	if twitch != "" {
+		patch.TwitchStream = &twitch
+	}
+	p, _, err := c.applyPublisherPatch(name, patch, true, func(p *models.Publisher, exists bool) error {
+		if exists {
+			return errConflict
+		}
+		return nil
+	})
+	return p, err
+}
+
+// RotateKey replaces the key of a publisher with a new random key
+func (c *Controller) RotateKey(name string) (models.Publisher, error) {
+	key, err := generateKey()
+	if err != nil {
+		return models.Publisher{}, err
+	}
+	p, _, err := c.applyPublisherPatch(name, publisherPatch{Key: &key}, false, anyRevision)
+	return p, publisherError(name, err)
+}
+
+// DeletePublisher removes a publisher
+func (c *Controller) DeletePublisher(name string) error {
+	return publisherError(name, c.deletePublisher(name, anyRevision))
+}
+
 // OnPublishHandler is the http handler for "/on_publish".
 func (c *Controller) OnPublishHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -186,27 +379,43 @@ func (c *Controller) OnPublishHandler(w http.ResponseWriter, r *http.Request) {
 	p, err := c.getPublisher(streamName)
 	if err != nil {
 		log.Warnf("on_publish unauthorized: %s", err)
+		callbackOutcome("on_publish", false)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	if streamKey != p.Key {
 		log.Warnf("on_publish unauthorized: %s with 'key': %s", p.Name, streamKey)
+		callbackOutcome("on_publish", false)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	log.Printf("on_publish authorized: %s", p.Name)
+	callbackOutcome("on_publish", true)
 
-	serverFQDN := c.Config.RTMPServerFQDN
-	serverPort := c.Config.RTMPServerPort
+	serverFQDN := c.Config().RTMPServerFQDN
+	serverPort := c.Config().RTMPServerPort
 
-	err = c.setBucketValue("RTMPLiveBucket", p.Name, "live")
+	_, err = c.Store.UpdatePublisher(p.Name, func(p *models.Publisher) error {
+		p.RTMPLive = "live"
+		return nil
+	})
 	if err != nil {
 		log.Error("error enabling local live status")
 	}
 
-	if c.Config.DiscordEnabled && (serverFQDN != "") {
+	_, err = c.Store.StartSession(models.Session{
+		Publisher: p.Name,
+		Provider:  models.SessionProviderRTMP,
+		StartedAt: time.Now(),
+	})
+	if err != nil {
+		log.Error("error recording session start: ", err)
+	}
+	c.emit(Event{Type: EventPublishStart, Publisher: p.Name})
+
+	if c.Config().DiscordEnabled && (serverFQDN != "") && !p.IsMuted(models.NotifyStream) {
 		content := fmt.Sprintf(":movie_camera: %s started a private stream!\nwatch now: `rtmp://%s:%s/stream/%s`", streamName, serverFQDN, serverPort, streamName)
-		err := c.callWebhook(content)
+		err := c.callWebhook(r.Context(), content)
 		if err != nil {
 			log.Error(err)
 		}
@@ -223,24 +432,39 @@ func (c *Controller) OnPublishDoneHandler(w http.ResponseWriter, r *http.Request
 	p, err := c.getPublisher(streamName)
 	if err != nil {
 		log.Warnf("on_publish_done unauthorized: %s", p.Name)
+		callbackOutcome("on_publish_done", false)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	if streamKey != p.Key {
 		log.Warnf("on_publish_done unauthorized: %s with key: %s", p.Name, p.Key)
+		callbackOutcome("on_publish_done", false)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 	log.Printf("on_publish_done authorized: %s", p.Name)
+	callbackOutcome("on_publish_done", true)
 
-	err = c.setBucketValue("RTMPLiveBucket", p.Name, "")
+	_, err = c.Store.UpdatePublisher(p.Name, func(p *models.Publisher) error {
+		p.RTMPLive = ""
+		return nil
+	})
 	if err != nil {
 		log.Error("error disabling local live status")
 	}
 
-	if c.Config.DiscordEnabled {
+	err = c.Store.EndSession(p.Name, models.SessionProviderRTMP, "", time.Now())
+	if err != nil {
+		log.Error("error recording session end: ", err)
+	}
+	if c.Events != nil {
+		c.Events.resetViewers(viewerKey(p.Name, "", ""))
+	}
+	c.emit(Event{Type: EventPublishStop, Publisher: p.Name})
+
+	if c.Config().DiscordEnabled && !p.IsMuted(models.NotifyStream) {
 		content := fmt.Sprintf(":checkered_flag:  %s finished streaming.", streamName)
-		err := c.callWebhook(content)
+		err := c.callWebhook(r.Context(), content)
 		if err != nil {
 			log.Error(err)
 		}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+)
+
+// racingStore runs a concurrent write before each upsert
+type racingStore struct {
+	store.Store
+	race func()
+}
+
+func (s *racingStore) UpsertPublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	if s.race != nil {
+		s.race()
+		s.race = nil
+	}
+	return s.Store.UpsertPublisher(name, fn)
+}
+
+func TestUpdatePublisherConcurrentLinks(t *testing.T) {
+	c := newTestController(t, nil)
+	_, err := c.Store.UpsertPublisher("alice", func(p *models.Publisher) error {
+		p.Key = "alicekey"
+		p.Links = []models.StreamLink{{Provider: "twitch", Account: "alice_old"}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &racingStore{Store: c.Store}
+	rs.race = func() {
+		_, err := c.Store.UpdatePublisher("alice", func(p *models.Publisher) error {
+			p.Links = append(p.Links, models.StreamLink{Provider: "owncast", Account: "https://owncast.example.com"})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Store = rs
+
+	p, err := c.updatePublisher(models.Publisher{Name: "alice", Key: "newkey", TwitchStream: "alice"}, anyRevision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != "newkey" || len(p.Links) != 2 || p.Links[0].Account != "alice" || p.Links[1].Provider != "owncast" {
+		t.Errorf("expected the concurrently added link to be kept, got %+v", p.Links)
+	}
+}
+
+func TestApplyPublisherPatchDiscordID(t *testing.T) {
+	c := newTestController(t, nil)
+	key, id := "alicekey", "1234"
+	_, _, err := c.applyPublisherPatch("alice", publisherPatch{Key: &key, DiscordID: &id}, true, anyRevision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = "bobkey"
+	_, _, err = c.applyPublisherPatch("bob", publisherPatch{Key: &key, DiscordID: &id}, true, anyRevision)
+	status, _ := errorStatus(err)
+	if status != http.StatusBadRequest || err.Error() != "discord_id is already linked to publisher 'alice'" {
+		t.Errorf("expected the linked discord user to be rejected, got %d %v", status, err)
+	}
+	if _, err = c.Store.GetPublisher("bob"); err != store.ErrNotFound {
+		t.Errorf("expected bob not to be created, got %v", err)
+	}
+}
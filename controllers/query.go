@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
+)
+
+const (
+	// defaultPageLimit is the page size of versioned publisher listings
+	defaultPageLimit = 100
+	// maxPageLimit is the largest page size which may be requested
+	maxPageLimit = 1000
+)
+
+// encodeCursor returns the opaque pagination cursor continuing after name
+func encodeCursor(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// decodeCursor returns the name encoded in a pagination cursor
+func decodeCursor(cursor string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", invalidf("invalid cursor")
+	}
+	return string(name), nil
+}
+
+// parseBoolFilter parses an optional boolean query parameter
+func parseBoolFilter(r *http.Request, param string) (*bool, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, invalidf("%s must be true or false", param)
+	}
+	return &b, nil
+}
+
+// parsePublisherQuery parses the pagination, filter & sort query parameters
+// of a publisher listing. The limit defaults to defaultLimit, 0 for no limit.
+func parsePublisherQuery(r *http.Request, defaultLimit int) (store.PublisherQuery, error) {
+	params := r.URL.Query()
+	q := store.PublisherQuery{Prefix: params.Get("prefix"), Limit: defaultLimit}
+
+	var err error
+	if limit := params.Get("limit"); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 1 || q.Limit > maxPageLimit {
+			return q, invalidf("limit must be between 1 and %d", maxPageLimit)
+		}
+	}
+	if cursor := params.Get("cursor"); cursor != "" {
+		q.After, err = decodeCursor(cursor)
+		if err != nil {
+			return q, err
+		}
+	}
+	switch params.Get("sort") {
+	case "", "name":
+	case "-name":
+		q.Descending = true
+	default:
+		return q, invalidf("sort must be name or -name")
+	}
+	q.Live, err = parseBoolFilter(r, "live")
+	if err != nil {
+		return q, err
+	}
+	q.TwitchLive, err = parseBoolFilter(r, "twitch_live")
+	if err != nil {
+		return q, err
+	}
+	q.HasTwitch, err = parseBoolFilter(r, "has_twitch")
+	return q, err
+}
+
+// queryPublishers returns the page of publishers requested by the query
+// parameters and sets the Link & X-Next-Cursor headers of the next page
+func (c *Controller) queryPublishers(w http.ResponseWriter, r *http.Request, defaultLimit int) ([]models.Publisher, error) {
+	q, err := parsePublisherQuery(r, defaultLimit)
+	if err != nil {
+		return nil, err
+	}
+	publishers, next, err := c.Store.QueryPublishers(q)
+	if err != nil {
+		return nil, err
+	}
+	if next != "" {
+		cursor := encodeCursor(next)
+		u := *r.URL
+		params := u.Query()
+		params.Set("cursor", cursor)
+		if params.Get("limit") == "" {
+			params.Set("limit", strconv.Itoa(q.Limit))
+		}
+		u.RawQuery = params.Encode()
+		w.Header().Set("Link", "<"+u.RequestURI()+">; rel=\"next\"")
+		w.Header().Set("X-Next-Cursor", cursor)
+	}
+	return publishers, nil
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReloadHandler is the http handler for "/api/admin/reload". The
+// configuration is re-read and applied without restarting, an invalid
+// configuration is rejected and the current configuration is kept.
+func (c *Controller) ReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if c.Reload == nil {
+		writeAPIError(w, http.StatusNotImplemented, "not_implemented", "configuration reload is not supported")
+		return
+	}
+	err := c.Reload()
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_configuration", strings.Join(invalid.Problems, "; "))
+		return
+	}
+	if err != nil {
+		log.Error("error reloading configuration: ", err)
+		writeAPIError(w, http.StatusInternalServerError, "reload_failed", err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
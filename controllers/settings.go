@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+	"github.com/bcambl/rtmpauthbot/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// settingsKey is the config key of the runtime settings overriding the
+	// configuration
+	settingsKey = "runtime_settings"
+	// settingsAuditKey is the config key of the runtime settings changes
+	settingsAuditKey = "runtime_settings_audit"
+	// settingsAuditSize is the number of settings changes kept
+	settingsAuditSize = 100
+)
+
+// runtimeSetting is a setting which may be changed through the api
+type runtimeSetting struct {
+	// Field is the json field of the settings api
+	Field string
+	// Key is the config file key of the setting
+	Key string
+	// Kind is the json type of the value: bool, string or int
+	Kind string
+}
+
+// runtimeSettings lists the settings which may be changed through the api
+var runtimeSettings = []runtimeSetting{
+	{Field: "discord_enabled", Key: "discord.enabled", Kind: "bool"},
+	{Field: "discord_webhook", Key: "discord.webhook", Kind: "string"},
+	{Field: "rtmp_server_fqdn", Key: "rtmp.fqdn", Kind: "string"},
+	{Field: "twitch_enabled", Key: "twitch.enabled", Kind: "bool"},
+	{Field: "twitch_poll_rate", Key: "twitch.poll_rate", Kind: "int"},
+	{Field: "owncast_enabled", Key: "owncast.enabled", Kind: "bool"},
+	{Field: "owncast_poll_rate", Key: "owncast.poll_rate", Kind: "int"},
+	{Field: "peertube_enabled", Key: "peertube.enabled", Kind: "bool"},
+	{Field: "peertube_poll_rate", Key: "peertube.poll_rate", Kind: "int"},
+}
+
+// Settings is the body of the settings api. Poll rates are in seconds and the
+// discord webhook is masked.
+type Settings struct {
+	DiscordEnabled   bool   `json:"discord_enabled"`
+	DiscordWebhook   string `json:"discord_webhook"`
+	RTMPServerFQDN   string `json:"rtmp_server_fqdn"`
+	TwitchEnabled    bool   `json:"twitch_enabled"`
+	TwitchPollRate   int    `json:"twitch_poll_rate"`
+	OwncastEnabled   bool   `json:"owncast_enabled"`
+	OwncastPollRate  int    `json:"owncast_poll_rate"`
+	PeerTubeEnabled  bool   `json:"peertube_enabled"`
+	PeerTubePollRate int    `json:"peertube_poll_rate"`
+	// Overridden lists the fields stored in the database, the other fields
+	// are read from the configuration
+	Overridden []string `json:"overridden"`
+	// Pinned lists the fields set by -set flags, which can not be changed
+	Pinned []string `json:"pinned"`
+}
+
+// SettingsChange is an audited change of a runtime setting
+type SettingsChange struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Remote string    `json:"remote"`
+	Field  string    `json:"field"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+}
+
+// storedSettings returns the runtime settings stored in the database by
+// config file key
+func (c *Controller) storedSettings() (map[string]string, error) {
+	overrides := make(map[string]string)
+	value, err := c.Store.GetConfig(settingsKey)
+	if err == store.ErrNotFound {
+		return overrides, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(value), &overrides)
+	if err != nil {
+		return nil, err
+	}
+	return overrides, nil
+}
+
+// unpinned returns the stored runtime settings which are not set by -set
+// flags, the command line takes precedence over the database
+func unpinned(conf *config.Config, overrides map[string]string) map[string]string {
+	applied := make(map[string]string, len(overrides))
+	for key, value := range overrides {
+		if !conf.Pinned(key) {
+			applied[key] = value
+		}
+	}
+	return applied
+}
+
+// withSettings returns the configuration with the stored runtime settings
+// applied
+func (c *Controller) withSettings(conf *config.Config) (*config.Config, error) {
+	if c.Store == nil {
+		return conf, nil
+	}
+	overrides, err := c.storedSettings()
+	if err != nil {
+		return nil, err
+	}
+	return conf.With(unpinned(conf, overrides))
+}
+
+// ApplyConfig validates the configuration with the stored runtime settings
+// applied and makes it the current configuration. An invalid configuration
+// is rejected and the current configuration is kept.
+func (c *Controller) ApplyConfig(conf *config.Config) error {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	effective, err := c.withSettings(conf)
+	if err != nil {
+		return err
+	}
+	err = effective.Validate()
+	if err != nil {
+		return err
+	}
+	c.base = conf
+	c.config.Store(effective)
+	return nil
+}
+
+// currentSettings returns the runtime settings of the current configuration
+func (c *Controller) currentSettings() (Settings, error) {
+	conf := c.Config()
+	s := Settings{
+		DiscordEnabled:   conf.DiscordEnabled,
+		DiscordWebhook:   maskValue("discord.webhook", conf.DiscordWebhook),
+		RTMPServerFQDN:   conf.RTMPServerFQDN,
+		TwitchEnabled:    conf.TwitchEnabled,
+		TwitchPollRate:   int(conf.TwitchPollRate / time.Second),
+		OwncastEnabled:   conf.OwncastEnabled,
+		OwncastPollRate:  int(conf.OwncastPollRate / time.Second),
+		PeerTubeEnabled:  conf.PeerTubeEnabled,
+		PeerTubePollRate: int(conf.PeerTubePollRate / time.Second),
+		Overridden:       []string{},
+		Pinned:           []string{},
+	}
+	overrides, err := c.storedSettings()
+	if err != nil {
+		return s, err
+	}
+	for _, rs := range runtimeSettings {
+		if conf.Pinned(rs.Key) {
+			s.Pinned = append(s.Pinned, rs.Field)
+		} else if _, ok := overrides[rs.Key]; ok {
+			s.Overridden = append(s.Overridden, rs.Field)
+		}
+	}
+	return s, nil
+}
+
+// settingValue converts a json value of a runtime setting to its raw
+// configuration value
+func settingValue(rs runtimeSetting, raw json.RawMessage) (string, error) {
+	switch rs.Kind {
+	case "bool":
+		var b bool
+		if json.Unmarshal(raw, &b) != nil {
+			return "", invalidf("%s: expected a boolean", rs.Field)
+		}
+		return strconv.FormatBool(b), nil
+	case "int":
+		var n int
+		if json.Unmarshal(raw, &n) != nil {
+			return "", invalidf("%s: expected a number of seconds", rs.Field)
+		}
+		return strconv.Itoa(n), nil
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return "", invalidf("%s: expected a string", rs.Field)
+	}
+	return strings.TrimSpace(s), nil
+}
+
+// sameValue returns true if two values of a setting are equal
+func sameValue(rs runtimeSetting, a, b string) bool {
+	switch rs.Kind {
+	case "bool":
+		x, errX := strconv.ParseBool(a)
+		y, errY := strconv.ParseBool(b)
+		return errX == nil && errY == nil && x == y
+	case "int":
+		x, errX := strconv.Atoi(a)
+		y, errY := strconv.Atoi(strings.TrimSpace(b))
+		return errX == nil && errY == nil && x == y
+	}
+	return a == strings.TrimSpace(b)
+}
+
+// maskValue returns the value of a setting with secrets masked
+func maskValue(key, value string) string {
+	if value != "" && config.IsSecret(key) {
+		return config.MaskedSecret
+	}
+	return value
+}
+
+// updateSettings stores the runtime settings of the json body and applies
+// them to the current configuration. Fields which are omitted or set to the
+// masked value keep their value, null or the configured value removes the
+// stored setting, so settings read may be sent back unchanged. Fields set by
+// -set flags can not be changed.
+func (c *Controller) updateSettings(r *http.Request) error {
+	var body map[string]json.RawMessage
+	err := decodeBody(r, &body)
+	if err != nil {
+		return err
+	}
+
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+	overrides, err := c.storedSettings()
+	if err != nil {
+		return err
+	}
+	base := c.base
+	if base == nil {
+		base = c.Config()
+	}
+	for field, raw := range body {
+		if field == "overridden" || field == "pinned" {
+			continue
+		}
+		var rs runtimeSetting
+		for i := range runtimeSettings {
+			if runtimeSettings[i].Field == field {
+				rs = runtimeSettings[i]
+			}
+		}
+		if rs.Field == "" {
+			return invalidf("unknown setting: %s", field)
+		}
+		if string(raw) == "null" {
+			delete(overrides, rs.Key)
+			continue
+		}
+		value, err := settingValue(rs, raw)
+		if err != nil {
+			return err
+		}
+		if value == config.MaskedSecret && config.IsSecret(rs.Key) {
+			continue
+		}
+		if sameValue(rs, value, base.Value(rs.Key)) {
+			// settings sent back unchanged keep following the configuration
+			delete(overrides, rs.Key)
+			continue
+		}
+		if base.Pinned(rs.Key) {
+			return invalidf("%s is set by a -set flag and can not be changed", field)
+		}
+		overrides[rs.Key] = value
+	}
+
+	effective, err := base.With(unpinned(base, overrides))
+	if err != nil {
+		return err
+	}
+	err = effective.Validate()
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		return invalidf("invalid settings: %s", strings.Join(invalid.Problems, "; "))
+	}
+	if err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	err = c.Store.SetConfig(settingsKey, string(value))
+	if err != nil {
+		return err
+	}
+	previous := c.Config()
+	c.config.Store(effective)
+
+	var changes []SettingsChange
+	now := time.Now().UTC()
+	for _, rs := range runtimeSettings {
+		old, current := previous.Value(rs.Key), effective.Value(rs.Key)
+		if old == current {
+			continue
+		}
+		change := SettingsChange{Time: now, User: c.requestUser(r), Remote: r.RemoteAddr, Field: rs.Field,
+			Old: maskValue(rs.Key, old), New: maskValue(rs.Key, current)}
+		log.Infof("setting %s changed from '%s' to '%s' by %s (%s)", change.Field, change.Old, change.New, change.User, change.Remote)
+		changes = append(changes, change)
+	}
+	if len(changes) > 0 {
+		err = c.auditSettings(changes)
+		if err != nil {
+			log.Error("error storing settings audit: ", err)
+		}
+	}
+	return nil
+}
+
+// settingsAudit returns the audited settings changes, most recent first
+func (c *Controller) settingsAudit() ([]SettingsChange, error) {
+	changes := []SettingsChange{}
+	value, err := c.Store.GetConfig(settingsAuditKey)
+	if err == store.ErrNotFound {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(value), &changes)
+	return changes, err
+}
+
+// auditSettings records settings changes keeping the most recent changes
+func (c *Controller) auditSettings(changes []SettingsChange) error {
+	audit, err := c.settingsAudit()
+	if err != nil {
+		return err
+	}
+	for i := range changes {
+		audit = append([]SettingsChange{changes[i]}, audit...)
+	}
+	if len(audit) > settingsAuditSize {
+		audit = audit[:settingsAuditSize]
+	}
+	value, err := json.Marshal(audit)
+	if err != nil {
+		return err
+	}
+	return c.Store.SetConfig(settingsAuditKey, string(value))
+}
+
+// SettingsHandler is the http handler for "/api/settings". GET returns the
+// runtime settings and PUT changes them. Changes are stored in the database,
+// take precedence over the configuration except -set flags and are applied
+// immediately.
+func (c *Controller) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		err := c.updateSettings(r)
+		if err != nil {
+			writeJSONError(w, err)
+			return
+		}
+		if c.ConfigChanged != nil {
+			c.ConfigChanged()
+		}
+	}
+	s, err := c.currentSettings()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+// SettingsAuditHandler is the http handler for "/api/settings/audit"
+func (c *Controller) SettingsAuditHandler(w http.ResponseWriter, r *http.Request) {
+	audit, err := c.settingsAudit()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, audit)
+}
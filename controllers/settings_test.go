@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/config"
+)
+
+// putSettings changes the runtime settings & returns the response
+func putSettings(t *testing.T, c *Controller, body string) (int, Settings) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c.SettingsHandler(w, httptest.NewRequest("PUT", "/api/settings", strings.NewReader(body)))
+	var s Settings
+	if w.Code == http.StatusOK {
+		err := json.Unmarshal(w.Body.Bytes(), &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, s
+}
+
+func TestSettingsHandler(t *testing.T) {
+	const webhook = "https://discord.com/api/webhooks/1/secret"
+	// newTestController applies the overrides like -set flags
+	c := newTestController(t, map[string]string{"TWITCH_POLL_RATE": "30"})
+
+	status, s := putSettings(t, c, `{"discord_webhook": "`+webhook+`", "owncast_poll_rate": 45}`)
+	if status != http.StatusOK {
+		t.Fatalf("expected the settings to change, got %d", status)
+	}
+	if s.DiscordWebhook != config.MaskedSecret || strings.Join(s.Overridden, ",") != "discord_webhook,owncast_poll_rate" {
+		t.Errorf("expected the masked webhook to be overridden, got %+v", s)
+	}
+	if strings.Join(s.Pinned, ",") != "twitch_poll_rate" {
+		t.Errorf("expected twitch_poll_rate to be pinned, got %+v", s.Pinned)
+	}
+	if c.Config().DiscordWebhook != webhook || c.Config().OwncastPollRate != 45*time.Second {
+		t.Errorf("expected the settings to apply, got %s %s", c.Config().DiscordWebhook, c.Config().OwncastPollRate)
+	}
+
+	// settings sent back as returned keep the webhook
+	status, _ = putSettings(t, c, `{"discord_webhook": "`+config.MaskedSecret+`", "owncast_poll_rate": 90}`)
+	if status != http.StatusOK || c.Config().DiscordWebhook != webhook || c.Config().OwncastPollRate != 90*time.Second {
+		t.Errorf("expected the masked webhook to be kept, got %d %s", status, c.Config().DiscordWebhook)
+	}
+
+	// settings sent back as read do not override the configuration
+	w := httptest.NewRecorder()
+	c.SettingsHandler(w, httptest.NewRequest("GET", "/api/settings", nil))
+	status, s = putSettings(t, c, w.Body.String())
+	if status != http.StatusOK || strings.Join(s.Overridden, ",") != "discord_webhook,owncast_poll_rate" {
+		t.Errorf("expected the unchanged settings to be accepted without new overrides, got %d %+v", status, s.Overridden)
+	}
+	status, s = putSettings(t, c, `{"owncast_poll_rate": 60}`)
+	if status != http.StatusOK || strings.Join(s.Overridden, ",") != "discord_webhook" || c.Config().OwncastPollRate != time.Minute {
+		t.Errorf("expected the configured poll rate to remove the override, got %d %+v", status, s.Overridden)
+	}
+
+	status, _ = putSettings(t, c, `{"twitch_poll_rate": 60, "owncast_poll_rate": 120}`)
+	if status != http.StatusBadRequest {
+		t.Errorf("expected a pinned setting to be rejected, got %d", status)
+	}
+	if c.Config().TwitchPollRate != 30*time.Second || c.Config().OwncastPollRate != time.Minute {
+		t.Errorf("expected nothing to change, got %s %s", c.Config().TwitchPollRate, c.Config().OwncastPollRate)
+	}
+}
+
+func TestPinnedSettings(t *testing.T) {
+	c := newTestController(t, nil)
+	status, _ := putSettings(t, c, `{"twitch_poll_rate": 120}`)
+	if status != http.StatusOK || c.Config().TwitchPollRate != 2*time.Minute {
+		t.Fatalf("expected the poll rate to change, got %d %s", status, c.Config().TwitchPollRate)
+	}
+
+	// a -set flag added after the setting was stored takes precedence
+	conf, err := config.Load("", map[string]string{"twitch.poll_rate": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.ApplyConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Config().TwitchPollRate != 30*time.Second {
+		t.Errorf("expected the -set flag to apply, got %s", c.Config().TwitchPollRate)
+	}
+	s, err := c.currentSettings()
+	if err != nil || len(s.Overridden) != 0 || strings.Join(s.Pinned, ",") != "twitch_poll_rate" {
+		t.Errorf("expected the stored setting to be ignored, got %+v (%v)", s, err)
+	}
+}
@@ -7,10 +7,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/bcambl/rtmpauthbot/models"
+	"github.com/bcambl/rtmpauthbot/store"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 	"golang.org/x/oauth2/twitch"
 )
@@ -27,14 +33,19 @@ type TwitchStreamsResponse struct {
 
 // StreamData to marshal the inner data of the TwitchStreamsResponse
 type StreamData struct {
-	ID          string `json:"id"`
-	UserID      string `json:"user_id"`
-	UserName    string `json:"user_name"`
-	GameID      string `json:"game_id"`
-	Type        string `json:"type"`
-	Title       string `json:"title"`
-	ViewerCount int    `json:"viewer_count"`
-	StartedAt   string `json:"started_at"`
+	ID          string   `json:"id"`
+	UserID      string   `json:"user_id"`
+	UserLogin   string   `json:"user_login"`
+	UserName    string   `json:"user_name"`
+	GameID      string   `json:"game_id"`
+	GameName    string   `json:"game_name"`
+	Type        string   `json:"type"`
+	Title       string   `json:"title"`
+	Tags        []string `json:"tags"`
+	Language    string   `json:"language"`
+	IsMature    bool     `json:"is_mature"`
+	ViewerCount int      `json:"viewer_count"`
+	StartedAt   string   `json:"started_at"`
 }
 
 // TwitchGamesResponse to marshal the json response from /helix/games/
@@ -49,398 +60,426 @@ type GameData struct {
 	BoxArtURL string `json:"box_art_url"`
 }
 
-// retrieve cached twitch access token from database and set in the
-// Config struct. This is only called when the token is not set in Config
-func (c *Controller) getCachedAccessToken() (string, error) {
-	var tokenBytes []byte
-	var err error
-	tokenBytes, err = c.getBucketValue("ConfigBucket", "twitchAccessToken")
+// TwitchUsersResponse to marshal the json response from /helix/users/
+type TwitchUsersResponse struct {
+	Data []UserData `json:"data"`
+}
+
+// UserData to marshal the inner data of the TwitchUsersResponse
+type UserData struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+}
+
+const (
+	twitchValidateURL = "https://id.twitch.tv/oauth2/validate"
+	// twitch requires app access tokens to be validated at least hourly
+	twitchValidateInterval = time.Hour
+	// app access tokens are refreshed this long before they expire
+	twitchRefreshMargin = 10 * time.Minute
+)
+
+// TwitchValidateResponse to marshal the json response from /oauth2/validate
+type TwitchValidateResponse struct {
+	ClientID  string `json:"client_id"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// twitchToken is the app access token cached in memory & the database
+type twitchToken struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// TwitchProvider implements the StreamProvider interface for twitch.tv
+type TwitchProvider struct {
+	c *Controller
+
+	mu        sync.Mutex
+	token     twitchToken
+	validated time.Time
+}
+
+// NewTwitchProvider returns a twitch stream provider using the controller
+// configuration & database for credentials and token caching
+func NewTwitchProvider(c *Controller) *TwitchProvider {
+	return &TwitchProvider{c: c}
+}
+
+// Name returns the provider identifier
+func (t *TwitchProvider) Name() string {
+	return "twitch"
+}
+
+// StreamURL returns the public link to a twitch channel
+func (t *TwitchProvider) StreamURL(account string) string {
+	return fmt.Sprintf("https://twitch.tv/%s", account)
+}
+
+// retrieve the cached twitch access token from the database. Tokens cached
+// prior to expiry tracking are stored as the raw access token.
+func (t *TwitchProvider) getCachedAccessToken() (twitchToken, error) {
+	var token twitchToken
+	value, err := t.c.Store.GetToken("twitch")
+	if err == store.ErrNotFound {
+		return token, errors.New("cached twitch access token not found in db")
+	}
 	if err != nil {
-		return "", err
+		return token, err
+	}
+	if isSealed(value) {
+		value, err = openValue(t.c.Config().TwitchTokenKey, value)
+		if err != nil {
+			return token, err
+		}
 	}
-	if len(tokenBytes) < 1 {
-		return "", errors.New("cached twitch access token not found in db")
+	err = json.Unmarshal([]byte(value), &token)
+	if err != nil {
+		token = twitchToken{AccessToken: value}
 	}
-	return string(tokenBytes), nil
+	return token, nil
 }
 
-// update the cached access token record in the database
-func (c *Controller) updateCachedAccessToken(accessToken string) error {
-	var err error
-	if accessToken == "" {
+// update the cached access token record in the database, encrypting the
+// token if an encryption key is configured
+func (t *TwitchProvider) updateCachedAccessToken(token twitchToken) error {
+	if token.AccessToken == "" {
 		return errors.New("updateCachedAccessToken: no token provided")
 	}
-	err = c.setBucketValue("ConfigBucket", "twitchAccessToken", accessToken)
+	b, err := json.Marshal(token)
 	if err != nil {
 		return err
 	}
-	return nil
+	value := string(b)
+	if t.c.Config().TwitchTokenKey != "" {
+		value, err = sealValue(t.c.Config().TwitchTokenKey, value)
+		if err != nil {
+			return err
+		}
+	}
+	return t.c.Store.SetToken("twitch", value)
 }
 
-func validateAccessToken(accessToken string) error {
+// validateAccessToken validates the token with twitch and returns the
+// remaining lifetime of the token
+func validateAccessToken(ctx context.Context, accessToken string) (time.Duration, error) {
 	if accessToken == "" {
 		err := errors.New("token validation fail - not set")
-		return err
+		return 0, err
 	}
-	r, err := http.NewRequest("GET", "https://id.twitch.tv/oauth2/validate", nil)
+	r, err := http.NewRequestWithContext(ctx, "GET", twitchValidateURL, nil)
 	if err != nil {
-		log.Error(err)
+		return 0, err
 	}
 	r.Header.Set("Content-Type", "application/json")
 	r.Header.Set("Authorization", "OAuth "+accessToken)
 
-	resp, err := http.DefaultClient.Do(r)
+	started := time.Now()
+	resp, err := providerClient.Do(r)
+	observeTwitchRequest("oauth2/validate", started, resp)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return errors.New("token validation response status code != 200")
+		return 0, errors.New("token validation response status code != 200")
 	}
 
-	return nil
+	validateResponse := TwitchValidateResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&validateResponse)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(validateResponse.ExpiresIn) * time.Second, nil
 }
 
-func (c *Controller) getNewAuthToken() error {
+func (t *TwitchProvider) getNewAuthToken(ctx context.Context) error {
 	var oauth2Config *clientcredentials.Config
 
 	oauth2Config = &clientcredentials.Config{
-		ClientID:     c.Config.TwitchClientID,
-		ClientSecret: c.Config.TwitchClientSecret,
+		ClientID:     t.c.Config().TwitchClientID,
+		ClientSecret: t.c.Config().TwitchClientSecret,
 		TokenURL:     twitch.Endpoint.TokenURL,
 	}
 
-	token, err := oauth2Config.Token(context.Background())
+	token, err := oauth2Config.Token(context.WithValue(ctx, oauth2.HTTPClient, providerClient))
 	if err != nil {
 		return err
 	}
 
-	log.Debug("New Access Token: ", token.AccessToken)
-	err = c.updateCachedAccessToken(token.AccessToken)
-	if err != nil {
-		return err
-	}
-	return nil
+	t.token = twitchToken{AccessToken: token.AccessToken, Expiry: token.Expiry}
+	t.validated = time.Now()
+	log.Debugf("obtained new twitch access token (expires: %s)", token.Expiry.Format(time.RFC3339))
 
+	return t.updateCachedAccessToken(t.token)
 }
 
-func (c *Controller) validateClientCredentials() error {
-	if c.Config.TwitchClientID == defaultClientID || c.Config.TwitchClientID == "" {
+func (t *TwitchProvider) validateClientCredentials() error {
+	if t.c.Config().TwitchClientID == defaultClientID || t.c.Config().TwitchClientID == "" {
 		err := errors.New("Default twitch client id value detected. Skipping twitch call")
 		return err
 	}
-	if c.Config.TwitchClientSecret == defaultClientSecret || c.Config.TwitchClientSecret == "" {
+	if t.c.Config().TwitchClientSecret == defaultClientSecret || t.c.Config().TwitchClientSecret == "" {
 		err := errors.New("Default twitch client secret value detected. Skipping twitch call")
 		return err
 	}
 	return nil
 }
 
-//twitchAuthToken handles the lifecycle of the twitch access token
-func (c *Controller) twitchAuthToken() (string, error) {
-	var token string
+// twitchAuthToken handles the lifecycle of the twitch access token. The token
+// is cached in memory, refreshed before it expires and validated hourly.
+func (t *TwitchProvider) twitchAuthToken(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	var err error
+	now := time.Now()
 
-	token, err = c.getCachedAccessToken()
-	if err != nil {
-		log.Debug(err)
+	if t.token.AccessToken == "" {
+		t.token, err = t.getCachedAccessToken()
+		if err != nil {
+			log.Debug(err)
+		}
+		t.validated = time.Time{}
 	}
 
-	err = validateAccessToken(token)
-	if err != nil {
-		err = c.getNewAuthToken()
+	if t.token.AccessToken == "" || (!t.token.Expiry.IsZero() && now.Add(twitchRefreshMargin).After(t.token.Expiry)) {
+		err = t.getNewAuthToken(ctx)
 		if err != nil {
 			return "", err
 		}
+		return t.token.AccessToken, nil
 	}
 
-	token, err = c.getCachedAccessToken()
-	if err != nil {
-		return "", err
-	}
-
-	return token, nil
-}
-
-func streamQueryURL(publishers []Publisher) (string, error) {
-	var userQuery string
-	for i := range publishers {
-		if publishers[i].TwitchStream == "" {
-			continue
+	if now.Sub(t.validated) >= twitchValidateInterval {
+		expiresIn, err := validateAccessToken(ctx, t.token.AccessToken)
+		if err != nil {
+			log.Debug("twitch access token validation failed: ", err)
+			err = t.getNewAuthToken(ctx)
+			if err != nil {
+				return "", err
+			}
+			return t.token.AccessToken, nil
 		}
-		if userQuery != "" {
-			userQuery = userQuery + "&"
+		t.validated = now
+		t.token.Expiry = now.Add(expiresIn)
+		if now.Add(twitchRefreshMargin).After(t.token.Expiry) {
+			err = t.getNewAuthToken(ctx)
+			if err != nil {
+				return "", err
+			}
+			return t.token.AccessToken, nil
+		}
+		err = t.updateCachedAccessToken(t.token)
+		if err != nil {
+			log.Error("error caching twitch access token: ", err)
 		}
-		userQuery = userQuery + fmt.Sprintf("user_login=%s", publishers[i].TwitchStream)
-	}
-
-	if userQuery == "" {
-		err := errors.New("no streams to query")
-		return "", err
 	}
 
-	//log.Debug("stream userQuery: ", userQuery)
-	return "https://api.twitch.tv/helix/streams/?" + userQuery, nil
+	return t.token.AccessToken, nil
 }
 
-func (c *Controller) getStreamInfo(s StreamData) (string, error) {
-	g, err := c.getGame(s.GameID)
-	if err != nil {
-		return "", err
+// invalidateAuthToken discards the access token if it is still the current
+// token, forcing a refresh on the next call to twitchAuthToken
+func (t *TwitchProvider) invalidateAuthToken(accessToken string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token.AccessToken == accessToken {
+		t.token = twitchToken{}
+		t.c.Store.SetToken("twitch", "")
 	}
-	return fmt.Sprintf("title: %s\ngame: %s", s.Title, g.Name), err
 }
 
-func (c *Controller) getStreams() ([]StreamData, error) {
-
-	var (
-		err         error
-		streamQuery string
-	)
+// helixGet performs an authenticated request against the twitch helix api
+// and unmarshals the json response into v. Requests rejected with 401 are
+// retried once with a refreshed access token.
+func (t *TwitchProvider) helixGet(ctx context.Context, query string, v interface{}) error {
 
-	err = c.validateClientCredentials()
+	err := t.validateClientCredentials()
 	if err != nil {
-		return nil, err
-	}
-
-	accessToken, err := c.twitchAuthToken()
-	if err != nil {
-		return nil, err
+		return err
 	}
 
-	publishers, err := c.getAllPublisher()
-	if err != nil {
-		return nil, err
-	}
+	for attempt := 0; ; attempt++ {
+		accessToken, err := t.twitchAuthToken(ctx)
+		if err != nil {
+			return err
+		}
 
-	streamQuery, err = streamQueryURL(publishers)
-	if err != nil {
-		return nil, err
-	}
+		r, err := http.NewRequestWithContext(ctx, "GET", query, nil)
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("client-id", t.c.Config().TwitchClientID)
+		r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	r, err := http.NewRequest("GET", streamQuery, nil)
-	if err != nil {
-		log.Error(err)
-	}
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("client-id", c.Config.TwitchClientID)
-	r.Header.Set("Authorization", "Bearer "+accessToken)
+		started := time.Now()
+		resp, err := providerClient.Do(r)
+		observeTwitchRequest(strings.Trim(r.URL.Path, "/"), started, resp)
+		if err != nil {
+			return err
+		}
 
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			log.Debug("twitch api rejected access token, refreshing")
+			t.invalidateAuthToken(accessToken)
+			continue
+		}
 
-	streamResponse := TwitchStreamsResponse{}
-	err = json.Unmarshal(body, &streamResponse)
-	if err != nil {
-		return nil, err
-	}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("twitch api response status code: %d", resp.StatusCode)
+		}
 
-	if len(streamResponse.Data) == 0 {
-		log.Debug("no twitch streams currently live")
-	}
-	for i := range streamResponse.Data {
-		log.Debug("Live Now:", streamResponse.Data[i].UserName)
+		return json.Unmarshal(body, v)
 	}
-
-	return streamResponse.Data, nil
 }
 
-func (c *Controller) getGame(gameID string) (GameData, error) {
-
-	var (
-		err        error
-		gamesQuery string
-		g          GameData
-	)
-
-	err = c.validateClientCredentials()
-	if err != nil {
-		return g, err
-	}
+// maxStreamLogins is the maximum number of user_login values of a helix
+// streams request
+const maxStreamLogins = 100
 
-	accessToken, err := c.twitchAuthToken()
-	if err != nil {
-		return g, err
+// streamQueryURLs returns the helix streams requests of the accounts, each
+// querying up to maxStreamLogins accounts
+func streamQueryURLs(accounts []string) ([]string, error) {
+	logins := []string{}
+	for i := range accounts {
+		if accounts[i] == "" {
+			continue
+		}
+		logins = append(logins, accounts[i])
 	}
 
-	gamesQuery = fmt.Sprintf("https://api.twitch.tv/helix/games?id=%s", gameID)
-
-	r, err := http.NewRequest("GET", gamesQuery, nil)
-	if err != nil {
-		log.Error(err)
+	if len(logins) == 0 {
+		err := errors.New("no streams to query")
+		return nil, err
 	}
-	r.Header.Set("Content-Type", "application/json")
-	r.Header.Set("client-id", c.Config.TwitchClientID)
-	r.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return g, err
+	queries := []string{}
+	for start := 0; start < len(logins); start += maxStreamLogins {
+		end := min(start+maxStreamLogins, len(logins))
+		// each login has at most one live stream, so a single page of
+		// results covers the chunk
+		query := url.Values{"first": {strconv.Itoa(end - start)}}
+		for _, login := range logins[start:end] {
+			query.Add("user_login", login)
+		}
+		queries = append(queries, "https://api.twitch.tv/helix/streams/?"+query.Encode())
 	}
-	defer resp.Body.Close()
+	return queries, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return g, err
-	}
+// ResolveAccount normalizes a twitch login & verifies the channel exists
+func (t *TwitchProvider) ResolveAccount(ctx context.Context, account string) (string, error) {
+	login := strings.ToLower(strings.TrimSpace(account))
 
-	gamesResponse := TwitchGamesResponse{}
-	err = json.Unmarshal(body, &gamesResponse)
+	usersResponse := TwitchUsersResponse{}
+	query := "https://api.twitch.tv/helix/users?login=" + url.QueryEscape(login)
+	err := t.helixGet(ctx, query, &usersResponse)
 	if err != nil {
-		return g, err
+		return login, err
 	}
 
-	if len(gamesResponse.Data) != 1 {
-		err = fmt.Errorf("game query for '%s' did not return exactly 1 result", gameID)
-		return g, err
+	if len(usersResponse.Data) != 1 {
+		return login, errAccountNotFound
 	}
 
-	return gamesResponse.Data[0], nil
+	return usersResponse.Data[0].Login, nil
 }
 
-func (c *Controller) updateLiveStatus(streams []StreamData) error {
+// LiveStreams returns the twitch streams currently live for the accounts
+func (t *TwitchProvider) LiveStreams(ctx context.Context, accounts []string) ([]LiveStream, error) {
 
-	var live bool
-	publishers, err := c.getAllPublisher()
+	streamQueries, err := streamQueryURLs(accounts)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// mark previous live streams -> offline and notify of stream info change
-	for i := range publishers {
-		live = false
-		p := &publishers[i]
-		if p.IsTwitchLive() {
-			for x := range streams {
-				s := streams[x]
-				if strings.ToLower(s.UserName) == strings.ToLower(p.TwitchStream) {
-					live = true
-					// save stream info for comparison against existing p.StreamInfo
-					streamInfo, err := c.getStreamInfo(s)
-					if err != nil {
-						return err
-					}
-					if p.StreamInfo != streamInfo {
-						// streamer changed their stream info, set notification
-						notification := fmt.Sprintf("%s updated stream info:\n%s", p.Name, streamInfo)
-						c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
-						c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
-					}
-				}
-			}
-			if !live {
-				c.setBucketValue("TwitchLiveBucket", p.Name, "")
-				c.setBucketValue("StreamInfoBucket", p.Name, "")
-				notification := fmt.Sprintf(":checkered_flag: %s finished streaming on twitch", p.Name)
-				c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
-			}
+	streamResponse := TwitchStreamsResponse{}
+	for _, streamQuery := range streamQueries {
+		chunk := TwitchStreamsResponse{}
+		err = t.helixGet(ctx, streamQuery, &chunk)
+		if err != nil {
+			return nil, err
 		}
+		streamResponse.Data = append(streamResponse.Data, chunk.Data...)
 	}
 
-	// mark live twitch streams -> online
-	for x := range streams {
-		s := streams[x]
-		for i := range publishers {
-			p := &publishers[i]
-			if p.TwitchStream == "" {
-				continue
-			}
-			if strings.ToLower(s.UserName) == strings.ToLower(p.TwitchStream) {
-				if !p.IsTwitchLive() {
-					c.setBucketValue("TwitchLiveBucket", p.Name, s.Type)
-					streamInfo, err := c.getStreamInfo(s)
-					if err != nil {
-						return err
-					}
-					streamLink := fmt.Sprintf("https://twitch.tv/%s", p.TwitchStream)
-					notification := fmt.Sprintf(":movie_camera: %s started streaming on twitch!"+
-						"\n%s\nwatch now: `%s`", p.Name, streamInfo, streamLink)
-					c.setBucketValue("StreamInfoBucket", p.Name, streamInfo)
-					c.setBucketValue("TwitchNotificationBucket", p.Name, notification)
-				}
-			}
-		}
+	if len(streamResponse.Data) == 0 {
+		log.Debug("no twitch streams currently live")
 	}
 
-	return nil
+	streams := []LiveStream{}
+	for i := range streamResponse.Data {
+		s := streamResponse.Data[i]
+		log.Debug("Live Now:", s.UserName)
+		account := s.UserLogin
+		if account == "" {
+			account = s.UserName
+		}
+		streams = append(streams, LiveStream{
+			Account:     account,
+			Type:        s.Type,
+			Title:       s.Title,
+			CategoryID:  s.GameID,
+			Category:    s.GameName,
+			Tags:        s.Tags,
+			Language:    s.Language,
+			Mature:      s.IsMature,
+			ViewerCount: s.ViewerCount,
+			StartedAt:   s.StartedAt,
+		})
+	}
+
+	return streams, nil
 }
 
-func (c *Controller) processNotifications() error {
-
-	publishers, err := c.getAllPublisher()
-	if err != nil {
-		return err
-	}
-
-	for i := range publishers {
-		p := publishers[i]
-		if p.TwitchLive == "" && p.TwitchNotification == "" {
-			continue
-		}
-		if p.TwitchLive != "" && p.TwitchNotification == "" {
-			continue
-		}
-		log.Debug("notification: ", p.TwitchNotification)
-		if c.Config.DiscordEnabled {
-			log.Debug("sending discord notification: ", p.TwitchNotification)
-			err := c.callWebhook(p.TwitchNotification)
-			if err != nil {
-				return err
-			}
-		}
-		if p.TwitchNotification != "" {
-			log.Debugf("resetting notification for %s (%s)", p.Name, p.TwitchStream)
-			err = c.setBucketValue("TwitchNotificationBucket", p.Name, "")
-			if err != nil {
-				return err
-			}
+// StreamInfo returns the metadata of a live twitch stream. The game name is
+// only looked up when it is missing from the streams response.
+func (t *TwitchProvider) StreamInfo(ctx context.Context, s LiveStream) (models.StreamInfo, error) {
+	info := models.StreamInfo{
+		Title:    s.Title,
+		GameID:   s.CategoryID,
+		GameName: s.Category,
+		Tags:     s.Tags,
+		Language: s.Language,
+		Mature:   s.Mature,
+	}
+	if info.GameName == "" && info.GameID != "" {
+		g, err := t.getGame(ctx, s.CategoryID)
+		if err != nil {
+			return info, err
 		}
+		info.GameName = g.Name
 	}
-
-	return nil
+	return info, nil
 }
 
-func (c *Controller) twitchMain() {
-	streams, err := c.getStreams()
-	if err != nil {
-		log.Debug(err)
-		return
-	}
+func (t *TwitchProvider) getGame(ctx context.Context, gameID string) (GameData, error) {
+
+	var g GameData
 
-	err = c.updateLiveStatus(streams)
+	gamesQuery := fmt.Sprintf("https://api.twitch.tv/helix/games?id=%s", url.QueryEscape(gameID))
+
+	gamesResponse := TwitchGamesResponse{}
+	err := t.helixGet(ctx, gamesQuery, &gamesResponse)
 	if err != nil {
-		log.Error(err)
-		return
+		return g, err
 	}
 
-	err = c.processNotifications()
-	if err != nil {
-		log.Error(err)
-		return
+	if len(gamesResponse.Data) != 1 {
+		err = fmt.Errorf("game query for '%s' did not return exactly 1 result", gameID)
+		return g, err
 	}
-}
 
-// TwitchScheduler launches the twitch stream query & notification background processes
-func (c *Controller) TwitchScheduler(ctx context.Context, pollRate time.Duration) {
-	ticker := time.NewTicker(pollRate)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				c.twitchMain()
-			case <-ctx.Done():
-				ticker.Stop()
-				return
-			}
-		}
-	}()
+	return gamesResponse.Data[0], nil
 }
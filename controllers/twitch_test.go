@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestStreamQueryURLs(t *testing.T) {
+	_, err := streamQueryURLs([]string{"", ""})
+	if err == nil {
+		t.Error("expected an error without accounts")
+	}
+
+	accounts := []string{""}
+	for i := 0; i < 2*maxStreamLogins+50; i++ {
+		accounts = append(accounts, fmt.Sprintf("user%d", i))
+	}
+	queries, err := streamQueryURLs(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int{maxStreamLogins, maxStreamLogins, 50}
+	if len(queries) != len(sizes) {
+		t.Fatalf("expected %d queries, got %d", len(sizes), len(queries))
+	}
+	next := 0
+	for i := range queries {
+		u, err := url.Parse(queries[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		logins := u.Query()["user_login"]
+		if len(logins) != sizes[i] || u.Query().Get("first") != fmt.Sprint(sizes[i]) {
+			t.Errorf("query %d: expected %d logins on one page, got %s", i, sizes[i], u.RawQuery)
+		}
+		for _, login := range logins {
+			if login != fmt.Sprintf("user%d", next) {
+				t.Fatalf("query %d: expected user%d, got %s", i, next, login)
+			}
+			next++
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package metrics implements counters, gauges & histograms with labels and
+// writes them in the prometheus text exposition format
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets suited to request latencies in
+// seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metric is a metric family which can be written in the text format
+type Metric interface {
+	write(w *bufio.Writer)
+}
+
+// series is a labelled value of a metric family
+type series struct {
+	labels []string
+	value  float64
+	// histogram buckets, sum & count
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// family is a metric with its series by label values
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+}
+
+// get returns the series of the label values, the series is created if it
+// does not exist. The caller must hold the lock.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		if f.buckets != nil {
+			s.buckets = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value which only increases
+type Counter struct {
+	f *family
+}
+
+// NewCounter returns a counter with the label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{f: newFamily(name, help, "counter", labels)}
+}
+
+// Inc increments the counter of the label values by one
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add increases the counter of the label values
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(values).value += v
+}
+
+// Set sets the counter of the label values, for counters which are read from
+// another source when the metrics are collected
+func (c *Counter) Set(v float64, values ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.get(values).value = v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.f.write(w)
+}
+
+// Gauge is a value which may go up & down
+type Gauge struct {
+	f *family
+}
+
+// NewGauge returns a gauge with the label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{f: newFamily(name, help, "gauge", labels)}
+}
+
+// Set sets the gauge of the label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.f.mu.Lock()
+	defer g.f.mu.Unlock()
+	g.f.get(values).value = v
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.f.write(w)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	f *family
+}
+
+// NewHistogram returns a histogram with the upper bounds of its buckets in
+// increasing order and the label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	f := newFamily(name, help, "histogram", labels)
+	f.buckets = buckets
+	return &Histogram{f: f}
+}
+
+// Observe adds an observation to the histogram of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+	s := h.f.get(values)
+	for i, upper := range h.f.buckets {
+		if v <= upper {
+			s.buckets[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.f.write(w)
+}
+
+// escape escapes a label value
+var escape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeHelp escapes a help text, which unlike label values may contain
+// double quotes
+var escapeHelp = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// labelString returns the label pairs of a sample including the extra pair
+// if its name is not empty
+func labelString(names, values []string, extraName, extraValue string) string {
+	var pairs []string
+	for i := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, names[i], escape.Replace(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatFloat formats a sample value
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// write writes the family with its series ordered by label values
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp.Replace(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, labelString(f.labels, s.labels, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, upper := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", formatFloat(upper)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, labelString(f.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, labelString(f.labels, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, labelString(f.labels, s.labels, "", ""), s.count)
+	}
+}
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Write writes the metrics in the text exposition format
+func Write(w io.Writer, metrics ...Metric) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
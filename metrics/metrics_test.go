@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+// written returns the metrics in the text exposition format
+func written(t *testing.T, metrics ...Metric) string {
+	t.Helper()
+	var b bytes.Buffer
+	err := Write(&b, metrics...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestWrite(t *testing.T) {
+	requests := NewCounter("requests_total", "Requests by method & code.", "method", "code")
+	requests.Inc("POST", "201")
+	requests.Add(2.5, "GET", "200")
+	requests.Inc("GET", "200")
+	pages := NewCounter("pages_total", "Pages read from another source.")
+	pages.Set(10)
+	pages.Set(7)
+	temperature := NewGauge("temperature", "Current temperature.")
+	temperature.Set(-1.25)
+	empty := NewGauge("empty", "Gauge without series.", "label")
+
+	want := `# HELP requests_total Requests by method & code.
+# TYPE requests_total counter
+requests_total{method="GET",code="200"} 3.5
+requests_total{method="POST",code="201"} 1
+# HELP pages_total Pages read from another source.
+# TYPE pages_total counter
+pages_total 7
+# HELP temperature Current temperature.
+# TYPE temperature gauge
+temperature -1.25
+# HELP empty Gauge without series.
+# TYPE empty gauge
+`
+	if got := written(t, requests, pages, temperature, empty); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	latency := NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "endpoint")
+	latency.Observe(0.05, "users")
+	latency.Observe(0.1, "users")
+	latency.Observe(0.5, "users")
+	latency.Observe(3, "users")
+
+	want := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{endpoint="users",le="0.1"} 2
+latency_seconds_bucket{endpoint="users",le="1"} 3
+latency_seconds_bucket{endpoint="users",le="+Inf"} 4
+latency_seconds_sum{endpoint="users"} 3.65
+latency_seconds_count{endpoint="users"} 4
+`
+	if got := written(t, latency); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	viewers := NewGauge("viewers", "Viewers by \"stream\",\nwith a \\ in the help.", "stream")
+	viewers.Set(1, `say "hi"`)
+	viewers.Set(2, `C:\streams`)
+	viewers.Set(3, "two\nlines")
+
+	want := `# HELP viewers Viewers by "stream",\nwith a \\ in the help.
+# TYPE viewers gauge
+viewers{stream="C:\\streams"} 2
+viewers{stream="say \"hi\""} 1
+viewers{stream="two\nlines"} 3
+`
+	if got := written(t, viewers); got != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for missing label values")
+		}
+	}()
+	NewCounter("requests_total", "Requests by method & code.", "method", "code").Inc("GET")
+}
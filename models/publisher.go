@@ -0,0 +1,157 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Publisher struct contains rtmp stream name, stream key & linked stream
+// provider accounts. TwitchStream & TwitchLive mirror the primary twitch link.
+// Revision is incremented by the store each time a user editable field
+// changes, live state updates keep the revision.
+// Unlisted publishers are hidden from the public live status endpoints.
+// DiscordID maps a discord user to the publisher for the member portal and
+// Muted contains the notification kinds the publisher opted out of.
+type Publisher struct {
+	Name         string       `json:"name"`
+	Key          string       `json:"key"`
+	RTMPLive     string       `json:"rtmp_live"`
+	TwitchStream string       `json:"twitch_stream"`
+	TwitchLive   string       `json:"twitch_live"`
+	Links        []StreamLink `json:"links"`
+	Unlisted     bool         `json:"unlisted"`
+	DiscordID    string       `json:"discord_id"`
+	Muted        []string     `json:"muted"`
+	Revision     int64        `json:"revision"`
+}
+
+// Notification kinds which publishers may mute
+const (
+	NotifyStream  = "stream"
+	NotifyViewers = "viewers"
+	NotifyLive    = "live"
+)
+
+// NotificationKinds lists all notification kinds
+var NotificationKinds = []string{NotifyStream, NotifyViewers, NotifyLive}
+
+// StreamLink associates a publisher with an account on a stream provider
+type StreamLink struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account"`
+	LinkState
+}
+
+// Link states tracked for each linked provider account
+const (
+	StateOffline      = "offline"
+	StateLive         = "live"
+	StateMaybeOffline = "maybe-offline"
+)
+
+// LinkState contains the tracked state of a linked provider account. A live
+// stream that disappears is kept in the maybe-offline state until the
+// configured offline grace period has elapsed.
+type LinkState struct {
+	Live         string     `json:"live"`
+	State        string     `json:"state"`
+	Missed       int        `json:"-"`
+	MissedSince  time.Time  `json:"-"`
+	Notification string     `json:"-"`
+	StreamInfo   StreamInfo `json:"stream_info"`
+}
+
+// MarshalJSON encodes the publisher with the twitch fields populated from the
+// primary twitch link
+func (p Publisher) MarshalJSON() ([]byte, error) {
+	type publisher Publisher
+	out := publisher(p)
+	out.TwitchStream = ""
+	out.TwitchLive = ""
+	if l := p.Link("twitch"); l != nil {
+		out.TwitchStream = l.Account
+		out.TwitchLive = l.Live
+	}
+	if out.Links == nil {
+		out.Links = []StreamLink{}
+	}
+	if out.Muted == nil {
+		out.Muted = []string{}
+	}
+	return json.Marshal(out)
+}
+
+// IsValid perform basic validations on a publisher record
+func (p *Publisher) IsValid() error {
+	var err error
+	if len(p.Name) < 1 {
+		err = errors.New("missing parameter: name")
+		return err
+	}
+	if len(p.Key) < 1 {
+		err = errors.New("missing parameter: key")
+		return err
+	}
+	return nil
+}
+
+// IsLive returns true if the publisher is streaming to the local rtmp server
+// or on any linked account
+func (p *Publisher) IsLive() bool {
+	if p.RTMPLive != "" {
+		return true
+	}
+	for i := range p.Links {
+		if p.Links[i].IsLive() {
+			return true
+		}
+	}
+	return false
+}
+
+// IsMuted returns true if the publisher muted the notification kind
+func (p *Publisher) IsMuted(kind string) bool {
+	for i := range p.Muted {
+		if p.Muted[i] == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTwitchLive returns true if any linked twitch account is live
+func (p *Publisher) IsTwitchLive() bool {
+	for i := range p.Links {
+		if p.Links[i].Provider == "twitch" && p.Links[i].IsLive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Link returns the first link to the provider or nil if none exist
+func (p *Publisher) Link(provider string) *StreamLink {
+	for i := range p.Links {
+		if p.Links[i].Provider == provider {
+			return &p.Links[i]
+		}
+	}
+	return nil
+}
+
+// IsLive returns a boolean based on string value of the Live field
+func (l *StreamLink) IsLive() bool {
+	return l.Live != ""
+}
+
+// Normalize fills in the state of links stored prior to state tracking,
+// which only contain the live status
+func (l *LinkState) Normalize() {
+	if l.State == "" {
+		l.State = StateOffline
+		if l.Live != "" {
+			l.State = StateLive
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// SessionProviderRTMP is the provider of sessions published to the local
+// rtmp server
+const SessionProviderRTMP = "rtmp"
+
+// Session is a single stream of a publisher on the local rtmp server or a
+// linked provider account
+type Session struct {
+	ID        int64      `json:"id"`
+	Publisher string     `json:"publisher"`
+	Provider  string     `json:"provider"`
+	Account   string     `json:"account,omitempty"`
+	Title     string     `json:"title,omitempty"`
+	Game      string     `json:"game,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+}
+
+// IsActive returns true if the session has not ended
+func (s *Session) IsActive() bool {
+	return s.EndedAt == nil
+}
@@ -0,0 +1,138 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Stream info fields which may be opted-in to change notifications
+const (
+	InfoFieldTitle    = "title"
+	InfoFieldGame     = "game"
+	InfoFieldTags     = "tags"
+	InfoFieldLanguage = "language"
+	InfoFieldMature   = "mature"
+)
+
+// StreamInfo contains the metadata of a live stream
+type StreamInfo struct {
+	Title    string   `json:"title"`
+	GameID   string   `json:"game_id"`
+	GameName string   `json:"game_name"`
+	Tags     []string `json:"tags"`
+	Language string   `json:"language"`
+	Mature   bool     `json:"mature"`
+}
+
+// InfoChange describes the change of a single stream info field
+type InfoChange struct {
+	Field   string
+	Message string
+}
+
+// UnmarshalJSON decodes stream info, including the legacy formatted string
+// ("title: ...\ngame: ...") stored prior to structured stream info.
+func (s *StreamInfo) UnmarshalJSON(b []byte) error {
+	var legacy string
+	if json.Unmarshal(b, &legacy) == nil {
+		*s = StreamInfo{}
+		for _, line := range strings.Split(legacy, "\n") {
+			switch {
+			case strings.HasPrefix(line, "title: "):
+				s.Title = strings.TrimPrefix(line, "title: ")
+			case strings.HasPrefix(line, "game: "):
+				s.GameName = strings.TrimPrefix(line, "game: ")
+			}
+		}
+		return nil
+	}
+	type streamInfo StreamInfo
+	return json.Unmarshal(b, (*streamInfo)(s))
+}
+
+// String returns the stream info formatted for notifications
+func (s StreamInfo) String() string {
+	info := fmt.Sprintf("title: %s", s.Title)
+	if s.GameName != "" {
+		info += fmt.Sprintf("\ngame: %s", s.GameName)
+	}
+	return info
+}
+
+func tagSet(tags []string) map[string]bool {
+	set := make(map[string]bool)
+	for i := range tags {
+		set[strings.ToLower(tags[i])] = true
+	}
+	return set
+}
+
+// Diff returns the field level changes from the previous stream info
+func (s StreamInfo) Diff(prev StreamInfo) []InfoChange {
+	var changes []InfoChange
+
+	if s.Title != prev.Title {
+		changes = append(changes, InfoChange{
+			Field:   InfoFieldTitle,
+			Message: fmt.Sprintf("changed title from \"%s\" to \"%s\"", prev.Title, s.Title),
+		})
+	}
+
+	// legacy stream info only contains the game name
+	gameChanged := s.GameName != prev.GameName
+	if s.GameID != "" && prev.GameID != "" {
+		gameChanged = s.GameID != prev.GameID
+	}
+	if gameChanged {
+		msg := fmt.Sprintf("switched game from %s to %s", prev.GameName, s.GameName)
+		if prev.GameName == "" {
+			msg = fmt.Sprintf("switched game to %s", s.GameName)
+		}
+		if s.GameName == "" {
+			msg = fmt.Sprintf("stopped playing %s", prev.GameName)
+		}
+		changes = append(changes, InfoChange{Field: InfoFieldGame, Message: msg})
+	}
+
+	current, previous := tagSet(s.Tags), tagSet(prev.Tags)
+	var added, removed []string
+	for i := range s.Tags {
+		if !previous[strings.ToLower(s.Tags[i])] {
+			added = append(added, s.Tags[i])
+		}
+	}
+	for i := range prev.Tags {
+		if !current[strings.ToLower(prev.Tags[i])] {
+			removed = append(removed, prev.Tags[i])
+		}
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		var parts []string
+		if len(added) > 0 {
+			parts = append(parts, "added tags "+strings.Join(added, ", "))
+		}
+		if len(removed) > 0 {
+			parts = append(parts, "removed tags "+strings.Join(removed, ", "))
+		}
+		changes = append(changes, InfoChange{Field: InfoFieldTags, Message: strings.Join(parts, " and ")})
+	}
+
+	if !strings.EqualFold(s.Language, prev.Language) {
+		msg := fmt.Sprintf("changed language from %s to %s", prev.Language, s.Language)
+		if prev.Language == "" {
+			msg = fmt.Sprintf("changed language to %s", s.Language)
+		}
+		changes = append(changes, InfoChange{Field: InfoFieldLanguage, Message: msg})
+	}
+
+	if s.Mature != prev.Mature {
+		msg := "marked the stream as mature"
+		if !s.Mature {
+			msg = "marked the stream as no longer mature"
+		}
+		changes = append(changes, InfoChange{Field: InfoFieldMature, Message: msg})
+	}
+
+	return changes
+}
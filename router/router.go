@@ -0,0 +1,126 @@
+// Package router provides a minimal http request router with path parameters
+// and per-method routes
+package router
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// route is a handler registered for a method & path pattern. An empty method
+// matches all methods.
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+// Router dispatches requests to the handler of the first route matching the
+// method & path. Pattern segments in braces, ie: "/publishers/{name}", match
+// a single path segment which is available from r.PathValue. A trailing
+// "{name...}" segment matches the remainder of the path.
+type Router struct {
+	routes []route
+	// NotFound handles requests which match no route
+	NotFound http.Handler
+	// MethodNotAllowed handles requests which match a route path but not
+	// its method. The Allow header is set before it is called.
+	MethodNotAllowed http.Handler
+}
+
+// New returns a router which responds with the default not found & method
+// not allowed responses
+func New() *Router {
+	return &Router{
+		NotFound: http.NotFoundHandler(),
+		MethodNotAllowed: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}),
+	}
+}
+
+// split returns the segments of a path without leading & trailing slashes
+func split(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// Handle registers a handler for the method & pattern
+func (rt *Router) Handle(method, pattern string, handler http.Handler) {
+	rt.routes = append(rt.routes, route{
+		method:   method,
+		segments: split(pattern),
+		handler:  handler,
+	})
+}
+
+// HandleFunc registers a handler function for the method & pattern
+func (rt *Router) HandleFunc(method, pattern string, handler http.HandlerFunc) {
+	rt.Handle(method, pattern, handler)
+}
+
+// match returns the path parameters if the path segments match the route
+func (r *route) match(segments []string) (map[string]string, bool) {
+	params := make(map[string]string)
+	for i, s := range r.segments {
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "...}") {
+			if i >= len(segments) {
+				return nil, false
+			}
+			params[s[1:len(s)-4]] = strings.Join(segments[i:], "/")
+			return params, true
+		}
+		if i >= len(segments) {
+			return nil, false
+		}
+		if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+			params[s[1:len(s)-1]] = segments[i]
+			continue
+		}
+		if s != segments[i] {
+			return nil, false
+		}
+	}
+	return params, len(r.segments) == len(segments)
+}
+
+// ServeHTTP dispatches the request to the matching route
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := split(r.URL.Path)
+	allowed := make(map[string]bool)
+	for i := range rt.routes {
+		params, ok := rt.routes[i].match(segments)
+		if !ok {
+			continue
+		}
+		method := rt.routes[i].method
+		if method != "" && method != r.Method && !(method == "GET" && r.Method == "HEAD") {
+			allowed[method] = true
+			if method == "GET" {
+				allowed["HEAD"] = true
+			}
+			continue
+		}
+		for k, v := range params {
+			r.SetPathValue(k, v)
+		}
+		rt.routes[i].handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		methods := make([]string, 0, len(allowed))
+		for m := range allowed {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		rt.MethodNotAllowed.ServeHTTP(w, r)
+		return
+	}
+	rt.NotFound.ServeHTTP(w, r)
+}
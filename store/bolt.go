@@ -0,0 +1,615 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// DataBuckets is a slice of all buckets that exist throught the project
+var DataBuckets = []string{
+	"ConfigBucket",      // General configuration, caching & schema version
+	"PublisherBucket",   // Local publishers -> publisher json documents
+	"SessionBucket",     // Session ids -> stream session json documents
+	"OpenSessionBucket", // Publisher, provider, account & session id of open sessions
+	"DiscordIDBucket",   // Discord user ids -> linked publisher names
+	"TokenBucket",       // Token names -> cached access tokens
+}
+
+// BoltStore is the bbolt implementation of Store
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// publisherRecord is the database document of a publisher. All state of a
+// publisher is stored in a single json document keyed by publisher name.
+type publisherRecord struct {
+	Name      string       `json:"name"`
+	Key       string       `json:"key"`
+	RTMPLive  string       `json:"rtmp_live"`
+	Links     []linkRecord `json:"links"`
+	Unlisted  bool         `json:"unlisted"`
+	DiscordID string       `json:"discord_id"`
+	Muted     []string     `json:"muted"`
+	Revision  int64        `json:"revision"`
+}
+
+// linkRecord is the database representation of a StreamLink
+type linkRecord struct {
+	Provider string `json:"provider"`
+	Account  string `json:"account"`
+	linkState
+}
+
+// linkState is the database representation of LinkState
+type linkState struct {
+	Live         string            `json:"live"`
+	State        string            `json:"state"`
+	Missed       int               `json:"missed"`
+	MissedSince  time.Time         `json:"missed_since"`
+	Notification string            `json:"notification"`
+	StreamInfo   models.StreamInfo `json:"stream_info"`
+}
+
+func (r *publisherRecord) toPublisher() models.Publisher {
+	p := models.Publisher{
+		Name:      r.Name,
+		Key:       r.Key,
+		RTMPLive:  r.RTMPLive,
+		Links:     []models.StreamLink{},
+		Unlisted:  r.Unlisted,
+		DiscordID: r.DiscordID,
+		Muted:     r.Muted,
+		Revision:  r.Revision,
+	}
+	for i := range r.Links {
+		state := models.LinkState(r.Links[i].linkState)
+		state.Normalize()
+		p.Links = append(p.Links, models.StreamLink{
+			Provider:  r.Links[i].Provider,
+			Account:   r.Links[i].Account,
+			LinkState: state,
+		})
+	}
+	return p
+}
+
+func newPublisherRecord(p *models.Publisher) publisherRecord {
+	r := publisherRecord{
+		Name:      p.Name,
+		Key:       p.Key,
+		RTMPLive:  p.RTMPLive,
+		Links:     []linkRecord{},
+		Unlisted:  p.Unlisted,
+		DiscordID: p.DiscordID,
+		Muted:     p.Muted,
+		Revision:  p.Revision,
+	}
+	for i := range p.Links {
+		r.Links = append(r.Links, linkRecord{
+			Provider:  p.Links[i].Provider,
+			Account:   p.Links[i].Account,
+			linkState: linkState(p.Links[i].LinkState),
+		})
+	}
+	return r
+}
+
+// OpenBolt opens the bbolt database at path, ensures all buckets exist and
+// runs any pending schema migrations
+func OpenBolt(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0700, &bolt.Options{Timeout: 5 * time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for b := range DataBuckets {
+			log.Debug("db: ensuring bucket exists: ", DataBuckets[b])
+			_, err := tx.CreateBucketIfNotExists([]byte(DataBuckets[b]))
+			if err != nil {
+				return fmt.Errorf("error creating bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = migrateBolt(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// OpenBoltReadOnly opens the bbolt database at path read-only without
+// running the schema migrations. Other processes may read the database
+// meanwhile but not write to it.
+func OpenBoltReadOnly(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("database %s is locked by another process", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// DB returns the underlying bbolt database
+func (s *BoltStore) DB() *bolt.DB {
+	return s.db
+}
+
+// Close closes the underlying database
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func readPublisher(tx *bolt.Tx, name string) (models.Publisher, error) {
+	v := tx.Bucket([]byte("PublisherBucket")).Get([]byte(name))
+	if v == nil {
+		return models.Publisher{Name: name}, ErrNotFound
+	}
+	var r publisherRecord
+	err := json.Unmarshal(v, &r)
+	if err != nil {
+		return models.Publisher{Name: name}, fmt.Errorf("error decoding publisher '%s': %s", name, err)
+	}
+	return r.toPublisher(), nil
+}
+
+func writePublisher(tx *bolt.Tx, p *models.Publisher) error {
+	v, err := json.Marshal(newPublisherRecord(p))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("PublisherBucket")).Put([]byte(p.Name), v)
+}
+
+// indexDiscordID moves the discord user of a publisher in the discord id index
+// from previous to id. A DiscordIDTakenError is returned if id is linked to
+// another publisher.
+func indexDiscordID(tx *bolt.Tx, name, previous, id string) error {
+	b := tx.Bucket([]byte("DiscordIDBucket"))
+	if id != "" {
+		owner := b.Get([]byte(id))
+		if owner != nil && string(owner) != name {
+			return &DiscordIDTakenError{DiscordID: id, Publisher: string(owner)}
+		}
+		err := b.Put([]byte(id), []byte(name))
+		if err != nil {
+			return err
+		}
+	}
+	if previous != "" && previous != id && string(b.Get([]byte(previous))) == name {
+		return b.Delete([]byte(previous))
+	}
+	return nil
+}
+
+// GetPublisher returns the publisher or ErrNotFound
+func (s *BoltStore) GetPublisher(name string) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		p, err = readPublisher(tx, name)
+		return err
+	})
+	return p, err
+}
+
+// GetPublisherByDiscordID returns the publisher linked to a discord user or
+// ErrNotFound
+func (s *BoltStore) GetPublisherByDiscordID(id string) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.db.View(func(tx *bolt.Tx) error {
+		name := tx.Bucket([]byte("DiscordIDBucket")).Get([]byte(id))
+		if id == "" || name == nil {
+			return ErrNotFound
+		}
+		var err error
+		p, err = readPublisher(tx, string(name))
+		return err
+	})
+	return p, err
+}
+
+// ListPublishers returns all publishers ordered by name
+func (s *BoltStore) ListPublishers() ([]models.Publisher, error) {
+	publishers := []models.Publisher{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("PublisherBucket"))
+		return b.ForEach(func(k, v []byte) error {
+			var r publisherRecord
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return fmt.Errorf("error decoding publisher '%s': %s", k, err)
+			}
+			publishers = append(publishers, r.toPublisher())
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return publishers, nil
+}
+
+// QueryPublishers returns a page of the publishers matching the query. The
+// cursor seeks directly to the first key of the page so only the requested
+// page and the filtered out publishers within it are decoded.
+func (s *BoltStore) QueryPublishers(q PublisherQuery) ([]models.Publisher, string, error) {
+	publishers := []models.Publisher{}
+	next := ""
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("PublisherBucket")).Cursor()
+		prefix := []byte(q.Prefix)
+
+		var k, v []byte
+		if !q.Descending {
+			start := prefix
+			if q.After > q.Prefix {
+				start = []byte(q.After)
+			}
+			k, v = c.Seek(start)
+			if k != nil && q.After != "" && string(k) == q.After {
+				k, v = c.Next()
+			}
+		} else {
+			// seek to the first key after the page and step back
+			start := prefixEnd(prefix)
+			if q.After != "" && (start == nil || q.After < string(start)) {
+				start = []byte(q.After)
+			}
+			if start == nil {
+				k, v = c.Last()
+			} else if k, v = c.Seek(start); k == nil {
+				k, v = c.Last()
+			} else {
+				k, v = c.Prev()
+			}
+		}
+
+		for k != nil && bytes.HasPrefix(k, prefix) {
+			var r publisherRecord
+			err := json.Unmarshal(v, &r)
+			if err != nil {
+				return fmt.Errorf("error decoding publisher '%s': %s", k, err)
+			}
+			p := r.toPublisher()
+			if q.Match(&p) {
+				publishers = append(publishers, p)
+				// read one publisher past the limit to detect the last page
+				if q.Limit > 0 && len(publishers) > q.Limit {
+					break
+				}
+			}
+			if q.Descending {
+				k, v = c.Prev()
+			} else {
+				k, v = c.Next()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if q.Limit > 0 && len(publishers) > q.Limit {
+		publishers = publishers[:q.Limit]
+		next = publishers[q.Limit-1].Name
+	}
+	return publishers, next, nil
+}
+
+func (s *BoltStore) updatePublisher(name string, create bool, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		p, err = readPublisher(tx, name)
+		exists := err == nil
+		if err == ErrNotFound && create {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		previous := p.DiscordID
+		err = applyUpdate(&p, name, exists, fn)
+		if err != nil {
+			return err
+		}
+		err = indexDiscordID(tx, name, previous, p.DiscordID)
+		if err != nil {
+			return err
+		}
+		return writePublisher(tx, &p)
+	})
+	if err == errUnchanged {
+		err = nil
+	}
+	if err != nil {
+		return models.Publisher{}, err
+	}
+	return p, nil
+}
+
+// UpdatePublisher reads, modifies & writes an existing publisher
+func (s *BoltStore) UpdatePublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	return s.updatePublisher(name, false, fn)
+}
+
+// UpsertPublisher reads, modifies & writes a publisher, creating it if needed
+func (s *BoltStore) UpsertPublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	return s.updatePublisher(name, true, fn)
+}
+
+// DeletePublisher removes a publisher or returns ErrNotFound
+func (s *BoltStore) DeletePublisher(name string, check func(p *models.Publisher) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		p, err := readPublisher(tx, name)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			err = check(&p)
+			if err != nil {
+				return err
+			}
+		}
+		err = indexDiscordID(tx, name, p.DiscordID, "")
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("PublisherBucket")).Delete([]byte(name))
+	})
+}
+
+// itob returns an 8-byte big endian representation of v
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// openSessionPrefix returns the OpenSessionBucket key prefix of the open
+// sessions of a publisher on a provider account
+func openSessionPrefix(publisher, provider, account string) []byte {
+	return []byte(publisher + "\x00" + provider + "\x00" + account + "\x00")
+}
+
+// openSessionKey returns the OpenSessionBucket key of a session
+func openSessionKey(session models.Session) []byte {
+	return append(openSessionPrefix(session.Publisher, session.Provider, session.Account), itob(uint64(session.ID))...)
+}
+
+// putSession writes a session and keeps the open session index current,
+// replacing any session with the same ID
+func putSession(tx *bolt.Tx, session models.Session) error {
+	b := tx.Bucket([]byte("SessionBucket"))
+	open := tx.Bucket([]byte("OpenSessionBucket"))
+	id := itob(uint64(session.ID))
+	if v := b.Get(id); v != nil {
+		var current models.Session
+		err := json.Unmarshal(v, &current)
+		if err != nil {
+			return err
+		}
+		err = open.Delete(openSessionKey(current))
+		if err != nil {
+			return err
+		}
+	}
+	if session.IsActive() {
+		err := open.Put(openSessionKey(session), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return b.Put(id, v)
+}
+
+// StartSession records the start of a session and returns it with its ID
+func (s *BoltStore) StartSession(session models.Session) (models.Session, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket([]byte("SessionBucket")).NextSequence()
+		if err != nil {
+			return err
+		}
+		session.ID = int64(id)
+		return putSession(tx, session)
+	})
+	return session, err
+}
+
+// EndSession ends the active sessions of a publisher on a provider account,
+// found through the open session index
+func (s *BoltStore) EndSession(publisher, provider, account string, endedAt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("SessionBucket"))
+		prefix := openSessionPrefix(publisher, provider, account)
+		var ids [][]byte
+		c := tx.Bucket([]byte("OpenSessionBucket")).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			ids = append(ids, k[len(prefix):])
+		}
+		for _, id := range ids {
+			var session models.Session
+			err := json.Unmarshal(b.Get(id), &session)
+			if err != nil {
+				return err
+			}
+			session.EndedAt = &endedAt
+			err = putSession(tx, session)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListSessions returns the sessions of a publisher, most recent first
+func (s *BoltStore) ListSessions(publisher string) ([]models.Session, error) {
+	sessions := []models.Session{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte("SessionBucket")).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var session models.Session
+			err := json.Unmarshal(v, &session)
+			if err != nil {
+				return err
+			}
+			if publisher != "" && session.Publisher != publisher {
+				continue
+			}
+			sessions = append(sessions, session)
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+// ImportSession stores a session with its existing ID, replacing any session
+// with the same ID
+func (s *BoltStore) ImportSession(session models.Session) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("SessionBucket"))
+		if session.ID < 1 {
+			return fmt.Errorf("invalid session id: %d", session.ID)
+		}
+		id := uint64(session.ID)
+		// keep the sequence ahead of imported ids so new sessions never
+		// overwrite them
+		if b.Sequence() < id {
+			err := b.SetSequence(id)
+			if err != nil {
+				return err
+			}
+		}
+		return putSession(tx, session)
+	})
+}
+
+func (s *BoltStore) getValue(bucket, key string) (string, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value = tx.Bucket([]byte(bucket)).Get([]byte(key))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if value == nil {
+		return "", ErrNotFound
+	}
+	return string(value), nil
+}
+
+func (s *BoltStore) setValue(bucket, key, value string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), []byte(value))
+	})
+}
+
+// GetToken returns a cached access token or ErrNotFound
+func (s *BoltStore) GetToken(name string) (string, error) {
+	token, err := s.getValue("TokenBucket", name)
+	if err == nil && token == "" {
+		return "", ErrNotFound
+	}
+	return token, err
+}
+
+// SetToken caches an access token. An empty token removes the cache.
+func (s *BoltStore) SetToken(name, token string) error {
+	if token == "" {
+		return s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket([]byte("TokenBucket")).Delete([]byte(name))
+		})
+	}
+	return s.setValue("TokenBucket", name, token)
+}
+
+// GetConfig returns a configuration or cache value or ErrNotFound
+func (s *BoltStore) GetConfig(key string) (string, error) {
+	return s.getValue("ConfigBucket", key)
+}
+
+// SetConfig stores a configuration or cache value
+func (s *BoltStore) SetConfig(key, value string) error {
+	return s.setValue("ConfigBucket", key, value)
+}
+
+// ListConfig returns all configuration values, excluding the internal schema
+// version
+func (s *BoltStore) ListConfig() (map[string]string, error) {
+	values := make(map[string]string)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ConfigBucket")).ForEach(func(k, v []byte) error {
+			if string(k) != schemaVersionKey {
+				values[string(k)] = string(v)
+			}
+			return nil
+		})
+	})
+	return values, err
+}
+
+// Backup writes a consistent snapshot of the database to w
+func (s *BoltStore) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return n, err
+}
+
+// Check verifies the consistency of the bbolt pages & buckets
+func (s *BoltStore) Check() ([]string, error) {
+	problems := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		return nil
+	})
+	return problems, err
+}
+
+// SchemaVersion returns the schema version of the database & the latest
+// schema version
+func (s *BoltStore) SchemaVersion() (int, int, error) {
+	var version int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("ConfigBucket")) == nil {
+			return nil
+		}
+		var err error
+		version, err = schemaVersion(tx)
+		return err
+	})
+	return version, migrations[len(migrations)-1].version, err
+}
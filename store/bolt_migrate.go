@@ -0,0 +1,316 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// schemaVersionKey is the ConfigBucket key of the database schema version
+const schemaVersionKey = "schemaVersion"
+
+// migration upgrades the database schema to version. Migrations must be
+// idempotent as a migration may be interrupted and run again.
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx *bolt.Tx) error
+}
+
+// migrations is the ordered list of database schema migrations
+var migrations = []migration{
+	{1, "move twitch buckets to stream provider buckets", migrateTwitchBuckets},
+	{2, "combine publisher buckets into publisher documents", migratePublisherDocuments},
+	{3, "move cached access tokens to token bucket", migrateTokens},
+	{4, "index open sessions by publisher", migrateOpenSessions},
+	{5, "index publishers by discord id", migrateDiscordIDs},
+}
+
+// schemaVersion returns the current database schema version
+func schemaVersion(tx *bolt.Tx) (int, error) {
+	v := tx.Bucket([]byte("ConfigBucket")).Get([]byte(schemaVersionKey))
+	if v == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(v))
+}
+
+// migrateBolt runs all pending schema migrations in order. Each migration is
+// applied along with its schema version in a single transaction.
+func migrateBolt(db *bolt.DB) error {
+	for i := range migrations {
+		m := migrations[i]
+		err := db.Update(func(tx *bolt.Tx) error {
+			version, err := schemaVersion(tx)
+			if err != nil {
+				return err
+			}
+			if version >= m.version {
+				return nil
+			}
+			log.Infof("db: migrating schema to version %d: %s", m.version, m.description)
+			err = m.migrate(tx)
+			if err != nil {
+				return fmt.Errorf("schema migration %d failed: %s", m.version, err)
+			}
+			return tx.Bucket([]byte("ConfigBucket")).Put([]byte(schemaVersionKey), []byte(strconv.Itoa(m.version)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyTwitchBuckets are the twitch specific buckets replaced by the
+// generic stream provider buckets
+var legacyTwitchBuckets = []string{
+	"TwitchStreamBucket",
+	"TwitchLiveBucket",
+	"TwitchNotificationBucket",
+	"StreamInfoBucket",
+}
+
+// migrateTwitchBuckets moves the twitch channel names, live status,
+// notification state & stream info from the legacy twitch buckets into the
+// stream provider buckets and removes the legacy buckets.
+func migrateTwitchBuckets(tx *bolt.Tx) error {
+	streams := tx.Bucket([]byte("TwitchStreamBucket"))
+	if streams == nil {
+		return nil
+	}
+
+	legacyValue := func(bucket string, name []byte) string {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ""
+		}
+		return string(b.Get(name))
+	}
+
+	links, err := tx.CreateBucketIfNotExists([]byte("StreamLinkBucket"))
+	if err != nil {
+		return err
+	}
+	providers, err := tx.CreateBucketIfNotExists([]byte("ProviderStateBucket"))
+	if err != nil {
+		return err
+	}
+	states, err := providers.CreateBucketIfNotExists([]byte("twitch"))
+	if err != nil {
+		return err
+	}
+
+	err = streams.ForEach(func(name, channel []byte) error {
+		account := strings.ToLower(string(channel))
+		if account == "" {
+			return nil
+		}
+		refs := []map[string]string{}
+		if v := links.Get(name); v != nil {
+			err := json.Unmarshal(v, &refs)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range refs {
+			if refs[i]["provider"] == "twitch" && refs[i]["account"] == account {
+				return nil
+			}
+		}
+		refs = append(refs, map[string]string{"provider": "twitch", "account": account})
+		v, err := json.Marshal(refs)
+		if err != nil {
+			return err
+		}
+		err = links.Put(name, v)
+		if err != nil {
+			return err
+		}
+
+		state, err := json.Marshal(map[string]string{
+			"live":         legacyValue("TwitchLiveBucket", name),
+			"notification": legacyValue("TwitchNotificationBucket", name),
+			"stream_info":  legacyValue("StreamInfoBucket", name),
+		})
+		if err != nil {
+			return err
+		}
+		nb, err := states.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return nb.Put([]byte(account), state)
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := range legacyTwitchBuckets {
+		err = tx.DeleteBucket([]byte(legacyTwitchBuckets[i]))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// legacyPublisherBuckets are the per-field publisher buckets replaced by the
+// publisher documents
+var legacyPublisherBuckets = []string{
+	"RTMPLiveBucket",
+	"StreamLinkBucket",
+	"ProviderStateBucket",
+}
+
+// migratePublisherDocuments combines the stream key, live status, provider
+// links & provider state of each publisher into a single json document
+// stored in the PublisherBucket and removes the legacy buckets.
+func migratePublisherDocuments(tx *bolt.Tx) error {
+	publishers := tx.Bucket([]byte("PublisherBucket"))
+	live := tx.Bucket([]byte("RTMPLiveBucket"))
+	links := tx.Bucket([]byte("StreamLinkBucket"))
+	providers := tx.Bucket([]byte("ProviderStateBucket"))
+
+	documents := make(map[string][]byte)
+	err := publishers.ForEach(func(name, key []byte) error {
+		var r publisherRecord
+		// skip publishers which were already migrated
+		if json.Unmarshal(key, &r) == nil && r.Name == string(name) {
+			return nil
+		}
+		r = publisherRecord{Name: string(name), Key: string(key), Links: []linkRecord{}}
+		if live != nil {
+			r.RTMPLive = string(live.Get(name))
+		}
+		if links != nil {
+			if v := links.Get(name); v != nil {
+				err := json.Unmarshal(v, &r.Links)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for i := range r.Links {
+			l := &r.Links[i]
+			if providers == nil || providers.Bucket([]byte(l.Provider)) == nil {
+				continue
+			}
+			nb := providers.Bucket([]byte(l.Provider)).Bucket(name)
+			if nb == nil {
+				continue
+			}
+			if v := nb.Get([]byte(l.Account)); v != nil {
+				err := json.Unmarshal(v, &l.linkState)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		documents[string(name)] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, v := range documents {
+		err = publishers.Put([]byte(name), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range legacyPublisherBuckets {
+		err = tx.DeleteBucket([]byte(legacyPublisherBuckets[i]))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTokens moves the cached twitch access token from the ConfigBucket to
+// the TokenBucket
+func migrateTokens(tx *bolt.Tx) error {
+	config := tx.Bucket([]byte("ConfigBucket"))
+	token := config.Get([]byte("twitchAccessToken"))
+	if token == nil {
+		return nil
+	}
+	if len(token) > 0 {
+		err := tx.Bucket([]byte("TokenBucket")).Put([]byte("twitch"), token)
+		if err != nil {
+			return err
+		}
+	}
+	return config.Delete([]byte("twitchAccessToken"))
+}
+
+// migrateOpenSessions adds the sessions which have not ended to the open
+// session index
+func migrateOpenSessions(tx *bolt.Tx) error {
+	open := tx.Bucket([]byte("OpenSessionBucket"))
+	return tx.Bucket([]byte("SessionBucket")).ForEach(func(k, v []byte) error {
+		var session models.Session
+		err := json.Unmarshal(v, &session)
+		if err != nil {
+			return err
+		}
+		if !session.IsActive() {
+			return nil
+		}
+		return open.Put(openSessionKey(session), []byte{})
+	})
+}
+
+// migrateDiscordIDs adds the discord users of the publishers to the discord id
+// index. A discord user linked to several publishers stays linked to the
+// first publisher by name only.
+func migrateDiscordIDs(tx *bolt.Tx) error {
+	publishers := tx.Bucket([]byte("PublisherBucket"))
+	index := tx.Bucket([]byte("DiscordIDBucket"))
+	unlinked := make(map[string][]byte)
+	err := publishers.ForEach(func(k, v []byte) error {
+		var r publisherRecord
+		err := json.Unmarshal(v, &r)
+		if err != nil {
+			return err
+		}
+		if r.DiscordID == "" {
+			return nil
+		}
+		owner := index.Get([]byte(r.DiscordID))
+		if owner != nil && string(owner) != string(k) {
+			log.Warnf("db: unlinking discord user %s from publisher %s, already linked to publisher %s", r.DiscordID, k, owner)
+			r.DiscordID = ""
+			v, err = json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			unlinked[string(k)] = v
+			return nil
+		}
+		return index.Put([]byte(r.DiscordID), k)
+	})
+	if err != nil {
+		return err
+	}
+	// keys may not be modified while iterating
+	for name, v := range unlinked {
+		err = publishers.Put([]byte(name), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltMigrateOpenSessions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtmpauthbot.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	session, err := s.StartSession(models.Session{Publisher: "alice", Provider: models.SessionProviderRTMP, StartedAt: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revert to the schema before open sessions were indexed
+	err = s.DB().Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte("OpenSessionBucket"))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("ConfigBucket")).Put([]byte(schemaVersionKey), []byte("3"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	end := start.Add(time.Hour)
+	err = s.EndSession("alice", models.SessionProviderRTMP, "", end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, err := s.ListSessions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != session.ID || sessions[0].EndedAt == nil || !sessions[0].EndedAt.Equal(end) {
+		t.Errorf("expected the migrated open session to end, got %+v", sessions)
+	}
+}
+
+func TestBoltMigrateDiscordIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtmpauthbot.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revert to the schema before publishers were indexed by discord id, in
+	// which a discord user could be linked to several publishers
+	err = s.DB().Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"bob", "alice", "carol"} {
+			p := models.Publisher{Name: name, Key: name + "key", DiscordID: "1234", Revision: 1}
+			if name == "carol" {
+				p.DiscordID = "5678"
+			}
+			err := writePublisher(tx, &p)
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.DeleteBucket([]byte("DiscordIDBucket"))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("ConfigBucket")).Put([]byte(schemaVersionKey), []byte("4"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, name := range map[string]string{"1234": "alice", "5678": "carol"} {
+		p, err := s.GetPublisherByDiscordID(id)
+		if err != nil || p.Name != name {
+			t.Errorf("expected %s to be linked to %s, got %+v (%v)", id, name, p, err)
+		}
+	}
+	p, err := s.GetPublisher("bob")
+	if err != nil || p.DiscordID != "" {
+		t.Errorf("expected the duplicate link of bob to be removed, got %+v (%v)", p, err)
+	}
+}
+
+func TestBoltReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtmpauthbot.db")
+	s, err := OpenBolt(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpsertPublisher("alice", setKey("alicekey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DB().Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("ConfigBucket")).Put([]byte(schemaVersionKey), []byte("4"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the pending migration is reported but not applied
+	for i := 0; i < 2; i++ {
+		s, err = OpenBoltReadOnly(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, latest, err := s.SchemaVersion()
+		if err != nil || version != 4 || latest != migrations[len(migrations)-1].version {
+			t.Errorf("expected schema version 4 of %d, got %d of %d (%v)", migrations[len(migrations)-1].version, version, latest, err)
+		}
+		_, err = s.UpsertPublisher("bob", setKey("bobkey"))
+		if err == nil {
+			t.Error("expected the read-only store to refuse writes")
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,232 @@
+package store
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+// ExportVersion is the version of the export document format
+const ExportVersion = 1
+
+// Export is a backend independent document of all publishers, settings and
+// stream history. Cached access tokens are not exported.
+type Export struct {
+	Version    int                `json:"version"`
+	ExportedAt time.Time          `json:"exported_at"`
+	Publishers []models.Publisher `json:"publishers"`
+	Settings   map[string]string  `json:"settings"`
+	Sessions   []models.Session   `json:"sessions"`
+}
+
+// ImportReport lists the changes made, or that would be made in a dry run,
+// by an import
+type ImportReport struct {
+	Changes   []string
+	Unchanged int
+}
+
+// ExportData returns an export document of the store
+func ExportData(s Store) (Export, error) {
+	e := Export{Version: ExportVersion, ExportedAt: time.Now().UTC()}
+	var err error
+	e.Publishers, err = s.ListPublishers()
+	if err != nil {
+		return e, err
+	}
+	e.Settings, err = s.ListConfig()
+	if err != nil {
+		return e, err
+	}
+	sessions, err := s.ListSessions("")
+	if err != nil {
+		return e, err
+	}
+	// export history in chronological order
+	for i := len(sessions) - 1; i >= 0; i-- {
+		e.Sessions = append(e.Sessions, sessions[i])
+	}
+	if e.Sessions == nil {
+		e.Sessions = []models.Session{}
+	}
+	return e, nil
+}
+
+// sameLinks returns true if both lists link the same accounts in the same order
+func sameLinks(a, b []models.StreamLink) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Provider != b[i].Provider || a[i].Account != b[i].Account {
+			return false
+		}
+	}
+	return true
+}
+
+// importLinks returns the imported links keeping the tracked state of links
+// which already exist. Imported links start offline.
+func importLinks(existing, imported []models.StreamLink) []models.StreamLink {
+	links := []models.StreamLink{}
+	for i := range imported {
+		l := models.StreamLink{Provider: imported[i].Provider, Account: imported[i].Account}
+		for j := range existing {
+			if existing[j].Provider == l.Provider && existing[j].Account == l.Account {
+				l.LinkState = existing[j].LinkState
+				break
+			}
+		}
+		l.Normalize()
+		links = append(links, l)
+	}
+	return links
+}
+
+// ImportData merges an export document into the store. Publishers and
+// settings are added or updated and sessions are added by ID, nothing is
+// deleted. The store is left unmodified if dryRun is set.
+func ImportData(s Store, e Export, dryRun bool) (ImportReport, error) {
+	var report ImportReport
+	if e.Version < 1 || e.Version > ExportVersion {
+		return report, fmt.Errorf("unsupported export version: %d", e.Version)
+	}
+
+	for i := range e.Publishers {
+		imported := e.Publishers[i]
+		err := imported.IsValid()
+		if err != nil {
+			return report, fmt.Errorf("invalid publisher '%s': %s", imported.Name, err)
+		}
+		existing, err := s.GetPublisher(imported.Name)
+		if err != nil && err != ErrNotFound {
+			return report, err
+		}
+		switch {
+		case err == ErrNotFound:
+			report.Changes = append(report.Changes, fmt.Sprintf("add publisher %s", imported.Name))
+		case existing.Key != imported.Key || existing.Unlisted != imported.Unlisted || existing.DiscordID != imported.DiscordID ||
+			strings.Join(existing.Muted, ",") != strings.Join(imported.Muted, ",") || !sameLinks(existing.Links, imported.Links):
+			var fields []string
+			if existing.Key != imported.Key {
+				fields = append(fields, "key")
+			}
+			if existing.Unlisted != imported.Unlisted {
+				fields = append(fields, "unlisted")
+			}
+			if existing.DiscordID != imported.DiscordID {
+				fields = append(fields, "discord_id")
+			}
+			if strings.Join(existing.Muted, ",") != strings.Join(imported.Muted, ",") {
+				fields = append(fields, "muted")
+			}
+			if !sameLinks(existing.Links, imported.Links) {
+				fields = append(fields, "links")
+			}
+			report.Changes = append(report.Changes, fmt.Sprintf("update publisher %s: %s", imported.Name, strings.Join(fields, ", ")))
+		default:
+			report.Unchanged++
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		_, err = s.UpsertPublisher(imported.Name, func(p *models.Publisher) error {
+			p.Key = imported.Key
+			p.Unlisted = imported.Unlisted
+			p.DiscordID = imported.DiscordID
+			p.Muted = imported.Muted
+			p.Links = importLinks(p.Links, imported.Links)
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+
+	settings, err := s.ListConfig()
+	if err != nil {
+		return report, err
+	}
+	keys := make([]string, 0, len(e.Settings))
+	for k := range e.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		current, ok := settings[k]
+		switch {
+		case !ok:
+			report.Changes = append(report.Changes, fmt.Sprintf("add setting %s", k))
+		case current != e.Settings[k]:
+			report.Changes = append(report.Changes, fmt.Sprintf("update setting %s", k))
+		default:
+			report.Unchanged++
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		err = s.SetConfig(k, e.Settings[k])
+		if err != nil {
+			return report, err
+		}
+	}
+
+	sessions, err := s.ListSessions("")
+	if err != nil {
+		return report, err
+	}
+	existingSessions := make(map[int64]models.Session)
+	for i := range sessions {
+		existingSessions[sessions[i].ID] = sessions[i]
+	}
+	added, updated := 0, 0
+	for i := range e.Sessions {
+		current, ok := existingSessions[e.Sessions[i].ID]
+		switch {
+		case !ok:
+			added++
+		case !sameSession(current, e.Sessions[i]):
+			updated++
+		default:
+			report.Unchanged++
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		err = s.ImportSession(e.Sessions[i])
+		if err != nil {
+			return report, err
+		}
+	}
+	if added > 0 {
+		report.Changes = append(report.Changes, fmt.Sprintf("add %d sessions", added))
+	}
+	if updated > 0 {
+		report.Changes = append(report.Changes, fmt.Sprintf("update %d sessions", updated))
+	}
+
+	return report, nil
+}
+
+// sameSession compares sessions ignoring time zones & monotonic clock readings
+func sameSession(a, b models.Session) bool {
+	if !a.StartedAt.Equal(b.StartedAt) {
+		return false
+	}
+	if (a.EndedAt == nil) != (b.EndedAt == nil) {
+		return false
+	}
+	if a.EndedAt != nil && !a.EndedAt.Equal(*b.EndedAt) {
+		return false
+	}
+	a.StartedAt, b.StartedAt = time.Time{}, time.Time{}
+	a.EndedAt, b.EndedAt = nil, nil
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,686 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+
+	// registers the pure go "sqlite" database/sql driver
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is the SQLite implementation of Store. Publishers, links and
+// sessions are stored in relational tables so stream history may be queried
+// with SQL by other tools.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// sqliteMigrations is the ordered list of SQLite schema migrations. The
+// schema version is tracked with PRAGMA user_version.
+var sqliteMigrations = []string{
+	// version 1: initial schema
+	`CREATE TABLE IF NOT EXISTS publishers (
+		name       TEXT PRIMARY KEY,
+		stream_key TEXT NOT NULL,
+		rtmp_live  TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS links (
+		publisher    TEXT NOT NULL,
+		position     INTEGER NOT NULL,
+		provider     TEXT NOT NULL,
+		account      TEXT NOT NULL,
+		live         TEXT NOT NULL DEFAULT '',
+		state        TEXT NOT NULL DEFAULT '',
+		missed       INTEGER NOT NULL DEFAULT 0,
+		missed_since TEXT,
+		notification TEXT NOT NULL DEFAULT '',
+		stream_info  TEXT NOT NULL DEFAULT '{}',
+		PRIMARY KEY (publisher, provider, account)
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		publisher  TEXT NOT NULL,
+		provider   TEXT NOT NULL,
+		account    TEXT NOT NULL DEFAULT '',
+		title      TEXT NOT NULL DEFAULT '',
+		game       TEXT NOT NULL DEFAULT '',
+		started_at TEXT NOT NULL,
+		ended_at   TEXT
+	);
+	CREATE INDEX IF NOT EXISTS sessions_publisher ON sessions (publisher, id);
+	CREATE TABLE IF NOT EXISTS tokens (
+		name  TEXT PRIMARY KEY,
+		token TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS config (
+		key   TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+	// version 2: publisher revisions
+	`ALTER TABLE publishers ADD COLUMN revision INTEGER NOT NULL DEFAULT 0;`,
+	// version 3: unlisted publishers
+	`ALTER TABLE publishers ADD COLUMN unlisted INTEGER NOT NULL DEFAULT 0;`,
+	// version 4: member portal discord users & muted notifications
+	`ALTER TABLE publishers ADD COLUMN discord_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE publishers ADD COLUMN muted TEXT NOT NULL DEFAULT '';`,
+	// version 5: a discord user is linked to one publisher, the first
+	// publisher by name keeps existing duplicates
+	`UPDATE publishers SET discord_id = '' WHERE discord_id != '' AND name NOT IN
+		(SELECT MIN(name) FROM publishers WHERE discord_id != '' GROUP BY discord_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS publishers_discord_id ON publishers (discord_id) WHERE discord_id != '';`,
+}
+
+// OpenSQLite opens the SQLite database at path and runs any pending schema
+// migrations
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer, serialize access through one connection
+	db.SetMaxOpenConns(1)
+
+	s := &SQLiteStore{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// OpenSQLiteReadOnly opens the SQLite database at path read-only without
+// running the schema migrations
+func OpenSQLiteReadOnly(path string) (*SQLiteStore, error) {
+	dsn := fmt.Sprintf("file:%s?mode=ro&_pragma=busy_timeout(5000)", path)
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	// sql.Open does not connect, fail early if the database cannot be read
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) migrate() error {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for i := version; i < len(sqliteMigrations); i++ {
+		log.Infof("db: migrating sqlite schema to version %d", i+1)
+		err = s.transaction(func(tx *sql.Tx) error {
+			_, err := tx.Exec(sqliteMigrations[i])
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("schema migration %d failed: %s", i+1, err)
+		}
+	}
+	return nil
+}
+
+// transaction runs fn in a transaction which is committed if fn succeeds
+func (s *SQLiteStore) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func formatTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseTime(value sql.NullString) (time.Time, error) {
+	if !value.Valid || value.String == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, value.String)
+}
+
+func sqliteReadLinks(q queryer, name string) ([]models.StreamLink, error) {
+	rows, err := q.Query(`SELECT provider, account, live, state, missed, missed_since,
+		notification, stream_info FROM links WHERE publisher = ? ORDER BY position`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []models.StreamLink{}
+	for rows.Next() {
+		var (
+			l           models.StreamLink
+			missedSince sql.NullString
+			streamInfo  string
+		)
+		err = rows.Scan(&l.Provider, &l.Account, &l.Live, &l.State, &l.Missed,
+			&missedSince, &l.Notification, &streamInfo)
+		if err != nil {
+			return nil, err
+		}
+		l.MissedSince, err = parseTime(missedSince)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(streamInfo), &l.StreamInfo)
+		if err != nil {
+			return nil, err
+		}
+		l.Normalize()
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// publisherColumns are the columns read by sqliteScanPublisher
+const publisherColumns = "name, stream_key, rtmp_live, unlisted, discord_id, muted, revision"
+
+// sqliteScanPublisher reads the publisherColumns of a row
+func sqliteScanPublisher(row interface{ Scan(...interface{}) error }) (models.Publisher, error) {
+	var (
+		p     models.Publisher
+		muted string
+	)
+	err := row.Scan(&p.Name, &p.Key, &p.RTMPLive, &p.Unlisted, &p.DiscordID, &muted, &p.Revision)
+	if muted != "" {
+		p.Muted = strings.Split(muted, ",")
+	}
+	return p, err
+}
+
+func sqliteReadPublisher(q queryer, name string) (models.Publisher, error) {
+	p, err := sqliteScanPublisher(q.QueryRow("SELECT "+publisherColumns+" FROM publishers WHERE name = ?", name))
+	p.Name = name
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	p.Links, err = sqliteReadLinks(q, name)
+	return p, err
+}
+
+func sqliteWritePublisher(tx *sql.Tx, p *models.Publisher) error {
+	_, err := tx.Exec(`INSERT INTO publishers (`+publisherColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET stream_key = excluded.stream_key, rtmp_live = excluded.rtmp_live,
+		unlisted = excluded.unlisted, discord_id = excluded.discord_id, muted = excluded.muted,
+		revision = excluded.revision`,
+		p.Name, p.Key, p.RTMPLive, p.Unlisted, p.DiscordID, strings.Join(p.Muted, ","), p.Revision)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM links WHERE publisher = ?", p.Name)
+	if err != nil {
+		return err
+	}
+	for i := range p.Links {
+		l := p.Links[i]
+		streamInfo, err := json.Marshal(l.StreamInfo)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO links (publisher, position, provider, account, live, state,
+			missed, missed_since, notification, stream_info) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.Name, i, l.Provider, l.Account, l.Live, l.State, l.Missed,
+			formatTime(l.MissedSince), l.Notification, string(streamInfo))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPublisher returns the publisher or ErrNotFound
+func (s *SQLiteStore) GetPublisher(name string) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.transaction(func(tx *sql.Tx) error {
+		var err error
+		p, err = sqliteReadPublisher(tx, name)
+		return err
+	})
+	return p, err
+}
+
+// GetPublisherByDiscordID returns the publisher linked to a discord user or
+// ErrNotFound
+func (s *SQLiteStore) GetPublisherByDiscordID(id string) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.transaction(func(tx *sql.Tx) error {
+		var name string
+		err := tx.QueryRow("SELECT name FROM publishers WHERE discord_id = ? AND discord_id != ''", id).Scan(&name)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		p, err = sqliteReadPublisher(tx, name)
+		return err
+	})
+	return p, err
+}
+
+// ListPublishers returns all publishers ordered by name
+func (s *SQLiteStore) ListPublishers() ([]models.Publisher, error) {
+	publishers := []models.Publisher{}
+	err := s.transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT " + publisherColumns + " FROM publishers ORDER BY name")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			p, err := sqliteScanPublisher(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			publishers = append(publishers, p)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		for i := range publishers {
+			publishers[i].Links, err = sqliteReadLinks(tx, publishers[i].Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return publishers, nil
+}
+
+// sqliteLiveFilter is the condition of publishers streaming locally or on any
+// linked account
+const sqliteLiveFilter = `(p.rtmp_live != '' OR EXISTS (SELECT 1 FROM links l
+	WHERE l.publisher = p.name AND l.live != ''))`
+
+// sqliteFilter appends the condition, negated if match is false
+func sqliteFilter(where []string, condition string, match *bool) []string {
+	if match == nil {
+		return where
+	}
+	if !*match {
+		condition = "NOT " + condition
+	}
+	return append(where, condition)
+}
+
+// QueryPublishers returns a page of the publishers matching the query. All
+// filters are applied in SQL so only the requested page is read.
+func (s *SQLiteStore) QueryPublishers(q PublisherQuery) ([]models.Publisher, string, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if q.Prefix != "" {
+		where = append(where, "p.name >= ?")
+		args = append(args, q.Prefix)
+		if end := prefixEnd([]byte(q.Prefix)); end != nil {
+			where = append(where, "p.name < ?")
+			args = append(args, string(end))
+		}
+	}
+	if q.After != "" {
+		if q.Descending {
+			where = append(where, "p.name < ?")
+		} else {
+			where = append(where, "p.name > ?")
+		}
+		args = append(args, q.After)
+	}
+	order := "ASC"
+	if q.Descending {
+		order = "DESC"
+	}
+	where = sqliteFilter(where, sqliteLiveFilter, q.Live)
+	where = sqliteFilter(where, `EXISTS (SELECT 1 FROM links l WHERE l.publisher = p.name
+		AND l.provider = 'twitch' AND l.live != '')`, q.TwitchLive)
+	where = sqliteFilter(where, `EXISTS (SELECT 1 FROM links l WHERE l.publisher = p.name
+		AND l.provider = 'twitch')`, q.HasTwitch)
+	query := fmt.Sprintf(`SELECT %s FROM publishers p WHERE %s ORDER BY p.name %s`,
+		publisherColumns, strings.Join(where, " AND "), order)
+	if q.Limit > 0 {
+		// read one publisher past the limit to detect the last page
+		query += " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+
+	publishers := []models.Publisher{}
+	err := s.transaction(func(tx *sql.Tx) error {
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			p, err := sqliteScanPublisher(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			publishers = append(publishers, p)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+		for i := range publishers {
+			publishers[i].Links, err = sqliteReadLinks(tx, publishers[i].Name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if q.Limit > 0 && len(publishers) > q.Limit {
+		publishers = publishers[:q.Limit]
+		next = publishers[q.Limit-1].Name
+	}
+	return publishers, next, nil
+}
+
+func (s *SQLiteStore) updatePublisher(name string, create bool, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	var p models.Publisher
+	err := s.transaction(func(tx *sql.Tx) error {
+		var err error
+		p, err = sqliteReadPublisher(tx, name)
+		exists := err == nil
+		if err == ErrNotFound && create {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		err = applyUpdate(&p, name, exists, fn)
+		if err != nil {
+			return err
+		}
+		if p.DiscordID != "" {
+			var owner string
+			err = tx.QueryRow("SELECT name FROM publishers WHERE discord_id = ? AND name != ?", p.DiscordID, name).Scan(&owner)
+			if err == nil {
+				return &DiscordIDTakenError{DiscordID: p.DiscordID, Publisher: owner}
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+		}
+		return sqliteWritePublisher(tx, &p)
+	})
+	if err == errUnchanged {
+		err = nil
+	}
+	if err != nil {
+		return models.Publisher{}, err
+	}
+	return p, nil
+}
+
+// UpdatePublisher reads, modifies & writes an existing publisher
+func (s *SQLiteStore) UpdatePublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	return s.updatePublisher(name, false, fn)
+}
+
+// UpsertPublisher reads, modifies & writes a publisher, creating it if needed
+func (s *SQLiteStore) UpsertPublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error) {
+	return s.updatePublisher(name, true, fn)
+}
+
+// DeletePublisher removes a publisher or returns ErrNotFound
+func (s *SQLiteStore) DeletePublisher(name string, check func(p *models.Publisher) error) error {
+	return s.transaction(func(tx *sql.Tx) error {
+		p, err := sqliteReadPublisher(tx, name)
+		if err != nil {
+			return err
+		}
+		if check != nil {
+			err = check(&p)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("DELETE FROM publishers WHERE name = ?", name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM links WHERE publisher = ?", name)
+		return err
+	})
+}
+
+// StartSession records the start of a session and returns it with its ID
+func (s *SQLiteStore) StartSession(session models.Session) (models.Session, error) {
+	var endedAt interface{}
+	if session.EndedAt != nil {
+		endedAt = formatTime(*session.EndedAt)
+	}
+	res, err := s.db.Exec(`INSERT INTO sessions (publisher, provider, account, title, game,
+		started_at, ended_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		session.Publisher, session.Provider, session.Account, session.Title, session.Game,
+		formatTime(session.StartedAt), endedAt)
+	if err != nil {
+		return session, err
+	}
+	session.ID, err = res.LastInsertId()
+	return session, err
+}
+
+// EndSession ends the active sessions of a publisher on a provider account
+func (s *SQLiteStore) EndSession(publisher, provider, account string, endedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE sessions SET ended_at = ? WHERE ended_at IS NULL
+		AND publisher = ? AND provider = ? AND account = ?`,
+		formatTime(endedAt), publisher, provider, account)
+	return err
+}
+
+// ListSessions returns the sessions of a publisher, most recent first
+func (s *SQLiteStore) ListSessions(publisher string) ([]models.Session, error) {
+	rows, err := s.db.Query(`SELECT id, publisher, provider, account, title, game, started_at,
+		ended_at FROM sessions WHERE ? = '' OR publisher = ? ORDER BY id DESC`, publisher, publisher)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var (
+			session   models.Session
+			startedAt sql.NullString
+			endedAt   sql.NullString
+		)
+		err = rows.Scan(&session.ID, &session.Publisher, &session.Provider, &session.Account,
+			&session.Title, &session.Game, &startedAt, &endedAt)
+		if err != nil {
+			return nil, err
+		}
+		session.StartedAt, err = parseTime(startedAt)
+		if err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			t, err := parseTime(endedAt)
+			if err != nil {
+				return nil, err
+			}
+			session.EndedAt = &t
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// ImportSession stores a session with its existing ID, replacing any session
+// with the same ID
+func (s *SQLiteStore) ImportSession(session models.Session) error {
+	if session.ID < 1 {
+		return fmt.Errorf("invalid session id: %d", session.ID)
+	}
+	var endedAt interface{}
+	if session.EndedAt != nil {
+		endedAt = formatTime(*session.EndedAt)
+	}
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (id, publisher, provider, account,
+		title, game, started_at, ended_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.ID, session.Publisher, session.Provider, session.Account, session.Title,
+		session.Game, formatTime(session.StartedAt), endedAt)
+	return err
+}
+
+func (s *SQLiteStore) getValue(table, column, keyColumn, key string) (string, error) {
+	var value string
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", column, table, keyColumn)
+	err := s.db.QueryRow(query, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// GetToken returns a cached access token or ErrNotFound
+func (s *SQLiteStore) GetToken(name string) (string, error) {
+	return s.getValue("tokens", "token", "name", name)
+}
+
+// SetToken caches an access token. An empty token removes the cache.
+func (s *SQLiteStore) SetToken(name, token string) error {
+	if token == "" {
+		_, err := s.db.Exec("DELETE FROM tokens WHERE name = ?", name)
+		return err
+	}
+	_, err := s.db.Exec(`INSERT INTO tokens (name, token) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET token = excluded.token`, name, token)
+	return err
+}
+
+// GetConfig returns a configuration or cache value or ErrNotFound
+func (s *SQLiteStore) GetConfig(key string) (string, error) {
+	return s.getValue("config", "value", "key", key)
+}
+
+// SetConfig stores a configuration or cache value
+func (s *SQLiteStore) SetConfig(key, value string) error {
+	_, err := s.db.Exec(`INSERT INTO config (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`, key, value)
+	return err
+}
+
+// ListConfig returns all configuration values
+func (s *SQLiteStore) ListConfig() (map[string]string, error) {
+	rows, err := s.db.Query("SELECT key, value FROM config")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+// Backup writes a consistent snapshot of the database to w
+func (s *SQLiteStore) Backup(w io.Writer) (int64, error) {
+	dir, err := os.MkdirTemp("", "rtmpauthbot-backup")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot := filepath.Join(dir, "snapshot.sqlite")
+	_, err = s.db.Exec("VACUUM INTO ?", snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// Check runs the sqlite integrity check
+func (s *SQLiteStore) Check() ([]string, error) {
+	rows, err := s.db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result)
+		if err != nil {
+			return nil, err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	return problems, rows.Err()
+}
+
+// SchemaVersion returns the schema version of the database & the latest
+// schema version
+func (s *SQLiteStore) SchemaVersion() (int, int, error) {
+	var version int
+	err := s.db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, len(sqliteMigrations), err
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteMigrateDiscordIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtmpauthbot.sqlite")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// revert to the schema before discord ids were unique, in which a discord
+	// user could be linked to several publishers
+	_, err = s.db.Exec(`DROP INDEX publishers_discord_id;
+		INSERT INTO publishers (name, stream_key, discord_id) VALUES
+			('bob', 'bobkey', '1234'), ('alice', 'alicekey', '1234'), ('carol', 'carolkey', '5678');
+		PRAGMA user_version = 4;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for id, name := range map[string]string{"1234": "alice", "5678": "carol"} {
+		p, err := s.GetPublisherByDiscordID(id)
+		if err != nil || p.Name != name {
+			t.Errorf("expected %s to be linked to %s, got %+v (%v)", id, name, p, err)
+		}
+	}
+	p, err := s.GetPublisher("bob")
+	if err != nil || p.DiscordID != "" {
+		t.Errorf("expected the duplicate link of bob to be removed, got %+v (%v)", p, err)
+	}
+}
+
+func TestSQLiteReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rtmpauthbot.sqlite")
+	s, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpsertPublisher("alice", setKey("alicekey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.db.Exec("PRAGMA user_version = 4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// the pending migration is reported but not applied
+	for i := 0; i < 2; i++ {
+		s, err = OpenSQLiteReadOnly(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, latest, err := s.SchemaVersion()
+		if err != nil || version != 4 || latest != len(sqliteMigrations) {
+			t.Errorf("expected schema version 4 of %d, got %d of %d (%v)", len(sqliteMigrations), version, latest, err)
+		}
+		_, err = s.UpsertPublisher("bob", setKey("bobkey"))
+		if err == nil {
+			t.Error("expected the read-only store to refuse writes")
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,246 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+)
+
+// Supported storage backends
+const (
+	BackendBolt   = "bolt"
+	BackendSQLite = "sqlite"
+)
+
+// ErrNotFound is returned when a requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// DiscordIDTakenError is returned when a publisher is linked to a discord user
+// which is already linked to another publisher
+type DiscordIDTakenError struct {
+	DiscordID string
+	Publisher string
+}
+
+func (e *DiscordIDTakenError) Error() string {
+	return fmt.Sprintf("discord user %s is already linked to publisher '%s'", e.DiscordID, e.Publisher)
+}
+
+// Store is the persistence layer for publishers, stream sessions, access
+// tokens and general configuration & caching. Implementations must apply
+// each call in a single transaction.
+type Store interface {
+	// GetPublisher returns the publisher or ErrNotFound
+	GetPublisher(name string) (models.Publisher, error)
+	// GetPublisherByDiscordID returns the publisher linked to a discord user
+	// or ErrNotFound
+	GetPublisherByDiscordID(id string) (models.Publisher, error)
+	// ListPublishers returns all publishers ordered by name
+	ListPublishers() ([]models.Publisher, error)
+	// QueryPublishers returns a page of the publishers matching the query and
+	// the name to continue the next page after, which is empty on the last
+	// page
+	QueryPublishers(q PublisherQuery) ([]models.Publisher, string, error)
+	// UpdatePublisher reads, modifies & writes an existing publisher and
+	// returns the stored publisher. The publisher is not written if fn returns
+	// an error or changes nothing. The revision of the publisher is
+	// incremented on each write. A DiscordIDTakenError is returned if the
+	// discord user is linked to another publisher.
+	UpdatePublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error)
+	// UpsertPublisher is UpdatePublisher but creates the publisher if it does
+	// not exist, in which case fn receives a publisher with only Name set
+	UpsertPublisher(name string, fn func(p *models.Publisher) error) (models.Publisher, error)
+	// DeletePublisher removes a publisher or returns ErrNotFound. The
+	// publisher is not removed if check returns an error, check may be nil.
+	DeletePublisher(name string, check func(p *models.Publisher) error) error
+
+	// StartSession records the start of a session and returns it with its ID
+	StartSession(s models.Session) (models.Session, error)
+	// EndSession ends the active sessions of a publisher on a provider account
+	EndSession(publisher, provider, account string, endedAt time.Time) error
+	// ListSessions returns the sessions of a publisher, most recent first. All
+	// sessions are returned if publisher is empty.
+	ListSessions(publisher string) ([]models.Session, error)
+	// ImportSession stores a session with its existing ID, replacing any
+	// session with the same ID
+	ImportSession(s models.Session) error
+
+	// GetToken returns a cached access token or ErrNotFound
+	GetToken(name string) (string, error)
+	// SetToken caches an access token. An empty token removes the cache.
+	SetToken(name, token string) error
+
+	// GetConfig returns a configuration or cache value or ErrNotFound
+	GetConfig(key string) (string, error)
+	// SetConfig stores a configuration or cache value
+	SetConfig(key, value string) error
+	// ListConfig returns all configuration values, excluding the internal
+	// schema version
+	ListConfig() (map[string]string, error)
+
+	// Backup writes a consistent snapshot of the database to w
+	Backup(w io.Writer) (int64, error)
+	// Check verifies the integrity of the database file and returns the
+	// problems found
+	Check() ([]string, error)
+	// SchemaVersion returns the schema version of the database & the latest
+	// schema version, which only differ for stores opened read-only
+	SchemaVersion() (int, int, error)
+	// Close closes the underlying database
+	Close() error
+}
+
+// PublisherQuery selects a page of publishers ordered by name. Nil filters
+// match all publishers.
+type PublisherQuery struct {
+	// Prefix only matches names starting with the prefix
+	Prefix string
+	// After continues the listing after this name
+	After string
+	// Limit is the maximum number of publishers returned, 0 for no limit
+	Limit int
+	// Descending orders publishers by name in descending order
+	Descending bool
+	// Live matches publishers streaming locally or on any linked account
+	Live *bool
+	// TwitchLive matches publishers live on any linked twitch account
+	TwitchLive *bool
+	// HasTwitch matches publishers with a linked twitch account
+	HasTwitch *bool
+}
+
+// Match returns true if the publisher matches the filters of the query
+func (q *PublisherQuery) Match(p *models.Publisher) bool {
+	if q.Live != nil && p.IsLive() != *q.Live {
+		return false
+	}
+	if q.TwitchLive != nil && p.IsTwitchLive() != *q.TwitchLive {
+		return false
+	}
+	if q.HasTwitch != nil && (p.Link("twitch") != nil) != *q.HasTwitch {
+		return false
+	}
+	return true
+}
+
+// errUnchanged rolls back the transaction of a publisher update which changed
+// nothing
+var errUnchanged = errors.New("publisher unchanged")
+
+// publisherState returns the stored state of a publisher, nil & empty lists
+// are stored alike
+func publisherState(p *models.Publisher) ([]byte, error) {
+	r := newPublisherRecord(p)
+	if len(r.Muted) == 0 {
+		r.Muted = nil
+	}
+	for i := range r.Links {
+		if len(r.Links[i].StreamInfo.Tags) == 0 {
+			r.Links[i].StreamInfo.Tags = nil
+		}
+	}
+	return json.Marshal(r)
+}
+
+// editableState returns the fields of a publisher which are edited by users,
+// the live state tracked by the server is left out
+func editableState(p *models.Publisher) ([]byte, error) {
+	type link struct {
+		Provider string `json:"provider"`
+		Account  string `json:"account"`
+	}
+	state := struct {
+		Key       string   `json:"key"`
+		Links     []link   `json:"links"`
+		Unlisted  bool     `json:"unlisted"`
+		DiscordID string   `json:"discord_id"`
+		Muted     []string `json:"muted"`
+	}{Key: p.Key, Unlisted: p.Unlisted, DiscordID: p.DiscordID}
+	for i := range p.Links {
+		state.Links = append(state.Links, link{Provider: p.Links[i].Provider, Account: p.Links[i].Account})
+	}
+	if len(p.Muted) > 0 {
+		state.Muted = p.Muted
+	}
+	return json.Marshal(state)
+}
+
+// applyUpdate runs the func of UpdatePublisher & UpsertPublisher on a
+// publisher read from the database, exists is false if the publisher is about
+// to be created. The revision is incremented if a user editable field
+// changed, so live state updates do not invalidate the ETag of the publisher.
+// errUnchanged is returned if fn changed nothing.
+func applyUpdate(p *models.Publisher, name string, exists bool, fn func(p *models.Publisher) error) error {
+	before, err := publisherState(p)
+	if err != nil {
+		return err
+	}
+	editable, err := editableState(p)
+	if err != nil {
+		return err
+	}
+	revision := p.Revision
+	err = fn(p)
+	if err != nil {
+		return err
+	}
+	p.Name = name
+	p.Revision = revision
+	after, err := publisherState(p)
+	if err != nil {
+		return err
+	}
+	if exists && bytes.Equal(before, after) {
+		return errUnchanged
+	}
+	edited, err := editableState(p)
+	if err != nil {
+		return err
+	}
+	if !exists || !bytes.Equal(editable, edited) {
+		p.Revision = revision + 1
+	}
+	return nil
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix or
+// nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// Open opens the store of the backend at path, creating & migrating the
+// database schema as required
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case "", BackendBolt:
+		return OpenBolt(path)
+	case BackendSQLite:
+		return OpenSQLite(path)
+	}
+	return nil, fmt.Errorf("unsupported database backend: %s", backend)
+}
+
+// OpenReadOnly opens the store of the backend at path read-only. The database
+// schema is neither created nor migrated.
+func OpenReadOnly(backend, path string) (Store, error) {
+	switch backend {
+	case "", BackendBolt:
+		return OpenBoltReadOnly(path)
+	case BackendSQLite:
+		return OpenSQLiteReadOnly(path)
+	}
+	return nil, fmt.Errorf("unsupported database backend: %s", backend)
+}
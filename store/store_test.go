@@ -0,0 +1,742 @@
+package store
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bcambl/rtmpauthbot/models"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	log.SetLevel(log.WarnLevel)
+}
+
+// backends opens each store implementation in a temporary directory
+var backends = []struct {
+	name string
+	open func(dir string) (Store, error)
+}{
+	{BackendBolt, func(dir string) (Store, error) { return OpenBolt(filepath.Join(dir, "rtmpauthbot.db")) }},
+	{BackendSQLite, func(dir string) (Store, error) { return OpenSQLite(filepath.Join(dir, "rtmpauthbot.sqlite")) }},
+}
+
+// openStore opens a new empty store of the backend which is closed when the
+// test completes
+func openStore(t *testing.T, backend string) Store {
+	t.Helper()
+	for _, b := range backends {
+		if b.name != backend {
+			continue
+		}
+		s, err := b.open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	t.Fatalf("unknown backend: %s", backend)
+	return nil
+}
+
+// conformance lists the behaviour all store implementations must share
+var conformance = []struct {
+	name string
+	run  func(t *testing.T, backend string)
+}{
+	{"Publishers", testPublishers},
+	{"PublisherLinks", testPublisherLinks},
+	{"Revisions", testRevisions},
+	{"DiscordIDs", testDiscordIDs},
+	{"QueryPublishers", testQueryPublishers},
+	{"Sessions", testSessions},
+	{"Tokens", testTokens},
+	{"Config", testConfig},
+	{"ExportImport", testExportImport},
+	{"Backup", testBackup},
+}
+
+func TestConformance(t *testing.T) {
+	for _, b := range backends {
+		for _, tc := range conformance {
+			t.Run(b.name+"/"+tc.name, func(t *testing.T) {
+				tc.run(t, b.name)
+			})
+		}
+	}
+}
+
+// setKey returns an update func setting the key of a publisher
+func setKey(key string) func(p *models.Publisher) error {
+	return func(p *models.Publisher) error {
+		p.Key = key
+		return nil
+	}
+}
+
+func testPublishers(t *testing.T, backend string) {
+	s := openStore(t, backend)
+
+	_, err := s.GetPublisher("alice")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	_, err = s.UpdatePublisher("alice", setKey("k"))
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound updating a missing publisher, got %v", err)
+	}
+	err = s.DeletePublisher("alice", nil)
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound deleting a missing publisher, got %v", err)
+	}
+
+	for _, name := range []string{"carol", "alice", "bob"} {
+		_, err = s.UpsertPublisher(name, func(p *models.Publisher) error {
+			if p.Name != name || p.Key != "" {
+				t.Errorf("expected a new publisher %s, got %+v", name, p)
+			}
+			p.Key = name + "-key"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = s.UpdatePublisher("alice", func(p *models.Publisher) error {
+		p.Unlisted = true
+		p.DiscordID = "1234"
+		p.Muted = []string{models.NotifyViewers}
+		p.RTMPLive = "live"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.GetPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Key != "alice-key" || !p.Unlisted || p.DiscordID != "1234" || p.RTMPLive != "live" ||
+		!reflect.DeepEqual(p.Muted, []string{models.NotifyViewers}) {
+		t.Errorf("unexpected publisher: %+v", p)
+	}
+
+	// a failing update func leaves the publisher unmodified
+	failed := errors.New("failed")
+	_, err = s.UpdatePublisher("alice", func(p *models.Publisher) error {
+		p.Key = "changed"
+		return failed
+	})
+	if err != failed {
+		t.Fatalf("expected the update func error, got %v", err)
+	}
+	p, _ = s.GetPublisher("alice")
+	if p.Key != "alice-key" {
+		t.Errorf("expected the failed update to be discarded, got key %s", p.Key)
+	}
+
+	publishers, err := s.ListPublishers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for i := range publishers {
+		names = append(names, publishers[i].Name)
+	}
+	if !reflect.DeepEqual(names, []string{"alice", "bob", "carol"}) {
+		t.Errorf("expected publishers ordered by name, got %v", names)
+	}
+
+	err = s.DeletePublisher("bob", func(p *models.Publisher) error { return failed })
+	if err != failed {
+		t.Fatalf("expected the check error, got %v", err)
+	}
+	err = s.DeletePublisher("bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetPublisher("bob")
+	if err != ErrNotFound {
+		t.Errorf("expected the publisher to be deleted, got %v", err)
+	}
+}
+
+func testPublisherLinks(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	missedSince := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	links := []models.StreamLink{
+		{Provider: "twitch", Account: "alice_tv", LinkState: models.LinkState{
+			Live: "live", State: models.StateMaybeOffline, Missed: 2, MissedSince: missedSince,
+			Notification: "alice is live", StreamInfo: models.StreamInfo{Title: "speedrun", GameName: "Celeste", Tags: []string{"any%"}},
+		}},
+		{Provider: "owncast", Account: "https://owncast.example.com"},
+	}
+	_, err := s.UpsertPublisher("alice", func(p *models.Publisher) error {
+		p.Key = "k"
+		p.Links = links
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.GetPublisher("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Links) != 2 {
+		t.Fatalf("expected 2 links, got %+v", p.Links)
+	}
+	got, want := p.Links[0], links[0]
+	if !got.MissedSince.Equal(want.MissedSince) {
+		t.Errorf("expected missed since %s, got %s", want.MissedSince, got.MissedSince)
+	}
+	got.MissedSince, want.MissedSince = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected link %+v, got %+v", want, got)
+	}
+	if p.Links[1].Provider != "owncast" || p.Links[1].Account != links[1].Account {
+		t.Errorf("expected links in order, got %+v", p.Links)
+	}
+	if !p.IsTwitchLive() || !p.IsLive() {
+		t.Errorf("expected the publisher to be live on twitch")
+	}
+}
+
+func testRevisions(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	created, err := s.UpsertPublisher("alice", setKey("k1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := s.GetPublisher("alice")
+	if p.Revision != 1 || created.Revision != 1 || created.Key != "k1" {
+		t.Fatalf("expected revision 1 after create, got %d (returned %+v)", p.Revision, created)
+	}
+	updated, err := s.UpdatePublisher("alice", func(p *models.Publisher) error {
+		p.Key = "k2"
+		// the revision is maintained by the store
+		p.Revision = 100
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ = s.GetPublisher("alice")
+	if p.Revision != 2 || updated.Revision != 2 || updated.Key != "k2" {
+		t.Fatalf("expected revision 2 after update, got %d (returned %+v)", p.Revision, updated)
+	}
+	s.UpdatePublisher("alice", func(p *models.Publisher) error { return errors.New("failed") })
+	p, _ = s.GetPublisher("alice")
+	if p.Revision != 2 {
+		t.Errorf("expected a failed update to keep revision 2, got %d", p.Revision)
+	}
+
+	// updates which change nothing are not written
+	for _, fn := range []func(p *models.Publisher) error{
+		setKey("k2"),
+		func(p *models.Publisher) error {
+			p.Links = []models.StreamLink{}
+			p.Muted = []string{}
+			return nil
+		},
+	} {
+		unchanged, err := s.UpdatePublisher("alice", fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unchanged.Revision != 2 || unchanged.Key != "k2" {
+			t.Errorf("expected the unchanged publisher with revision 2, got %+v", unchanged)
+		}
+	}
+	p, _ = s.GetPublisher("alice")
+	if p.Revision != 2 {
+		t.Errorf("expected unchanged updates to keep revision 2, got %d", p.Revision)
+	}
+	_, err = s.UpsertPublisher("alice", setKey("k2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ = s.GetPublisher("alice")
+	if p.Revision != 2 {
+		t.Errorf("expected an unchanged upsert to keep revision 2, got %d", p.Revision)
+	}
+
+	// live state is written without a new revision
+	_, err = s.UpdatePublisher("alice", func(p *models.Publisher) error {
+		p.RTMPLive = "live"
+		p.Links = []models.StreamLink{{Provider: "twitch", Account: "alice"}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := s.UpdatePublisher("alice", func(p *models.Publisher) error {
+		p.Links[0].Live = "live"
+		p.Links[0].State = models.StateLive
+		p.Links[0].Missed = 1
+		p.Links[0].Notification = "alice is live"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ = s.GetPublisher("alice")
+	if live.Revision != 3 || p.Revision != 3 || p.Links[0].Notification != "alice is live" {
+		t.Errorf("expected the live state to keep revision 3, got %+v", p)
+	}
+}
+
+// setDiscordID returns an update func which links a discord user
+func setDiscordID(id string) func(p *models.Publisher) error {
+	return func(p *models.Publisher) error {
+		p.Key = "key"
+		p.DiscordID = id
+		return nil
+	}
+}
+
+func testDiscordIDs(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	_, err := s.GetPublisherByDiscordID("1234")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an unlinked discord user, got %v", err)
+	}
+	_, err = s.UpsertPublisher("alice", setDiscordID("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpsertPublisher("bob", setDiscordID(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.GetPublisherByDiscordID("1234")
+	if err != nil || p.Name != "alice" {
+		t.Errorf("expected alice to be linked, got %+v (%v)", p, err)
+	}
+	_, err = s.GetPublisherByDiscordID("")
+	if err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for an empty discord id, got %v", err)
+	}
+
+	// a discord user is linked to a single publisher
+	for _, name := range []string{"bob", "carol"} {
+		_, err = s.UpsertPublisher(name, setDiscordID("1234"))
+		var taken *DiscordIDTakenError
+		if !errors.As(err, &taken) || taken.Publisher != "alice" {
+			t.Errorf("expected linking %s to fail, got %v", name, err)
+		}
+	}
+	if _, err = s.GetPublisher("carol"); err != ErrNotFound {
+		t.Errorf("expected carol not to be created, got %v", err)
+	}
+
+	// the discord user is free once unlinked or deleted
+	_, err = s.UpdatePublisher("alice", setDiscordID("5678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpdatePublisher("bob", setDiscordID("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeletePublisher("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpsertPublisher("carol", setDiscordID("5678"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, name := range map[string]string{"1234": "bob", "5678": "carol"} {
+		p, err = s.GetPublisherByDiscordID(id)
+		if err != nil || p.Name != name {
+			t.Errorf("expected %s to be linked to %s, got %+v (%v)", id, name, p, err)
+		}
+	}
+}
+
+func testQueryPublishers(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	for _, name := range []string{"alice", "alex", "bob", "carol", "dave"} {
+		name := name
+		_, err := s.UpsertPublisher(name, func(p *models.Publisher) error {
+			p.Key = "k"
+			switch name {
+			case "alex":
+				p.RTMPLive = "live"
+			case "bob":
+				p.Links = []models.StreamLink{{Provider: "twitch", Account: "bob_tv", LinkState: models.LinkState{Live: "live"}}}
+			case "carol":
+				p.Links = []models.StreamLink{{Provider: "twitch", Account: "carol_tv"}}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	yes, no := true, false
+	tests := []struct {
+		name  string
+		query PublisherQuery
+		want  []string
+		next  string
+	}{
+		{"all", PublisherQuery{}, []string{"alex", "alice", "bob", "carol", "dave"}, ""},
+		{"prefix", PublisherQuery{Prefix: "al"}, []string{"alex", "alice"}, ""},
+		{"first page", PublisherQuery{Limit: 2}, []string{"alex", "alice"}, "alice"},
+		{"next page", PublisherQuery{Limit: 2, After: "alice"}, []string{"bob", "carol"}, "carol"},
+		{"last page", PublisherQuery{Limit: 2, After: "carol"}, []string{"dave"}, ""},
+		{"descending", PublisherQuery{Descending: true, Limit: 2}, []string{"dave", "carol"}, "carol"},
+		{"descending next page", PublisherQuery{Descending: true, After: "carol"}, []string{"bob", "alice", "alex"}, ""},
+		{"live", PublisherQuery{Live: &yes}, []string{"alex", "bob"}, ""},
+		{"twitch live", PublisherQuery{TwitchLive: &yes}, []string{"bob"}, ""},
+		{"no twitch", PublisherQuery{HasTwitch: &no}, []string{"alex", "alice", "dave"}, ""},
+		{"filtered page", PublisherQuery{Live: &no, Limit: 2}, []string{"alice", "carol"}, "carol"},
+	}
+	for _, tc := range tests {
+		publishers, next, err := s.QueryPublishers(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for i := range publishers {
+			names = append(names, publishers[i].Name)
+		}
+		if !reflect.DeepEqual(names, tc.want) || next != tc.next {
+			t.Errorf("%s: expected %v (next: %q), got %v (next: %q)", tc.name, tc.want, tc.next, names, next)
+		}
+	}
+}
+
+func testSessions(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+
+	sessions, err := s.ListSessions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatalf("expected no sessions, got %d", len(sessions))
+	}
+
+	started := []models.Session{
+		{Publisher: "alice", Provider: models.SessionProviderRTMP, StartedAt: start},
+		{Publisher: "alice", Provider: "twitch", Account: "alice_tv", Title: "speedrun", Game: "Celeste", StartedAt: start.Add(time.Minute)},
+		{Publisher: "bob", Provider: models.SessionProviderRTMP, StartedAt: start.Add(2 * time.Minute)},
+	}
+	var lastID int64
+	for i := range started {
+		started[i], err = s.StartSession(started[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if started[i].ID <= lastID {
+			t.Fatalf("expected increasing session ids, got %d after %d", started[i].ID, lastID)
+		}
+		lastID = started[i].ID
+	}
+
+	end := start.Add(time.Hour)
+	err = s.EndSession("alice", models.SessionProviderRTMP, "", end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ending a session without an active session is not an error
+	err = s.EndSession("alice", models.SessionProviderRTMP, "", end.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions, err = s.ListSessions("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].ID != started[1].ID || sessions[1].ID != started[0].ID {
+		t.Fatalf("expected the sessions of alice most recent first, got %+v", sessions)
+	}
+	if !sessions[0].IsActive() || sessions[0].Title != "speedrun" || sessions[0].Game != "Celeste" || sessions[0].Account != "alice_tv" {
+		t.Errorf("unexpected twitch session: %+v", sessions[0])
+	}
+	if sessions[1].IsActive() || !sessions[1].EndedAt.Equal(end) || !sessions[1].StartedAt.Equal(start) {
+		t.Errorf("expected the rtmp session to end at %s, got %+v", end, sessions[1])
+	}
+
+	all, err := s.ListSessions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 || all[0].Publisher != "bob" || !all[0].IsActive() {
+		t.Errorf("expected all sessions most recent first, got %+v", all)
+	}
+
+	// imported sessions keep their id & new sessions are numbered after them
+	imported := models.Session{ID: lastID + 10, Publisher: "carol", Provider: models.SessionProviderRTMP, StartedAt: start, EndedAt: &end}
+	err = s.ImportSession(imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ImportSession(models.Session{ID: 0, Publisher: "carol"})
+	if err == nil {
+		t.Error("expected an error importing a session without an id")
+	}
+	next, err := s.StartSession(models.Session{Publisher: "carol", Provider: models.SessionProviderRTMP, StartedAt: end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.ID <= imported.ID {
+		t.Errorf("expected a session id after %d, got %d", imported.ID, next.ID)
+	}
+	sessions, _ = s.ListSessions("carol")
+	if len(sessions) != 2 || sessions[1].ID != imported.ID || !sessions[1].EndedAt.Equal(end) {
+		t.Errorf("expected the imported session, got %+v", sessions)
+	}
+
+	// imported open sessions are ended like started sessions, unless replaced
+	// by an ended session
+	open := models.Session{ID: next.ID + 1, Publisher: "dave", Provider: "twitch", Account: "dave_tv", StartedAt: start}
+	replaced := models.Session{ID: next.ID + 2, Publisher: "dave", Provider: "twitch", Account: "dave_tv", StartedAt: start}
+	for _, session := range []models.Session{open, replaced} {
+		err = s.ImportSession(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	replaced.EndedAt = &end
+	err = s.ImportSession(replaced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.EndSession("dave", "twitch", "dave_tv", end.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = s.ListSessions("dave")
+	if len(sessions) != 2 || !sessions[0].EndedAt.Equal(end) || !sessions[1].EndedAt.Equal(end.Add(time.Hour)) {
+		t.Errorf("expected the open imported session to end, got %+v", sessions)
+	}
+}
+
+func testTokens(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	_, err := s.GetToken("twitch")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	for _, token := range []string{"first", "second"} {
+		err = s.SetToken("twitch", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, err := s.GetToken("twitch")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != token {
+			t.Errorf("expected %s, got %s", token, value)
+		}
+	}
+	err = s.SetToken("twitch", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetToken("twitch")
+	if err != ErrNotFound {
+		t.Errorf("expected an empty token to remove the cache, got %v", err)
+	}
+}
+
+func testConfig(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	_, err := s.GetConfig("missing")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	values := map[string]string{"allow_list": `["1234"]`, "cache": "value", "empty": ""}
+	for k, v := range values {
+		err = s.SetConfig(k, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.SetConfig("cache", "replaced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values["cache"] = "replaced"
+	for k, v := range values {
+		value, err := s.GetConfig(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != v {
+			t.Errorf("%s: expected %q, got %q", k, v, value)
+		}
+	}
+	listed, err := s.ListConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, values) {
+		t.Errorf("expected %v without the schema version, got %v", values, listed)
+	}
+}
+
+// populate adds publishers, settings & sessions to a store
+func populate(t *testing.T, s Store) {
+	t.Helper()
+	_, err := s.UpsertPublisher("alice", func(p *models.Publisher) error {
+		p.Key = "alice-key"
+		p.DiscordID = "1234"
+		p.Muted = []string{models.NotifyLive}
+		p.Links = []models.StreamLink{
+			{Provider: "twitch", Account: "alice_tv", LinkState: models.LinkState{Live: "live", State: models.StateLive}},
+			{Provider: "peertube", Account: "https://peertube.example.com/c/alice"},
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpsertPublisher("bob", func(p *models.Publisher) error {
+		p.Key = "bob-key"
+		p.Unlisted = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetConfig("allow_list", `["1234"]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetToken("twitch", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	for _, session := range []models.Session{
+		{Publisher: "alice", Provider: models.SessionProviderRTMP, StartedAt: start, EndedAt: &end},
+		{Publisher: "alice", Provider: "twitch", Account: "alice_tv", Title: "speedrun", StartedAt: end},
+	} {
+		_, err = s.StartSession(session)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testExportImport(t *testing.T, backend string) {
+	source := openStore(t, backend)
+	populate(t, source)
+	exported, err := ExportData(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exported.Version != ExportVersion || len(exported.Publishers) != 2 || len(exported.Sessions) != 2 || len(exported.Settings) != 1 {
+		t.Fatalf("unexpected export: %+v", exported)
+	}
+	if exported.Sessions[0].ID > exported.Sessions[1].ID {
+		t.Errorf("expected sessions in chronological order")
+	}
+
+	// exports are imported into either backend
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			target := openStore(t, b.name)
+			report, err := ImportData(target, exported, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Changes) != 4 {
+				t.Errorf("expected 4 changes, got %v", report.Changes)
+			}
+			publishers, _ := target.ListPublishers()
+			if len(publishers) != 0 {
+				t.Fatal("expected a dry run to leave the store unmodified")
+			}
+
+			_, err = ImportData(target, exported, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			imported, err := ExportData(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range exported.Publishers {
+				want, got := exported.Publishers[i], imported.Publishers[i]
+				if got.Name != want.Name || got.Key != want.Key || got.Unlisted != want.Unlisted ||
+					got.DiscordID != want.DiscordID || !reflect.DeepEqual(got.Muted, want.Muted) || !sameLinks(got.Links, want.Links) {
+					t.Errorf("expected publisher %+v, got %+v", want, got)
+				}
+				// imported links start offline
+				for _, l := range got.Links {
+					if l.Live != "" {
+						t.Errorf("expected imported link %s to be offline", l.Account)
+					}
+				}
+			}
+			if !reflect.DeepEqual(imported.Settings, exported.Settings) {
+				t.Errorf("expected settings %v, got %v", exported.Settings, imported.Settings)
+			}
+			for i := range exported.Sessions {
+				if !sameSession(imported.Sessions[i], exported.Sessions[i]) {
+					t.Errorf("expected session %+v, got %+v", exported.Sessions[i], imported.Sessions[i])
+				}
+			}
+			_, err = target.GetToken("twitch")
+			if err != ErrNotFound {
+				t.Errorf("expected access tokens not to be exported, got %v", err)
+			}
+
+			report, err = ImportData(target, exported, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Changes) != 0 || report.Unchanged != 5 {
+				t.Errorf("expected a repeated import to change nothing, got %+v", report)
+			}
+		})
+	}
+
+	exported.Version = ExportVersion + 1
+	_, err = ImportData(openStore(t, backend), exported, false)
+	if err == nil {
+		t.Error("expected an error importing an unsupported version")
+	}
+}
+
+func testBackup(t *testing.T, backend string) {
+	s := openStore(t, backend)
+	populate(t, s)
+	problems, err := s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("expected no integrity problems, got %v", problems)
+	}
+	var buf countingWriter
+	n, err := s.Backup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 || n != int64(buf) {
+		t.Errorf("expected the snapshot size %d to match the bytes written %d", n, buf)
+	}
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter int
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	*w += countingWriter(len(b))
+	return len(b), nil
+}